@@ -0,0 +1,181 @@
+package users
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/golang-jwt/jwt"
+)
+
+// authentication errors
+var (
+	ErrMissingToken = newError("missing_token", http.StatusUnauthorized, "missing bearer token")
+	ErrInvalidToken = newError("invalid_token", http.StatusUnauthorized, "invalid bearer token")
+	ErrTokenExpired = newError("token_expired", http.StatusUnauthorized, "bearer token expired")
+)
+
+type contextKey int
+
+const (
+	bearerTokenContextKey contextKey = iota
+	principalContextKey
+	preconditionContextKey
+	clientIPContextKey
+	apiKeyContextKey
+	rateLimitContextKey
+)
+
+// ContextWithToken returns a copy of ctx carrying the bearer token. On the
+// client side it is sent along with the request, see ContextToHTTP.
+func ContextWithToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, bearerTokenContextKey, token)
+}
+
+// PrincipalFromContext returns the verified claims of the caller, put in the
+// context by Authenticated or OptionallyAuthenticated.
+func PrincipalFromContext(ctx context.Context) (Claims, bool) {
+	c, ok := ctx.Value(principalContextKey).(Claims)
+	return c, ok
+}
+
+// HTTPToContext moves a bearer token from the Authorization header to the
+// context. Use it as an httptransport.ServerBefore hook.
+func HTTPToContext() httptransport.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		header := r.Header.Get("Authorization")
+		if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+			return ctx
+		}
+		return ContextWithToken(ctx, header[7:])
+	}
+}
+
+// ContextToHTTP moves a bearer token from the context to the Authorization
+// header. Use it as an httptransport.ClientBefore hook.
+func ContextToHTTP() httptransport.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		if token, ok := ctx.Value(bearerTokenContextKey).(string); ok {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		return ctx
+	}
+}
+
+// ParseToken verifies the signature and validity of token and returns its
+// claims. Only tokens signed with the method of keys are accepted.
+func ParseToken(keys TokenKeys, token string) (Claims, error) {
+	var claims Claims
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method.Alg() != keys.Method.Alg() {
+			return nil, ErrInvalidToken
+		}
+		return keys.VerifyKey, nil
+	})
+	if ve, ok := err.(*jwt.ValidationError); ok && ve.Errors&jwt.ValidationErrorExpired != 0 {
+		return Claims{}, ErrTokenExpired
+	}
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// Authenticated returns an endpoint middleware rejecting requests without a
+// valid bearer token in the context. The claims of the token are put in the
+// context for the next endpoint, see PrincipalFromContext.
+func Authenticated(keys TokenKeys) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			token, ok := ctx.Value(bearerTokenContextKey).(string)
+			if !ok {
+				return nil, ErrMissingToken
+			}
+			claims, err := ParseToken(keys, token)
+			if err != nil {
+				return nil, err
+			}
+			return next(context.WithValue(ctx, principalContextKey, claims), request)
+		}
+	}
+}
+
+// OptionallyAuthenticated is like Authenticated, but lets anonymous requests
+// through. A token, if present, must still be valid.
+func OptionallyAuthenticated(keys TokenKeys) endpoint.Middleware {
+	authenticated := Authenticated(keys)
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		withPrincipal := authenticated(next)
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if _, ok := ctx.Value(bearerTokenContextKey).(string); !ok {
+				return next(ctx, request)
+			}
+			return withPrincipal(ctx, request)
+		}
+	}
+}
+
+// TokenSource supplies the bearer tokens attached by a client.
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// StaticTokenSource always supplies the same token.
+type StaticTokenSource string
+
+// Token implements TokenSource.
+func (t StaticTokenSource) Token(context.Context) (string, error) { return string(t), nil }
+
+// expiryLeeway is how long before its expiry a cached token is renewed.
+const expiryLeeway = 30 * time.Second
+
+type loginTokenSource struct {
+	login              endpoint.Endpoint
+	username, password string
+
+	mtx   sync.Mutex
+	token Token
+}
+
+// NewLoginTokenSource returns a TokenSource logging in through the login
+// endpoint, e.g. Endpoints.LoginEndpoint, and caching the token until it's
+// about to expire.
+func NewLoginTokenSource(login endpoint.Endpoint, username, password string) TokenSource {
+	return &loginTokenSource{login: login, username: username, password: password}
+}
+
+func (s *loginTokenSource) Token(ctx context.Context) (string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.token.AccessToken != "" && time.Until(s.token.ExpiresAt) > expiryLeeway {
+		return s.token.AccessToken, nil
+	}
+	response, err := s.login(ctx, loginRequest{Username: s.username, Password: s.password})
+	if err != nil {
+		return "", err
+	}
+	resp := response.(loginResponse)
+	if resp.Err != nil {
+		return "", resp.Err
+	}
+	s.token = resp.Token
+	return s.token.AccessToken, nil
+}
+
+// WithTokenSource returns a client endpoint middleware putting a token from
+// source in the context, to be sent by ContextToHTTP.
+func WithTokenSource(source TokenSource) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			token, err := source.Token(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return next(ContextWithToken(ctx, token), request)
+		}
+	}
+}
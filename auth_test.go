@@ -0,0 +1,78 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHTTPBearerToken(t *testing.T) {
+	ts := newTestServer(t)
+	ts.seed(User{Username: "alice", Email: "alice@example.com", Password: testPassword, Role: "user"})
+	expired, err := tokenIssuer{keys: ts.keys, issuer: "test", ttl: time.Minute, now: func() time.Time { return time.Now().Add(-time.Hour) }}.
+		Issue(User{Username: "alice", Role: "user"}, AMRPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := ts.token("alice", "user")
+
+	for _, tc := range []struct {
+		name          string
+		authorization string
+		wantCode      int
+		wantErr       string
+	}{
+		{"bearer", "Bearer " + valid, http.StatusOK, ""},
+		{"scheme case", "bearer " + valid, http.StatusOK, ""},
+		{"missing", "", http.StatusUnauthorized, "missing_token"},
+		{"other scheme", "Basic YWxpY2U6c2VjcmV0", http.StatusUnauthorized, "missing_token"},
+		{"invalid", "Bearer " + valid[:len(valid)-2], http.StatusUnauthorized, "invalid_token"},
+		{"expired", "Bearer " + expired.AccessToken, http.StatusUnauthorized, "token_expired"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, body := ts.do("GET", "/users/alice", "", nil, "Authorization", tc.authorization)
+			if resp.StatusCode != tc.wantCode {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tc.wantCode, body)
+			}
+			if got := problemCode(body); got != tc.wantErr {
+				t.Errorf("problem = %q, want %q", got, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthenticatedClient(t *testing.T) {
+	ts := newTestServer(t)
+	ts.seed(User{Username: "alice", Email: "alice@example.com", Password: testPassword, Role: "user"})
+	login, err := MakeClientEndpoints(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		source  TokenSource
+		wantErr error
+	}{
+		{"login", NewLoginTokenSource(login.LoginEndpoint, "alice", testPassword), nil},
+		{"static", StaticTokenSource(ts.token("alice", "user")), nil},
+		{"wrong password", NewLoginTokenSource(login.LoginEndpoint, "alice", "wrong"), ErrInvalidCredentials},
+		{"invalid token", StaticTokenSource("garbage"), ErrInvalidToken},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e, err := MakeAuthenticatedClientEndpoints(ts.URL, tc.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := e.GetUser(context.Background(), "alice")
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tc.wantErr)
+			}
+			if err == nil && u.Username != "alice" {
+				t.Errorf("got user %+v, want alice", u)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/circuitbreaker"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	"github.com/go-kit/kit/sd/lb"
+	"github.com/sony/gobreaker"
+)
+
+// ClientOption sets an optional parameter of balanced clients, see
+// MakeBalancedClientEndpoints.
+type ClientOption func(*clientOptions)
+
+type clientOptions struct {
+	timeout      time.Duration
+	attempts     int
+	retryTimeout time.Duration
+	breaker      gobreaker.Settings
+	source       TokenSource
+	logger       log.Logger
+}
+
+// Defaults of balanced clients.
+const (
+	DefaultCallTimeout  = 5 * time.Second
+	DefaultAttempts     = 3
+	DefaultRetryTimeout = 15 * time.Second
+)
+
+// DefaultBreakerSettings open the circuit to an instance after 5 consecutive
+// failures, and try it again after 30 seconds.
+var DefaultBreakerSettings = gobreaker.Settings{
+	Timeout: 30 * time.Second,
+	ReadyToTrip: func(c gobreaker.Counts) bool {
+		return c.ConsecutiveFailures >= 5
+	},
+}
+
+// WithCallTimeout bounds each call to an instance, DefaultCallTimeout by
+// default.
+func WithCallTimeout(d time.Duration) ClientOption {
+	return func(o *clientOptions) { o.timeout = d }
+}
+
+// WithRetries makes idempotent calls, those over GET, PUT and DELETE, up to
+// attempts times, on the next instance each time, within timeout overall.
+// Other calls are only made once, since they might have gone through.
+func WithRetries(attempts int, timeout time.Duration) ClientOption {
+	return func(o *clientOptions) { o.attempts, o.retryTimeout = attempts, timeout }
+}
+
+// WithBreakerSettings overrides DefaultBreakerSettings. Every instance has a
+// circuit breaker of its own, named after it.
+func WithBreakerSettings(s gobreaker.Settings) ClientOption {
+	return func(o *clientOptions) { o.breaker = s }
+}
+
+// WithClientTokenSource attaches a bearer token from source to every request
+// except logins, as MakeAuthenticatedClientEndpoints.
+func WithClientTokenSource(source TokenSource) ClientOption {
+	return func(o *clientOptions) { o.source = source }
+}
+
+// WithClientLogger logs changes to the instances, and of the state of their
+// circuit breakers.
+func WithClientLogger(logger log.Logger) ClientOption {
+	return func(o *clientOptions) { o.logger = logger }
+}
+
+// clientEndpoints lists the client endpoints of Endpoints, with the HTTP
+// method they use, which tells whether they may be retried.
+var clientEndpoints = []struct {
+	name   string
+	method string
+	field  func(*Endpoints) *endpoint.Endpoint
+}{
+	{"PostUser", "POST", func(e *Endpoints) *endpoint.Endpoint { return &e.PostUserEndpoint }},
+	{"GetUser", "GET", func(e *Endpoints) *endpoint.Endpoint { return &e.GetUserEndpoint }},
+	{"PutUser", "PUT", func(e *Endpoints) *endpoint.Endpoint { return &e.PutUserEndpoint }},
+	{"PatchUser", "PATCH", func(e *Endpoints) *endpoint.Endpoint { return &e.PatchUserEndpoint }},
+	{"DeleteUser", "DELETE", func(e *Endpoints) *endpoint.Endpoint { return &e.DeleteUserEndpoint }},
+	{"RestoreUser", "POST", func(e *Endpoints) *endpoint.Endpoint { return &e.RestoreUserEndpoint }},
+	{"PurgeUser", "POST", func(e *Endpoints) *endpoint.Endpoint { return &e.PurgeUserEndpoint }},
+	{"UnlockUser", "POST", func(e *Endpoints) *endpoint.Endpoint { return &e.UnlockUserEndpoint }},
+	{"ListUsers", "GET", func(e *Endpoints) *endpoint.Endpoint { return &e.ListUsersEndpoint }},
+	{"Login", "POST", func(e *Endpoints) *endpoint.Endpoint { return &e.LoginEndpoint }},
+	{"Refresh", "POST", func(e *Endpoints) *endpoint.Endpoint { return &e.RefreshEndpoint }},
+	{"Logout", "POST", func(e *Endpoints) *endpoint.Endpoint { return &e.LogoutEndpoint }},
+	{"RevokeSessions", "DELETE", func(e *Endpoints) *endpoint.Endpoint { return &e.RevokeSessionsEndpoint }},
+	{"EnrollMFA", "POST", func(e *Endpoints) *endpoint.Endpoint { return &e.EnrollMFAEndpoint }},
+	{"ConfirmMFA", "POST", func(e *Endpoints) *endpoint.Endpoint { return &e.ConfirmMFAEndpoint }},
+	{"RegenerateRecoveryCodes", "POST", func(e *Endpoints) *endpoint.Endpoint { return &e.RegenerateRecoveryCodesEndpoint }},
+	{"RequestPasswordReset", "POST", func(e *Endpoints) *endpoint.Endpoint { return &e.RequestPasswordResetEndpoint }},
+	{"ResetPassword", "POST", func(e *Endpoints) *endpoint.Endpoint { return &e.ResetPasswordEndpoint }},
+	{"VerifyEmail", "POST", func(e *Endpoints) *endpoint.Endpoint { return &e.VerifyEmailEndpoint }},
+}
+
+// MakeBalancedClientEndpoints is like MakeClientEndpoints, but spreads calls
+// over the instances of instancer, round-robin. Instancers may be static, as
+// sd.FixedInstancer{"host1:8080", "host2:8080"}, or follow DNS SRV records,
+// see dnssrv.NewInstancer, or a file, see NewFileInstancer.
+//
+// Calls to an instance time out, see WithCallTimeout, and go through a circuit
+// breaker of the instance, see WithBreakerSettings. Idempotent calls are
+// retried on other instances, see WithRetries. Instances failing with 502, 503
+// or 504 count as failed, like unreachable ones.
+func MakeBalancedClientEndpoints(instancer sd.Instancer, options ...ClientOption) Endpoints {
+	o := clientOptions{
+		timeout:      DefaultCallTimeout,
+		attempts:     DefaultAttempts,
+		retryTimeout: DefaultRetryTimeout,
+		breaker:      DefaultBreakerSettings,
+		logger:       log.NewNopLogger(),
+	}
+	for _, option := range options {
+		option(&o)
+	}
+
+	var (
+		mtx      sync.Mutex
+		breakers = map[string]endpoint.Middleware{}
+	)
+	breaker := func(instance string) endpoint.Middleware {
+		mtx.Lock()
+		defer mtx.Unlock()
+		b, ok := breakers[instance]
+		if !ok {
+			s := o.breaker
+			s.Name = instance
+			if s.OnStateChange == nil {
+				s.OnStateChange = func(name string, from, to gobreaker.State) {
+					o.logger.Log("instance", name, "breaker", to.String(), "was", from.String())
+				}
+			}
+			b = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(s))
+			breakers[instance] = b
+		}
+		return b
+	}
+
+	var e Endpoints
+	for _, ce := range clientEndpoints {
+		ce := ce
+		factory := func(instance string) (endpoint.Endpoint, io.Closer, error) {
+			c, err := MakeClientEndpoints(instance)
+			if err != nil {
+				return nil, nil, err
+			}
+			next := unavailableAsError(*ce.field(&c))
+			return breaker(instance)(withTimeout(o.timeout)(next)), nil, nil
+		}
+		endpointer := sd.NewEndpointer(instancer, factory, log.With(o.logger, "endpoint", ce.name))
+		attempts := 1
+		if ce.method == "GET" || ce.method == "PUT" || ce.method == "DELETE" {
+			attempts = o.attempts
+		}
+		*ce.field(&e) = lastError(lb.Retry(attempts, o.retryTimeout, lb.NewRoundRobin(endpointer)))
+	}
+	if o.source != nil {
+		e = withTokenSource(e, o.source)
+	}
+	return e
+}
+
+// withTimeout bounds calls to next by d.
+func withTimeout(d time.Duration) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+			return next(ctx, request)
+		}
+	}
+}
+
+// unavailableAsError turns responses telling that the instance can't serve
+// the request right now into errors, which trip circuit breakers and are
+// retried. Other errors are part of the response, see decodeProblem.
+func unavailableAsError(next endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		response, err := next(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		if r, ok := response.(errorer); ok && r.error() != nil {
+			switch errorFrom(r.error()).Status {
+			case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+				return nil, r.error()
+			}
+		}
+		return response, nil
+	}
+}
+
+// lastError returns the last error of failed retries, rather than an
+// lb.RetryError, so callers get the same errors as from MakeClientEndpoints.
+func lastError(next endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		response, err := next(ctx, request)
+		var re lb.RetryError
+		if errors.As(err, &re) {
+			err = re.Final
+		}
+		return response, err
+	}
+}
@@ -0,0 +1,143 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	"github.com/sony/gobreaker"
+)
+
+func TestBalancedClient(t *testing.T) {
+	trip := gobreaker.Settings{
+		Timeout:     time.Hour,
+		ReadyToTrip: func(c gobreaker.Counts) bool { return c.ConsecutiveFailures >= 2 },
+	}
+	for _, tc := range []struct {
+		name      string
+		instances []string // "up" or "down"
+		options   []ClientOption
+		call      string // "get", "get unknown" or "post"
+		calls     int
+		wantErr   []error  // of each call
+		wantDown  [2]int32 // least and most calls reaching the instances down
+	}{
+		{"retried on the next instance", []string{"down", "up"}, []ClientOption{WithRetries(3, time.Second)},
+			"get", 2, []error{nil, nil}, [2]int32{1, 2}},
+		{"retries exhausted", []string{"down"}, []ClientOption{WithRetries(3, time.Second)},
+			"get", 1, []error{errBadGateway}, [2]int32{3, 3}},
+		{"not retried", []string{"down", "up"}, []ClientOption{WithRetries(3, time.Second)},
+			"post", 2, nil, [2]int32{1, 1}},
+		{"breaker opens", []string{"down"}, []ClientOption{WithRetries(1, time.Second), WithBreakerSettings(trip)},
+			"get", 3, []error{errBadGateway, errBadGateway, gobreaker.ErrOpenState}, [2]int32{2, 2}},
+		{"client errors don't trip the breaker", []string{"up"}, []ClientOption{WithRetries(1, time.Second), WithBreakerSettings(trip)},
+			"get unknown", 3, []error{ErrNotFound, ErrNotFound, ErrNotFound}, [2]int32{0, 0}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.seed(User{Username: "alice", Email: "alice@example.com", Password: testPassword, Role: "user"})
+			var down int32
+			unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&down, 1)
+				http.Error(w, "upstream unavailable", http.StatusBadGateway)
+			}))
+			defer unavailable.Close()
+
+			var instances sd.FixedInstancer
+			for _, s := range tc.instances {
+				if s == "up" {
+					instances = append(instances, ts.URL)
+				} else {
+					instances = append(instances, unavailable.URL)
+				}
+			}
+			sort.Strings(instances) // as endpointers sort them, in place
+			options := append(tc.options, WithClientTokenSource(StaticTokenSource(ts.token("admin", "admin"))))
+			c := MakeBalancedClientEndpoints(instances, options...)
+
+			var failed int
+			for i := 0; i < tc.calls; i++ {
+				ctx := context.Background()
+				var err error
+				switch tc.call {
+				case "get":
+					_, err = c.GetUser(ctx, "alice")
+				case "get unknown":
+					_, err = c.GetUser(ctx, "carol")
+				case "post":
+					err = c.PostUser(ctx, User{Username: fmt.Sprintf("bob%d", i), Email: fmt.Sprintf("bob%d@example.com", i), Password: testPassword, Role: "user"})
+				}
+				if tc.wantErr == nil {
+					if err != nil {
+						failed++
+					}
+					continue
+				}
+				if want := tc.wantErr[i]; (want == nil) != (err == nil) || (want != nil && !errors.Is(err, want)) {
+					t.Errorf("call %d: err = %v, want %v", i, err, want)
+				}
+			}
+			// Round-robin, exactly one of the calls not retried goes to the
+			// instance down.
+			if tc.wantErr == nil && failed != 1 {
+				t.Errorf("%d calls failed, want 1", failed)
+			}
+			if got := atomic.LoadInt32(&down); got < tc.wantDown[0] || got > tc.wantDown[1] {
+				t.Errorf("instances down were called %d times, want %d to %d", got, tc.wantDown[0], tc.wantDown[1])
+			}
+		})
+	}
+}
+
+// errBadGateway is the error of instances failing with 502, as a proxy in
+// front of an instance that is down would.
+var errBadGateway = &Error{Code: "unknown", Status: http.StatusBadGateway}
+
+func TestFileInstancer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "instances")
+	write := func(s string) {
+		if err := ioutil.WriteFile(path, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("# users\nhost1:8080\n\n  host2:8080 # canary\n")
+	in := NewFileInstancer(path, 10*time.Millisecond, log.NewNopLogger())
+	defer in.Stop()
+	events := make(chan sd.Event, 1)
+	in.Register(events)
+	defer in.Deregister(events)
+
+	for i, tc := range []struct {
+		change    func()
+		want      []string
+		wantError bool
+	}{
+		{func() {}, []string{"host1:8080", "host2:8080"}, false},
+		{func() { write("host3:8080\n") }, []string{"host3:8080"}, false},
+		{func() { write("host4:8080\nhost3:8080\n") }, []string{"host3:8080", "host4:8080"}, false},
+		{func() { os.Remove(path) }, []string{"host3:8080", "host4:8080"}, true},
+		{func() { write("host1:8080\n") }, []string{"host1:8080"}, false},
+	} {
+		tc.change()
+		select {
+		case ev := <-events:
+			if !reflect.DeepEqual(ev.Instances, tc.want) || (ev.Err != nil) != tc.wantError {
+				t.Errorf("event %d = %+v, want instances %v, error %v", i, ev, tc.want, tc.wantError)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d: timed out", i)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package users
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	grpctransport "github.com/go-kit/kit/transport/grpc"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// ContextWithClientIP returns a copy of ctx carrying the IP address of the
+// client a request comes from.
+func ContextWithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPContextKey, ip)
+}
+
+// ClientIPFromContext returns the IP address of the client, as set by
+// HTTPClientIPToContext or GRPCClientIPToContext.
+func ClientIPFromContext(ctx context.Context) (string, bool) {
+	ip, ok := ctx.Value(clientIPContextKey).(string)
+	return ip, ok && ip != ""
+}
+
+// HTTPClientIPToContext moves the client IP of a request to the context. Behind
+// trusted proxies, it's taken from X-Forwarded-For, see WithTrustedProxies. Use it as an httptransport.ServerBefore hook.
+func HTTPClientIPToContext(proxies int) httptransport.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		return ContextWithClientIP(ctx, clientIP(r.RemoteAddr, r.Header.Values("X-Forwarded-For"), proxies))
+	}
+}
+
+// GRPCClientIPToContext is like HTTPClientIPToContext, with the peer address
+// and the x-forwarded-for metadata. Use it as a grpctransport.ServerBefore
+// hook.
+func GRPCClientIPToContext(proxies int) grpctransport.ServerRequestFunc {
+	return func(ctx context.Context, md metadata.MD) context.Context {
+		var addr string
+		if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+			addr = p.Addr.String()
+		}
+		return ContextWithClientIP(ctx, clientIP(addr, md.Get("x-forwarded-for"), proxies))
+	}
+}
+
+// clientIP returns the IP of the client of a request from remoteAddr through
+// the given number of proxies, each appending the address it got the request
+// from to forwarded. Entries further left are set by the client, and can't be
+// trusted.
+func clientIP(remoteAddr string, forwarded []string, proxies int) string {
+	if proxies > 0 {
+		var hops []string
+		for _, v := range forwarded {
+			for _, hop := range strings.Split(v, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+		if len(hops) >= proxies {
+			return hops[len(hops)-proxies]
+		}
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
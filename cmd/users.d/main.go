@@ -1,34 +1,83 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
+	"net/smtp"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/go-kit/kit/log"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	kitgrpc "github.com/go-kit/kit/transport/grpc"
 	"github.com/jinzhu/gorm"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
 
 	svc "github.com/AndrewSC208/user-service-go-kit"
+	"github.com/AndrewSC208/user-service-go-kit/pb"
 )
 
+// adminShutdownTimeout bounds the shutdown of the admin server, serving
+// requests as short as metrics scrapes.
+const adminShutdownTimeout = 5 * time.Second
+
 func main() {
+	os.Exit(run())
+}
+
+// run runs the service until it is shut down, returning the exit code. Exiting
+// from main instead lets the deferred calls, flushing traces, run first.
+func run() int {
 	var (
-		httpAddr = flag.String("http.addr", ":8080", "HTTP listen address")
-		storeUrl = flag.String("db.url", "postgresql://root@localhost:26257/bank?sslmode=disable", "STORE db url")
+		httpAddr     = flag.String("http.addr", ":8080", "HTTP listen address")
+		readTimeout  = flag.Duration("http.read-timeout", 10*time.Second, "maximum duration for reading a request")
+		writeTimeout = flag.Duration("http.write-timeout", 30*time.Second, "maximum duration before timing out writes of a response")
+		idleTimeout  = flag.Duration("http.idle-timeout", 2*time.Minute, "how long to keep idle keep-alive connections open")
+		grpcAddr     = flag.String("grpc.addr", ":8082", "gRPC listen address")
+		adminAddr    = flag.String("admin.addr", ":8081", "admin HTTP listen address, serving /metrics")
+		proxies      = flag.Int("http.proxies", 0, "number of trusted reverse proxies setting X-Forwarded-For in front of the service")
+		ifMatch      = flag.Bool("http.require-if-match", false, "reject PUT, PATCH and DELETE without If-Match or If-None-Match with 428")
+		traceExp     = flag.String("trace.exporter", "none", "trace exporter: none, stdout, file or otlp")
+		traceDest    = flag.String("trace.target", "localhost:4317", "OTLP collector address, or file path for the file exporter")
+		traceRatio   = flag.Float64("trace.ratio", 1, "fraction of new traces sampled")
+		storeUrl     = flag.String("db.url", "postgresql://root@localhost:26257/bank?sslmode=disable", "STORE db url")
+		inmem        = flag.Bool("db.inmem", false, "use an in-memory store instead of the database")
+		migrate      = flag.Bool("db.migrate", false, "apply pending migrations at startup")
+		jwtAlg       = flag.String("jwt.alg", svc.AlgHS256, "JWT signing algorithm: HS256, RS256 or EdDSA")
+		jwtKey       = flag.String("jwt.key", "", "PEM private key file, for RS256 and EdDSA")
+		jwtIss       = flag.String("jwt.issuer", "users.d", "JWT issuer claim")
+		jwtTTL       = flag.Duration("jwt.ttl", 15*time.Minute, "access token lifetime")
+		refreshTTL   = flag.Duration("jwt.refresh-ttl", svc.DefaultRefreshTTL, "refresh token lifetime")
+		policyFile   = flag.String("policy.file", "", "JSON roles and permissions file, defaults to the built-in policy")
+		retention    = flag.Duration("users.retention", svc.DefaultRetention, "how long deleted users can be restored before being purged")
+		purgeEvery   = flag.Duration("users.purge-interval", time.Hour, "how often to purge users deleted past the retention period")
+		smtpAddr     = flag.String("mail.smtp", "", "SMTP server address; without it, mails are written to -mail.dir")
+		mailDir      = flag.String("mail.dir", "mail", "directory mails are written to, without -mail.smtp")
+		mailFrom     = flag.String("mail.from", "users.d@localhost", "sender address of mails")
+		resetURL     = flag.String("reset.url", "http://localhost:8080/reset-password", "page password reset links point to, with the token as query parameter")
+		resetTTL     = flag.Duration("reset.ttl", svc.DefaultPasswordResetTTL, "password reset token lifetime")
+		verifyURL    = flag.String("verify.url", "http://localhost:8080/verify-email", "page email verification links point to, with the username and token as query parameters")
+		verifyTTL    = flag.Duration("verify.ttl", svc.DefaultEmailVerificationTTL, "email verification link lifetime")
+		lockUser     = flag.Int("lockout.threshold", svc.DefaultAccountLockout.Threshold, "failed logins locking an account out, 0 to disable")
+		lockIP       = flag.Int("lockout.ip-threshold", svc.DefaultIPLockout.Threshold, "failed logins locking an IP out, 0 to disable")
+		limitsFile   = flag.String("ratelimit.file", "", "JSON rate limits file, by endpoint, defaults to the built-in limits")
+		noLimits     = flag.Bool("ratelimit.disable", false, "don't rate limit requests")
+		apiKeys      = flag.Bool("ratelimit.api-keys", false, "count rate limits by the X-API-Key header, set by a trusted gateway")
+		drainDelay   = flag.Duration("shutdown.delay", 5*time.Second, "how long to report unready before draining, for load balancers to notice")
+		grace        = flag.Duration("shutdown.grace", 30*time.Second, "how long to wait for requests in flight to finish when shutting down")
 	)
 	flag.Parse()
 
-	db, err := gorm.Open("postgres", storeUrl)
-	if err != nil {
-		panic("failed to connect database")
-	}
-	defer db.Close()
-
-	db.AutoMigrate(&svc.UserModel{})
-
 	var logger log.Logger
 	{
 		logger = log.NewLogfmtLogger(os.Stderr)
@@ -36,31 +85,366 @@ func main() {
 		logger = log.With(logger, "caller", log.DefaultCaller)
 	}
 
+	shutdownTracing, err := setupTracing(*traceExp, *traceDest, *traceRatio)
+	if err != nil {
+		panic(fmt.Sprintf("failed to set up tracing: %v", err))
+	}
+	defer shutdownTracing(context.Background())
+
+	if flag.Arg(0) == "migrate" && *inmem {
+		fmt.Fprintln(os.Stderr, "migrate needs a database, not -db.inmem")
+		return 2
+	}
+
+	// Readiness checks are registered along with the dependencies they check.
+	health := svc.NewHealth(svc.DefaultCheckTimeout)
+
+	var (
+		repo     svc.UserRepository
+		sessions svc.RefreshTokenRepository
+		resets   svc.PasswordResetRepository
+		attempts svc.AttemptCounter
+		closeDB  = func() error { return nil }
+	)
+	if *inmem {
+		repo = svc.NewInmemRepository()
+		sessions = svc.NewInmemRefreshTokenRepository()
+		resets = svc.NewInmemPasswordResetRepository()
+		attempts = svc.NewInmemAttemptCounter()
+	} else {
+		db, err := gorm.Open("postgres", *storeUrl)
+		if err != nil {
+			panic("failed to connect database")
+		}
+		closeDB = db.Close
+
+		if flag.Arg(0) == "migrate" {
+			err := runMigrate(db.DB(), flag.Args()[1:], os.Stdout)
+			db.Close()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			return 0
+		}
+
+		// Schema changes are reviewed migrations, applied by an operator with
+		// the migrate subcommand, or here when asked to.
+		m, err := svc.NewMigrator(db.DB())
+		if err != nil {
+			panic(err)
+		}
+		if *migrate {
+			applied, err := m.Up(context.Background())
+			if err != nil {
+				panic(fmt.Sprintf("failed to migrate database: %v", err))
+			}
+			logger.Log("migrations", len(applied))
+		} else if pending, err := m.Pending(context.Background()); err != nil || pending > 0 {
+			panic(fmt.Sprintf("database not migrated (%d pending, err=%v): run users.d migrate up", pending, err))
+		}
+
+		health.Register("database", svc.DatabaseChecker(db.DB()))
+		health.Register("migrations", svc.MigrationChecker(m))
+
+		svc.TraceGorm(db)
+		repo = svc.NewGormRepository(db)
+		sessions = svc.NewGormRefreshTokenRepository(db)
+		resets = svc.NewGormPasswordResetRepository(db)
+		attempts = svc.NewGormAttemptCounter(db)
+	}
+
+	var keys svc.TokenKeys
+	if *jwtAlg == svc.AlgHS256 {
+		secret := os.Getenv("JWT_SECRET")
+		if secret == "" {
+			panic("JWT_SECRET must be set for HS256")
+		}
+		keys = svc.NewHS256Keys([]byte(secret))
+	} else {
+		var err error
+		if keys, err = svc.LoadTokenKeys(*jwtAlg, *jwtKey); err != nil {
+			panic(fmt.Sprintf("failed to load JWT key: %v", err))
+		}
+	}
+
+	// TOTP secrets are encrypted with a key kept out of the database. The
+	// in-memory store forgets them on exit anyway, so it makes do with a
+	// throwaway key.
+	var secrets svc.SecretBox
+	{
+		var key []byte
+		if env := os.Getenv("MFA_KEY"); env == "" && *inmem {
+			key = throwawayKey(logger, "MFA_KEY")
+		} else if key, err = base64.StdEncoding.DecodeString(env); err != nil || len(key) != 32 {
+			panic("MFA_KEY must be set to a base64 encoded 32 byte key")
+		}
+		if secrets, err = svc.NewAESSecretBox(key); err != nil {
+			panic(err)
+		}
+	}
+
+	var mailer svc.Mailer
+	if *smtpAddr != "" {
+		var auth smtp.Auth
+		if user := os.Getenv("SMTP_USERNAME"); user != "" {
+			host, _, _ := net.SplitHostPort(*smtpAddr)
+			auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+		}
+		mailer = svc.NewSMTPMailer(*smtpAddr, *mailFrom, auth)
+	} else {
+		mailer = svc.NewFileMailer(*mailDir, *mailFrom)
+	}
+
+	verifyKey := []byte(os.Getenv("EMAIL_VERIFY_KEY"))
+	if len(verifyKey) == 0 {
+		if !*inmem {
+			panic("EMAIL_VERIFY_KEY must be set to sign email verification links")
+		}
+		verifyKey = throwawayKey(logger, "EMAIL_VERIFY_KEY")
+	}
+
+	policy := svc.DefaultPolicy
+	if *policyFile != "" {
+		var err error
+		if policy, err = svc.LoadPolicy(*policyFile); err != nil {
+			panic(fmt.Sprintf("failed to load policy: %v", err))
+		}
+	}
+
+	limits := svc.DefaultRateLimits
+	if *limitsFile != "" {
+		var err error
+		if limits, err = svc.LoadRateLimits(*limitsFile); err != nil {
+			panic(fmt.Sprintf("failed to load rate limits: %v", err))
+		}
+	}
+
 	var s svc.Service
 	{
 		// create new service, and pass store in
-		s = svc.NewService(*db)
+		s = svc.NewService(repo,
+			svc.WithLogger(log.With(logger, "component", "service")),
+			svc.WithTokenIssuer(svc.NewTokenIssuer(keys, *jwtIss, *jwtTTL)),
+			svc.WithRetention(*retention),
+			svc.WithRefreshTokens(sessions, *refreshTTL),
+			svc.WithMFA(secrets, *jwtIss),
+			svc.WithPasswordReset(resets, mailer, *resetURL, *resetTTL),
+			svc.WithEmailVerification(mailer, verifyKey, *verifyURL, *verifyTTL),
+		)
+
+		// Enforce roles and permissions
+		s = svc.AuthorizationMiddleware(policy)(s)
+
+		// Lock accounts and IPs out after failed logins
+		accountLockout, ipLockout := svc.DefaultAccountLockout, svc.DefaultIPLockout
+		accountLockout.Threshold, ipLockout.Threshold = *lockUser, *lockIP
+		s = svc.LockoutMiddleware(attempts, accountLockout, ipLockout, log.With(logger, "component", "lockout"))(s)
 
 		// Setup logging
 		s = svc.LoggingMiddleware(logger)(s)
+
+		// Setup metrics
+		fieldKeys := []string{"method"}
+		s = svc.InstrumentingMiddleware(
+			kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+				Namespace: "users",
+				Subsystem: "service",
+				Name:      "requests_total",
+				Help:      "Number of requests received.",
+			}, fieldKeys),
+			kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+				Namespace: "users",
+				Subsystem: "service",
+				Name:      "errors_total",
+				Help:      "Number of requests failed, by kind of error.",
+			}, append(fieldKeys, "kind")),
+			kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+				Namespace: "users",
+				Subsystem: "service",
+				Name:      "request_duration_seconds",
+				Help:      "Time spent processing requests.",
+				Buckets:   stdprometheus.DefBuckets,
+			}, fieldKeys),
+		)(s)
+	}
+
+	endpointOptions := []svc.EndpointOption{
+		svc.WithValidator(svc.NewValidator(policy)),
+		svc.WithTrustedProxies(*proxies),
+	}
+	if !*noLimits {
+		endpointOptions = append(endpointOptions, svc.WithRateLimits(svc.NewInmemRateLimiter(), limits))
+	}
+	if *apiKeys {
+		endpointOptions = append(endpointOptions, svc.WithRateLimitKey(svc.RateLimitByAPIKey))
+	}
+	if *ifMatch {
+		endpointOptions = append(endpointOptions, svc.WithRequiredPreconditions())
 	}
 
 	var h http.Handler
 	{
-		h = svc.MakeHTTPHandler(s, log.With(logger, "component", "HTTP"))
+		h = svc.MakeHTTPHandler(s, keys, log.With(logger, "component", "HTTP"), endpointOptions...)
+
+		// Probes are served next to the API, so they check the server the
+		// traffic goes to.
+		mux := http.NewServeMux()
+		mux.Handle("/healthz", health.LiveHandler())
+		mux.Handle("/readyz", health.ReadyHandler())
+		mux.Handle("/", h)
+		h = mux
 	}
 
-	errs := make(chan error)
+	var g *grpc.Server
+	{
+		g = grpc.NewServer(grpc.UnaryInterceptor(kitgrpc.Interceptor))
+		pb.RegisterUsersServer(g, svc.MakeGRPCServer(s, keys, log.With(logger, "component", "gRPC"), endpointOptions...))
+	}
+
+	// Background workers stop when workers is canceled, after the servers
+	// drained.
+	workers, stopWorkers := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
 	go func() {
-		c := make(chan os.Signal)
-		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-		errs <- fmt.Errorf("%s", <-c)
+		defer wg.Done()
+		svc.RunPurgeJob(workers, repo, sessions, resets, *retention, *purgeEvery, log.With(logger, "component", "purge"))
 	}()
 
+	var (
+		httpServer = &http.Server{
+			Addr:              *httpAddr,
+			Handler:           h,
+			ReadHeaderTimeout: *readTimeout,
+			ReadTimeout:       *readTimeout,
+			WriteTimeout:      *writeTimeout,
+			IdleTimeout:       *idleTimeout,
+		}
+		adminServer = &http.Server{
+			Addr:              *adminAddr,
+			ReadHeaderTimeout: *readTimeout,
+		}
+	)
+	{
+		m := http.NewServeMux()
+		m.Handle("/metrics", promhttp.Handler())
+		adminServer.Handler = m
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	errs := make(chan error, 3)
+
 	go func() {
 		logger.Log("transport", "HTTP", "addr", *httpAddr)
-		errs <- http.ListenAndServe(*httpAddr, h)
+		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+			errs <- err
+		}
+	}()
+
+	go func() {
+		logger.Log("transport", "admin", "addr", *adminAddr)
+		if err := adminServer.ListenAndServe(); err != http.ErrServerClosed {
+			errs <- err
+		}
+	}()
+
+	go func() {
+		ln, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			errs <- err
+			return
+		}
+		logger.Log("transport", "gRPC", "addr", *grpcAddr)
+		if err := g.Serve(ln); err != nil {
+			errs <- err
+		}
+	}()
+
+	// A signal is a shutdown asked for, exiting 0; a server failing exits 1,
+	// after shutting the others down all the same.
+	code := 0
+	select {
+	case sig := <-sigs:
+		logger.Log("exit", sig)
+	case err := <-errs:
+		logger.Log("exit", "error", "err", err)
+		code = 1
+	}
+	signal.Stop(sigs)
+
+	// Shut down in order: stop being ready, so load balancers take the
+	// instance out, then drain the requests in flight, then stop the workers
+	// and wait for the mails the requests left sending, and only then close
+	// the database they all use. Load balancers only get the delay to notice
+	// when shutting down was asked for, not when a server failed.
+	health.SetDraining(true)
+	if code == 0 {
+		logger.Log("shutdown", "draining", "delay", *drainDelay, "grace", *grace)
+		time.Sleep(*drainDelay)
+	} else {
+		logger.Log("shutdown", "draining", "grace", *grace)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *grace)
+	defer cancel()
+	var drained sync.WaitGroup
+	drained.Add(2)
+	go func() {
+		defer drained.Done()
+		if err := httpServer.Shutdown(ctx); err != nil {
+			logger.Log("transport", "HTTP", "shutdown", err)
+		}
 	}()
+	go func() {
+		defer drained.Done()
+		stopped := make(chan struct{})
+		go func() {
+			g.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			logger.Log("transport", "gRPC", "shutdown", ctx.Err())
+			g.Stop()
+		}
+	}()
+	drained.Wait()
+
+	stopWorkers()
+	wg.Wait()
+
+	// Mails get a grace of their own, as requests answered late in draining
+	// leave theirs running.
+	mailCtx, cancelMail := context.WithTimeout(context.Background(), *grace)
+	defer cancelMail()
+	if err := s.Close(mailCtx); err != nil {
+		logger.Log("service", "close", "err", err)
+	}
 
-	logger.Log("exit", <-errs)
-}
\ No newline at end of file
+	// The admin server goes last, with a deadline of its own, so metrics are
+	// served until the end however long draining took.
+	adminCtx, cancelAdmin := context.WithTimeout(context.Background(), adminShutdownTimeout)
+	defer cancelAdmin()
+	if err := adminServer.Shutdown(adminCtx); err != nil {
+		logger.Log("transport", "admin", "shutdown", err)
+	}
+	if err := closeDB(); err != nil {
+		logger.Log("db", "close", "err", err)
+	}
+	logger.Log("shutdown", "done")
+	return code
+}
+
+// throwawayKey returns a random 32 byte key standing in for the one in the
+// unset environment variable name, for local demos with -db.inmem.
+func throwawayKey(logger log.Logger, name string) []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	logger.Log("env", name, "key", "throwaway", "msg", name+" unset, using a random key until exit")
+	return key
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	svc "github.com/AndrewSC208/user-service-go-kit"
+)
+
+const migrateUsage = "usage: users.d [flags] migrate up|down [steps]|status"
+
+// runMigrate implements the migrate subcommand:
+//
+//	migrate up            apply all pending migrations
+//	migrate down [steps]  revert the last steps migrations, 1 by default
+//	migrate status        list migrations and when they were applied
+func runMigrate(db *sql.DB, args []string, w io.Writer) error {
+	m, err := svc.NewMigrator(db)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+	switch args[0] {
+	case "up":
+		applied, err := m.Up(ctx)
+		for _, mig := range applied {
+			fmt.Fprintf(w, "applied %d_%s\n", mig.Version, mig.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Fprintln(w, "no pending migrations")
+		}
+		return err
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("bad number of steps %q", args[1])
+			}
+		}
+		reverted, err := m.Down(ctx, steps)
+		for _, mig := range reverted {
+			fmt.Fprintf(w, "reverted %d_%s\n", mig.Version, mig.Name)
+		}
+		return err
+
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		return tw.Flush()
+
+	default:
+		return errors.New(migrateUsage)
+	}
+}
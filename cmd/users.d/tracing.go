@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// setupTracing installs the global TracerProvider and W3C propagators. The
+// exporter is one of:
+//
+//	none    spans are propagated but not exported
+//	stdout  spans are written to stdout, pretty-printed
+//	file    spans are appended to the file at target, one JSON object per line
+//	otlp    spans are sent to the OTLP gRPC collector at target
+//
+// The returned function flushes pending spans and releases the exporter.
+func setupTracing(exporter, target string, ratio float64) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var (
+		exp    sdktrace.SpanExporter
+		closer io.Closer
+		err    error
+	)
+	switch exporter {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exp, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "file":
+		var f *os.File
+		if f, err = os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return nil, err
+		}
+		closer = f
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	case "otlp":
+		exp, err = otlptracegrpc.New(context.Background(),
+			otlptracegrpc.WithEndpoint(target),
+			otlptracegrpc.WithInsecure(),
+		)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "users.d"))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if closer != nil {
+			closer.Close()
+		}
+		return err
+	}, nil
+}
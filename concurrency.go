@@ -0,0 +1,222 @@
+package users
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/endpoint"
+	grpctransport "github.com/go-kit/kit/transport/grpc"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"google.golang.org/grpc/metadata"
+)
+
+// concurrency errors
+var (
+	// ErrPreconditionFailed is returned when a write's Precondition doesn't
+	// hold, typically because someone else modified the user in the meantime.
+	ErrPreconditionFailed = newError("precondition_failed", http.StatusPreconditionFailed, "precondition failed")
+
+	// ErrPreconditionRequired is returned for writes made without a
+	// Precondition where one is required, see WithRequiredPreconditions.
+	ErrPreconditionRequired = newError("precondition_required", http.StatusPreconditionRequired, "precondition required")
+)
+
+// Precondition guards writes against lost updates: PutUser, PatchUser and
+// DeleteUser only proceed if the current state of the user meets it. It is
+// the service-side form of the If-Match and If-None-Match headers.
+type Precondition struct {
+	// Versions lists the versions the user may have, as the ETags of
+	// If-Match. The user must exist and have one of them.
+	Versions []uint64
+
+	// MustExist requires the user to exist, as If-Match: *.
+	MustExist bool
+
+	// MustNotExist requires the user not to exist, as If-None-Match: *. It
+	// makes PutUser create-only.
+	MustNotExist bool
+}
+
+// IfMatch returns a Precondition requiring the user to have the version.
+func IfMatch(version uint64) Precondition {
+	return Precondition{Versions: []uint64{version}}
+}
+
+// check returns ErrPreconditionFailed unless m, the current state of the
+// user, meets p. exists is false when there's no such user.
+func (p Precondition) check(m UserModel, exists bool) error {
+	switch {
+	case p.MustNotExist && exists:
+		return ErrPreconditionFailed.WithDetail("user already exists")
+	case (p.MustExist || len(p.Versions) > 0) && !exists:
+		return ErrPreconditionFailed.WithDetail("user doesn't exist")
+	case len(p.Versions) > 0 && !containsVersion(p.Versions, m.Version):
+		return ErrPreconditionFailed.WithDetail("user was modified, current version is " + ETag(m.Version))
+	}
+	return nil
+}
+
+// isZero reports whether p lets any write through.
+func (p Precondition) isZero() bool {
+	return len(p.Versions) == 0 && !p.MustExist && !p.MustNotExist
+}
+
+func containsVersion(versions []uint64, v uint64) bool {
+	for _, w := range versions {
+		if w == v {
+			return true
+		}
+	}
+	return false
+}
+
+// ContextWithPrecondition returns a context with the Precondition the writes
+// made with it must meet. Clients send it along as If-Match and If-None-Match,
+// see PreconditionToHTTP and PreconditionToGRPC.
+func ContextWithPrecondition(ctx context.Context, p Precondition) context.Context {
+	return context.WithValue(ctx, preconditionContextKey, p)
+}
+
+// PreconditionFromContext returns the Precondition in ctx, if any.
+func PreconditionFromContext(ctx context.Context) (Precondition, bool) {
+	p, ok := ctx.Value(preconditionContextKey).(Precondition)
+	return p, ok
+}
+
+// RequiringPrecondition returns an endpoint middleware rejecting PUT, PATCH
+// and DELETE requests made without a Precondition, or a Version of the user
+// written, with ErrPreconditionRequired. Clients must then read users before
+// writing them, or use If-None-Match: * to create them.
+func RequiringPrecondition(next endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		if p, ok := PreconditionFromContext(ctx); ok && !p.isZero() {
+			return next(ctx, request)
+		}
+		switch r := request.(type) {
+		case putUserRequest:
+			if r.User.Version != 0 {
+				return next(ctx, request)
+			}
+		case patchUserRequest, deleteUserRequest:
+		default:
+			return next(ctx, request)
+		}
+		return nil, ErrPreconditionRequired.WithDetail("send the ETag of the user as If-Match")
+	}
+}
+
+// ETag formats a version as a strong entity tag.
+func ETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// parseETag returns the version of an entity tag made by ETag. Weak tags never
+// match: If-Match requires strong comparison.
+func parseETag(tag string) (uint64, bool) {
+	tag = strings.TrimSpace(tag)
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(tag[1:len(tag)-1], 10, 64)
+	return v, err == nil
+}
+
+// preconditionFromHeaders parses If-Match and If-None-Match. Only the "*"
+// form of If-None-Match is supported, for create-only PUTs.
+func preconditionFromHeaders(ifMatch, ifNoneMatch string) (Precondition, bool) {
+	var p Precondition
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		p.MustNotExist = true
+	}
+	if strings.TrimSpace(ifMatch) == "*" {
+		p.MustExist = true
+	} else if ifMatch != "" {
+		for _, tag := range strings.Split(ifMatch, ",") {
+			if v, ok := parseETag(tag); ok {
+				p.Versions = append(p.Versions, v)
+			}
+		}
+		if len(p.Versions) == 0 {
+			// Nothing can match a list of unknown tags. Versions start at
+			// 1, so no user has version 0.
+			p.Versions = []uint64{0}
+		}
+	}
+	return p, !p.isZero()
+}
+
+// headersFromPrecondition formats p as If-Match and If-None-Match.
+func headersFromPrecondition(p Precondition) (ifMatch, ifNoneMatch string) {
+	if p.MustNotExist {
+		ifNoneMatch = "*"
+	}
+	if len(p.Versions) > 0 {
+		tags := make([]string, len(p.Versions))
+		for i, v := range p.Versions {
+			tags[i] = ETag(v)
+		}
+		ifMatch = strings.Join(tags, ", ")
+	} else if p.MustExist {
+		ifMatch = "*"
+	}
+	return ifMatch, ifNoneMatch
+}
+
+// HTTPPreconditionToContext moves If-Match and If-None-Match to the context.
+// Use it as an httptransport.ServerBefore hook.
+func HTTPPreconditionToContext() httptransport.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		if p, ok := preconditionFromHeaders(r.Header.Get("If-Match"), r.Header.Get("If-None-Match")); ok {
+			return ContextWithPrecondition(ctx, p)
+		}
+		return ctx
+	}
+}
+
+// PreconditionToHTTP moves the Precondition in the context to If-Match and
+// If-None-Match. An If-Match set from the Version of the user written takes
+// precedence. Use it as an httptransport.ClientBefore hook.
+func PreconditionToHTTP() httptransport.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		if p, ok := PreconditionFromContext(ctx); ok {
+			ifMatch, ifNoneMatch := headersFromPrecondition(p)
+			if ifMatch != "" && r.Header.Get("If-Match") == "" {
+				r.Header.Set("If-Match", ifMatch)
+			}
+			if ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", ifNoneMatch)
+			}
+		}
+		return ctx
+	}
+}
+
+// GRPCPreconditionToContext moves the if-match and if-none-match metadata to
+// the context. Use it as a grpctransport.ServerBefore hook.
+func GRPCPreconditionToContext() grpctransport.ServerRequestFunc {
+	return func(ctx context.Context, md metadata.MD) context.Context {
+		if p, ok := preconditionFromHeaders(strings.Join(md.Get("if-match"), ","), strings.Join(md.Get("if-none-match"), ",")); ok {
+			return ContextWithPrecondition(ctx, p)
+		}
+		return ctx
+	}
+}
+
+// PreconditionToGRPC moves the Precondition in the context to the if-match and
+// if-none-match metadata. Use it as a grpctransport.ClientBefore hook.
+func PreconditionToGRPC() grpctransport.ClientRequestFunc {
+	return func(ctx context.Context, md *metadata.MD) context.Context {
+		if p, ok := PreconditionFromContext(ctx); ok {
+			ifMatch, ifNoneMatch := headersFromPrecondition(p)
+			if ifMatch != "" {
+				(*md)["if-match"] = []string{ifMatch}
+			}
+			if ifNoneMatch != "" {
+				(*md)["if-none-match"] = []string{ifNoneMatch}
+			}
+		}
+		return ctx
+	}
+}
@@ -0,0 +1,113 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestHTTPPreconditions(t *testing.T) {
+	alice := User{Username: "alice", Email: "alice@example.com"}
+	carol := User{Username: "carol", Email: "carol@example.com"}
+	name := map[string]string{"first_name": "Alice"}
+
+	for _, tc := range []struct {
+		name     string
+		required bool
+		method   string
+		path     string
+		body     interface{}
+		header   []string
+		wantCode int
+		wantErr  string
+	}{
+		{"put current", false, "PUT", "/users/alice", alice, []string{"If-Match", `"1"`}, http.StatusOK, ""},
+		{"put one of", false, "PUT", "/users/alice", alice, []string{"If-Match", `"3", "1"`}, http.StatusOK, ""},
+		{"put stale", false, "PUT", "/users/alice", alice, []string{"If-Match", `"2"`}, http.StatusPreconditionFailed, "precondition_failed"},
+		{"put weak", false, "PUT", "/users/alice", alice, []string{"If-Match", `W/"1"`}, http.StatusPreconditionFailed, "precondition_failed"},
+		{"put any", false, "PUT", "/users/alice", alice, []string{"If-Match", "*"}, http.StatusOK, ""},
+		{"put any unknown", false, "PUT", "/users/carol", carol, []string{"If-Match", "*"}, http.StatusPreconditionFailed, "precondition_failed"},
+		{"put create only", false, "PUT", "/users/carol", carol, []string{"If-None-Match", "*"}, http.StatusOK, ""},
+		{"put create only existing", false, "PUT", "/users/alice", alice, []string{"If-None-Match", "*"}, http.StatusPreconditionFailed, "precondition_failed"},
+		{"patch current", false, "PATCH", "/users/alice", name, []string{"If-Match", `"1"`}, http.StatusOK, ""},
+		{"patch stale", false, "PATCH", "/users/alice", name, []string{"If-Match", `"2"`}, http.StatusPreconditionFailed, "precondition_failed"},
+		{"delete current", false, "DELETE", "/users/alice", nil, []string{"If-Match", `"1"`}, http.StatusOK, ""},
+		{"delete stale", false, "DELETE", "/users/alice", nil, []string{"If-Match", `"2"`}, http.StatusPreconditionFailed, "precondition_failed"},
+		{"put unconditional", false, "PUT", "/users/alice", alice, nil, http.StatusOK, ""},
+
+		{"required put", true, "PUT", "/users/alice", alice, nil, http.StatusPreconditionRequired, "precondition_required"},
+		{"required put current", true, "PUT", "/users/alice", alice, []string{"If-Match", `"1"`}, http.StatusOK, ""},
+		{"required put create only", true, "PUT", "/users/carol", carol, []string{"If-None-Match", "*"}, http.StatusOK, ""},
+		{"required patch", true, "PATCH", "/users/alice", name, nil, http.StatusPreconditionRequired, "precondition_required"},
+		{"required patch stale", true, "PATCH", "/users/alice", name, []string{"If-Match", `"2"`}, http.StatusPreconditionFailed, "precondition_failed"},
+		{"required delete", true, "DELETE", "/users/alice", nil, nil, http.StatusPreconditionRequired, "precondition_required"},
+		{"required get", true, "GET", "/users/alice", nil, nil, http.StatusOK, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var options []testOption
+			if tc.required {
+				options = append(options, withEndpointOptions(WithRequiredPreconditions()))
+			}
+			ts := newTestServer(t, options...)
+			ts.seed(alice)
+			resp, body := ts.do(tc.method, tc.path, ts.token("admin", "admin"), tc.body, tc.header...)
+			if resp.StatusCode != tc.wantCode {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tc.wantCode, body)
+			}
+			if got := problemCode(body); got != tc.wantErr {
+				t.Errorf("problem = %q, want %q", got, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestHTTPETag(t *testing.T) {
+	ts := newTestServer(t)
+	ts.seed(User{Username: "alice", Email: "alice@example.com"})
+	admin := ts.token("admin", "admin")
+
+	// Each write bumps the version, which the next one must match.
+	for _, want := range []string{`"1"`, `"2"`, `"3"`} {
+		resp, _ := ts.do("GET", "/users/alice", admin, nil)
+		if got := resp.Header.Get("ETag"); got != want {
+			t.Fatalf("ETag = %s, want %s", got, want)
+		}
+		resp, body := ts.do("PATCH", "/users/alice", admin, map[string]string{"last_name": want}, "If-Match", want)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("PATCH status = %d: %s", resp.StatusCode, body)
+		}
+	}
+}
+
+func TestClientPreconditions(t *testing.T) {
+	ts := newTestServer(t)
+	ts.seed(User{Username: "alice", Email: "alice@example.com"})
+	c, err := MakeClientEndpoints(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := ContextWithToken(context.Background(), ts.token("admin", "admin"))
+
+	u, err := c.GetUser(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Version != 1 {
+		t.Fatalf("version = %d, want 1", u.Version)
+	}
+	u.FirstName = "Alice"
+	if err := c.PutUser(ctx, "alice", u, nil); err != nil {
+		t.Fatal(err)
+	}
+	// u still has the version it was read with.
+	if err := c.PutUser(ctx, "alice", u, nil); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("stale PutUser err = %v, want %v", err, ErrPreconditionFailed)
+	}
+	if err := c.DeleteUser(ContextWithPrecondition(ctx, IfMatch(1)), "alice"); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("stale DeleteUser err = %v, want %v", err, ErrPreconditionFailed)
+	}
+	if err := c.DeleteUser(ContextWithPrecondition(ctx, IfMatch(2)), "alice"); err != nil {
+		t.Errorf("DeleteUser err = %v", err)
+	}
+}
@@ -2,11 +2,13 @@ package users
 
 import (
 	"context"
+	"net/http"
 	"net/url"
 	"strings"
 
 	"github.com/go-kit/kit/endpoint"
 	httptransport "github.com/go-kit/kit/transport/http"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Endpoints collects all of the endpoints that compose a profile service. It's
@@ -24,22 +26,137 @@ import (
 // construct individual endpoints using transport/http.NewClient, combine them
 // into an Endpoints, and return it to the caller as a Service.
 type Endpoints struct {
-	PostUserEndpoint   endpoint.Endpoint
-	GetUserEndpoint    endpoint.Endpoint
-	PutUserEndpoint    endpoint.Endpoint
-	PatchUserEndpoint  endpoint.Endpoint
-	DeleteUserEndpoint endpoint.Endpoint
+	PostUserEndpoint                endpoint.Endpoint
+	GetUserEndpoint                 endpoint.Endpoint
+	PutUserEndpoint                 endpoint.Endpoint
+	PatchUserEndpoint               endpoint.Endpoint
+	DeleteUserEndpoint              endpoint.Endpoint
+	RestoreUserEndpoint             endpoint.Endpoint
+	PurgeUserEndpoint               endpoint.Endpoint
+	UnlockUserEndpoint              endpoint.Endpoint
+	ListUsersEndpoint               endpoint.Endpoint
+	LoginEndpoint                   endpoint.Endpoint
+	RefreshEndpoint                 endpoint.Endpoint
+	LogoutEndpoint                  endpoint.Endpoint
+	RevokeSessionsEndpoint          endpoint.Endpoint
+	EnrollMFAEndpoint               endpoint.Endpoint
+	ConfirmMFAEndpoint              endpoint.Endpoint
+	RegenerateRecoveryCodesEndpoint endpoint.Endpoint
+	RequestPasswordResetEndpoint    endpoint.Endpoint
+	ResetPasswordEndpoint           endpoint.Endpoint
+	VerifyEmailEndpoint             endpoint.Endpoint
+}
+
+// EndpointOption sets an optional parameter of the server endpoints.
+type EndpointOption func(*endpointOptions)
+
+type endpointOptions struct {
+	validator     Validator
+	proxies       int
+	preconditions bool
+
+	limiter      RateLimiter
+	limits       RateLimits
+	rateLimitKey RateLimitKey
+}
+
+func newEndpointOptions(options []EndpointOption) endpointOptions {
+	o := endpointOptions{validator: NewValidator(DefaultPolicy), rateLimitKey: RateLimitByClient}
+	for _, option := range options {
+		option(&o)
+	}
+	return o
+}
+
+// WithValidator overrides the Validator of requests, which by default allows
+// the roles of DefaultPolicy and enforces DefaultPasswordPolicy.
+func WithValidator(v Validator) EndpointOption {
+	return func(o *endpointOptions) { o.validator = v }
+}
+
+// WithTrustedProxies tells the HTTP and gRPC servers how many reverse proxies
+// are in front of the service, each adding the address it got the request
+// from to X-Forwarded-For. The client IP is then read from that header rather
+// than the connection, see ClientIPFromContext. By default there are none,
+// since clients could otherwise spoof the header.
+func WithTrustedProxies(n int) EndpointOption {
+	return func(o *endpointOptions) { o.proxies = n }
+}
+
+// WithRequiredPreconditions makes PUT, PATCH and DELETE fail with
+// ErrPreconditionRequired unless they carry a Precondition, see
+// RequiringPrecondition. By default, writes without one overwrite whatever
+// is stored.
+func WithRequiredPreconditions() EndpointOption {
+	return func(o *endpointOptions) { o.preconditions = true }
+}
+
+// WithRateLimits limits the rate of requests to the endpoints, counted in
+// buckets of limiter, see RateLimiting. Endpoints without a limit, and
+// without a "*" one, are unlimited. By default, every endpoint is.
+func WithRateLimits(limiter RateLimiter, limits RateLimits) EndpointOption {
+	return func(o *endpointOptions) { o.limiter, o.limits = limiter, limits }
+}
+
+// WithRateLimitKey overrides what rate limits count requests by, by default
+// RateLimitByClient.
+func WithRateLimitKey(key RateLimitKey) EndpointOption {
+	return func(o *endpointOptions) { o.rateLimitKey = key }
 }
 
 // MakeServerEndpoints returns an Endpoints struct where each endpoint invokes
 // the corresponding method on the provided service. Useful in a users server.
-func MakeServerEndpoints(s Service) Endpoints {
+//
+// Every user endpoint requires a bearer token signed with keys, except
+// PostUserEndpoint, which is open for signups. Login, refresh, logout,
+// password reset and email verification endpoints are always open.
+// Requests are then rate limited, see WithRateLimits, checked for
+// preconditions, see WithRequiredPreconditions, and validated, see
+// Validating.
+//
+// Each endpoint call is traced, see TraceEndpoint.
+func MakeServerEndpoints(s Service, keys TokenKeys, options ...EndpointOption) Endpoints {
+	o := newEndpointOptions(options)
+	var (
+		authenticated = Authenticated(keys)
+		validated     = Validating(o.validator)
+	)
+	traced := func(name string, e endpoint.Endpoint) endpoint.Endpoint {
+		return TraceEndpoint(name, trace.SpanKindInternal)(e)
+	}
+	limited := func(name string, e endpoint.Endpoint) endpoint.Endpoint {
+		limit, ok := o.limits.For(name)
+		if o.limiter == nil || !ok {
+			return e
+		}
+		return RateLimiting(o.limiter, name, limit, o.rateLimitKey)(e)
+	}
+	preconditioned := func(e endpoint.Endpoint) endpoint.Endpoint {
+		if !o.preconditions {
+			return e
+		}
+		return RequiringPrecondition(e)
+	}
 	return Endpoints{
-		PostUserEndpoint:   MakePostUserEndpoint(s),
-		GetUserEndpoint:    MakeGetUserEndpoint(s),
-		PutUserEndpoint:    MakePutUserEndpoint(s),
-		PatchUserEndpoint:  MakePatchUserEndpoint(s),
-		DeleteUserEndpoint: MakeDeleteUserEndpoint(s),
+		PostUserEndpoint:                traced("PostUser", OptionallyAuthenticated(keys)(limited("PostUser", validated(MakePostUserEndpoint(s))))),
+		GetUserEndpoint:                 traced("GetUser", authenticated(limited("GetUser", validated(MakeGetUserEndpoint(s))))),
+		PutUserEndpoint:                 traced("PutUser", authenticated(limited("PutUser", preconditioned(validated(MakePutUserEndpoint(s)))))),
+		PatchUserEndpoint:               traced("PatchUser", authenticated(limited("PatchUser", preconditioned(validated(MakePatchUserEndpoint(s)))))),
+		DeleteUserEndpoint:              traced("DeleteUser", authenticated(limited("DeleteUser", preconditioned(validated(MakeDeleteUserEndpoint(s)))))),
+		RestoreUserEndpoint:             traced("RestoreUser", authenticated(limited("RestoreUser", validated(MakeRestoreUserEndpoint(s))))),
+		PurgeUserEndpoint:               traced("PurgeUser", authenticated(limited("PurgeUser", validated(MakePurgeUserEndpoint(s))))),
+		UnlockUserEndpoint:              traced("UnlockUser", authenticated(limited("UnlockUser", validated(MakeUnlockUserEndpoint(s))))),
+		ListUsersEndpoint:               traced("ListUsers", authenticated(limited("ListUsers", validated(MakeListUsersEndpoint(s))))),
+		LoginEndpoint:                   traced("Login", limited("Login", validated(MakeLoginEndpoint(s)))),
+		RefreshEndpoint:                 traced("Refresh", limited("Refresh", validated(MakeRefreshEndpoint(s)))),
+		LogoutEndpoint:                  traced("Logout", limited("Logout", validated(MakeLogoutEndpoint(s)))),
+		RevokeSessionsEndpoint:          traced("RevokeSessions", authenticated(limited("RevokeSessions", validated(MakeRevokeSessionsEndpoint(s))))),
+		EnrollMFAEndpoint:               traced("EnrollMFA", authenticated(limited("EnrollMFA", validated(MakeEnrollMFAEndpoint(s))))),
+		ConfirmMFAEndpoint:              traced("ConfirmMFA", authenticated(limited("ConfirmMFA", validated(MakeConfirmMFAEndpoint(s))))),
+		RegenerateRecoveryCodesEndpoint: traced("RegenerateRecoveryCodes", authenticated(limited("RegenerateRecoveryCodes", validated(MakeRegenerateRecoveryCodesEndpoint(s))))),
+		RequestPasswordResetEndpoint:    traced("RequestPasswordReset", limited("RequestPasswordReset", validated(MakeRequestPasswordResetEndpoint(s)))),
+		ResetPasswordEndpoint:           traced("ResetPassword", limited("ResetPassword", validated(MakeResetPasswordEndpoint(s)))),
+		VerifyEmailEndpoint:             traced("VerifyEmail", limited("VerifyEmail", validated(MakeVerifyEmailEndpoint(s)))),
 	}
 }
 
@@ -56,21 +173,73 @@ func MakeClientEndpoints(instance string) (Endpoints, error) {
 	}
 	tgt.Path = ""
 
-	options := []httptransport.ClientOption{}
+	options := []httptransport.ClientOption{
+		httptransport.ClientBefore(ContextToHTTP(), PreconditionToHTTP(), HTTPClientTrace()),
+	}
 
 	// Note that the request encoders need to modify the request URL, changing
 	// the path and method. That's fine: we simply need to provide specific
 	// encoders for each endpoint.
+	//
+	// Each call gets a client span, whose context HTTPClientTrace injects in
+	// the request.
+	traced := func(name string, c *httptransport.Client) endpoint.Endpoint {
+		return TraceEndpoint(name, trace.SpanKindClient)(c.Endpoint())
+	}
 
 	return Endpoints{
-		PostUserEndpoint:   httptransport.NewClient("POST", tgt, encodePostUserRequest, decodePostUserResponse, options...).Endpoint(),
-		GetUserEndpoint:    httptransport.NewClient("GET", tgt, encodeGetUserRequest, decodeGetUserResponse, options...).Endpoint(),
-		PutUserEndpoint:    httptransport.NewClient("PUT", tgt, encodePutUserRequest, decodePutUserResponse, options...).Endpoint(),
-		PatchUserEndpoint:  httptransport.NewClient("PATCH", tgt, encodePatchUserRequest, decodePatchUserResponse, options...).Endpoint(),
-		DeleteUserEndpoint: httptransport.NewClient("DELETE", tgt, encodeDeleteUserRequest, decodeDeleteUserResponse, options...).Endpoint(),
+		PostUserEndpoint:                traced("PostUser", httptransport.NewClient("POST", tgt, encodePostUserRequest, decodePostUserResponse, options...)),
+		GetUserEndpoint:                 traced("GetUser", httptransport.NewClient("GET", tgt, encodeGetUserRequest, decodeGetUserResponse, options...)),
+		PutUserEndpoint:                 traced("PutUser", httptransport.NewClient("PUT", tgt, encodePutUserRequest, decodePutUserResponse, options...)),
+		PatchUserEndpoint:               traced("PatchUser", httptransport.NewClient("PATCH", tgt, encodePatchUserRequest, decodePatchUserResponse, options...)),
+		DeleteUserEndpoint:              traced("DeleteUser", httptransport.NewClient("DELETE", tgt, encodeDeleteUserRequest, decodeDeleteUserResponse, options...)),
+		RestoreUserEndpoint:             traced("RestoreUser", httptransport.NewClient("POST", tgt, encodeRestoreUserRequest, decodeRestoreUserResponse, options...)),
+		PurgeUserEndpoint:               traced("PurgeUser", httptransport.NewClient("POST", tgt, encodePurgeUserRequest, decodePurgeUserResponse, options...)),
+		UnlockUserEndpoint:              traced("UnlockUser", httptransport.NewClient("POST", tgt, encodeUnlockUserRequest, decodeUnlockUserResponse, options...)),
+		ListUsersEndpoint:               traced("ListUsers", httptransport.NewClient("GET", tgt, encodeListUsersRequest, decodeListUsersResponse, options...)),
+		LoginEndpoint:                   traced("Login", httptransport.NewClient("POST", tgt, encodeLoginRequest, decodeLoginResponse, options...)),
+		RefreshEndpoint:                 traced("Refresh", httptransport.NewClient("POST", tgt, encodeRefreshRequest, decodeRefreshResponse, options...)),
+		LogoutEndpoint:                  traced("Logout", httptransport.NewClient("POST", tgt, encodeLogoutRequest, decodeLogoutResponse, options...)),
+		RevokeSessionsEndpoint:          traced("RevokeSessions", httptransport.NewClient("DELETE", tgt, encodeRevokeSessionsRequest, decodeRevokeSessionsResponse, options...)),
+		EnrollMFAEndpoint:               traced("EnrollMFA", httptransport.NewClient("POST", tgt, encodeEnrollMFARequest, decodeEnrollMFAResponse, options...)),
+		ConfirmMFAEndpoint:              traced("ConfirmMFA", httptransport.NewClient("POST", tgt, encodeConfirmMFARequest, decodeRecoveryCodesResponse, options...)),
+		RegenerateRecoveryCodesEndpoint: traced("RegenerateRecoveryCodes", httptransport.NewClient("POST", tgt, encodeRegenerateRecoveryCodesRequest, decodeRecoveryCodesResponse, options...)),
+		RequestPasswordResetEndpoint:    traced("RequestPasswordReset", httptransport.NewClient("POST", tgt, encodeRequestPasswordResetRequest, decodeRequestPasswordResetResponse, options...)),
+		ResetPasswordEndpoint:           traced("ResetPassword", httptransport.NewClient("POST", tgt, encodeResetPasswordRequest, decodeResetPasswordResponse, options...)),
+		VerifyEmailEndpoint:             traced("VerifyEmail", httptransport.NewClient("POST", tgt, encodeVerifyEmailRequest, decodeVerifyEmailResponse, options...)),
 	}, nil
 }
 
+// MakeAuthenticatedClientEndpoints is like MakeClientEndpoints, but attaches a
+// bearer token from source to every request except logins.
+func MakeAuthenticatedClientEndpoints(instance string, source TokenSource) (Endpoints, error) {
+	e, err := MakeClientEndpoints(instance)
+	if err != nil {
+		return Endpoints{}, err
+	}
+	return withTokenSource(e, source), nil
+}
+
+// withTokenSource attaches a bearer token from source to the requests of every
+// client endpoint of e except logins.
+func withTokenSource(e Endpoints, source TokenSource) Endpoints {
+	withToken := WithTokenSource(source)
+	e.PostUserEndpoint = withToken(e.PostUserEndpoint)
+	e.GetUserEndpoint = withToken(e.GetUserEndpoint)
+	e.PutUserEndpoint = withToken(e.PutUserEndpoint)
+	e.PatchUserEndpoint = withToken(e.PatchUserEndpoint)
+	e.DeleteUserEndpoint = withToken(e.DeleteUserEndpoint)
+	e.RestoreUserEndpoint = withToken(e.RestoreUserEndpoint)
+	e.PurgeUserEndpoint = withToken(e.PurgeUserEndpoint)
+	e.UnlockUserEndpoint = withToken(e.UnlockUserEndpoint)
+	e.ListUsersEndpoint = withToken(e.ListUsersEndpoint)
+	e.RevokeSessionsEndpoint = withToken(e.RevokeSessionsEndpoint)
+	e.EnrollMFAEndpoint = withToken(e.EnrollMFAEndpoint)
+	e.ConfirmMFAEndpoint = withToken(e.ConfirmMFAEndpoint)
+	e.RegenerateRecoveryCodesEndpoint = withToken(e.RegenerateRecoveryCodesEndpoint)
+	return e
+}
+
 /**
  * METHODS
  */
@@ -96,8 +265,9 @@ func (e Endpoints) GetUser(ctx context.Context, username string) (User, error) {
 	return resp.User, resp.Err
 }
 
-// PutUser implements Service. Primarily useful in a client.
-func (e Endpoints) PutUser(ctx context.Context, username string, u User) error {
+// PutUser implements Service. Primarily useful in a client, where onCreate is
+// ignored: the server vets the users it creates itself.
+func (e Endpoints) PutUser(ctx context.Context, username string, u User, _ func(User) error) error {
 	request := putUserRequest{Username: username, User: u}
 	response, err := e.PutUserEndpoint(ctx, request)
 	if err != nil {
@@ -107,9 +277,10 @@ func (e Endpoints) PutUser(ctx context.Context, username string, u User) error {
 	return resp.Err
 }
 
-// PatchUser implements Service. Primarily useful in a client.
-func (e Endpoints) PatchUser(ctx context.Context, username string, u User) error {
-	request := patchUserRequest{Username: username, User: u}
+// PatchUser implements Service. Primarily useful in a client, where the patch
+// must be a MergePatch or a JSONPatch.
+func (e Endpoints) PatchUser(ctx context.Context, username string, patch Patch) error {
+	request := patchUserRequest{Username: username, Patch: patch}
 	response, err := e.PatchUserEndpoint(ctx, request)
 	if err != nil {
 		return err
@@ -128,6 +299,164 @@ func (e Endpoints) DeleteUser(ctx context.Context, username string) error {
 	resp := response.(deleteUserResponse)
 	return resp.Err
 }
+
+// RestoreUser implements Service. Primarily useful in a client.
+func (e Endpoints) RestoreUser(ctx context.Context, username string) error {
+	request := restoreUserRequest{Username: username}
+	response, err := e.RestoreUserEndpoint(ctx, request)
+	if err != nil {
+		return err
+	}
+	resp := response.(restoreUserResponse)
+	return resp.Err
+}
+
+// PurgeUser implements Service. Primarily useful in a client.
+func (e Endpoints) PurgeUser(ctx context.Context, username string) error {
+	request := purgeUserRequest{Username: username}
+	response, err := e.PurgeUserEndpoint(ctx, request)
+	if err != nil {
+		return err
+	}
+	resp := response.(purgeUserResponse)
+	return resp.Err
+}
+
+// UnlockUser implements Service. Primarily useful in a client.
+func (e Endpoints) UnlockUser(ctx context.Context, username string) error {
+	request := unlockUserRequest{Username: username}
+	response, err := e.UnlockUserEndpoint(ctx, request)
+	if err != nil {
+		return err
+	}
+	resp := response.(unlockUserResponse)
+	return resp.Err
+}
+
+// ListUsers implements Service. Primarily useful in a client.
+func (e Endpoints) ListUsers(ctx context.Context, opts ListOptions) (UserPage, error) {
+	request := listUsersRequest{Options: opts}
+	response, err := e.ListUsersEndpoint(ctx, request)
+	if err != nil {
+		return UserPage{}, err
+	}
+	resp := response.(listUsersResponse)
+	return resp.UserPage, resp.Err
+}
+
+// Authenticate implements Service. Primarily useful in a client.
+func (e Endpoints) Authenticate(ctx context.Context, username, password, otp string) (Token, error) {
+	request := loginRequest{Username: username, Password: password, OTP: otp}
+	response, err := e.LoginEndpoint(ctx, request)
+	if err != nil {
+		return Token{}, err
+	}
+	resp := response.(loginResponse)
+	return resp.Token, resp.Err
+}
+
+// Refresh implements Service. Primarily useful in a client.
+func (e Endpoints) Refresh(ctx context.Context, refreshToken string) (Token, error) {
+	request := refreshRequest{RefreshToken: refreshToken}
+	response, err := e.RefreshEndpoint(ctx, request)
+	if err != nil {
+		return Token{}, err
+	}
+	resp := response.(refreshResponse)
+	return resp.Token, resp.Err
+}
+
+// Logout implements Service. Primarily useful in a client.
+func (e Endpoints) Logout(ctx context.Context, refreshToken string) error {
+	request := logoutRequest{RefreshToken: refreshToken}
+	response, err := e.LogoutEndpoint(ctx, request)
+	if err != nil {
+		return err
+	}
+	resp := response.(logoutResponse)
+	return resp.Err
+}
+
+// RevokeSessions implements Service. Primarily useful in a client.
+func (e Endpoints) RevokeSessions(ctx context.Context, username string) error {
+	request := revokeSessionsRequest{Username: username}
+	response, err := e.RevokeSessionsEndpoint(ctx, request)
+	if err != nil {
+		return err
+	}
+	resp := response.(revokeSessionsResponse)
+	return resp.Err
+}
+
+// EnrollMFA implements Service. Primarily useful in a client.
+func (e Endpoints) EnrollMFA(ctx context.Context, username string) (MFAEnrollment, error) {
+	request := enrollMFARequest{Username: username}
+	response, err := e.EnrollMFAEndpoint(ctx, request)
+	if err != nil {
+		return MFAEnrollment{}, err
+	}
+	resp := response.(enrollMFAResponse)
+	return resp.MFAEnrollment, resp.Err
+}
+
+// ConfirmMFA implements Service. Primarily useful in a client.
+func (e Endpoints) ConfirmMFA(ctx context.Context, username, code string) ([]string, error) {
+	request := confirmMFARequest{Username: username, Code: code}
+	response, err := e.ConfirmMFAEndpoint(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	resp := response.(recoveryCodesResponse)
+	return resp.RecoveryCodes, resp.Err
+}
+
+// RegenerateRecoveryCodes implements Service. Primarily useful in a client.
+func (e Endpoints) RegenerateRecoveryCodes(ctx context.Context, username, code string) ([]string, error) {
+	request := regenerateRecoveryCodesRequest{Username: username, Code: code}
+	response, err := e.RegenerateRecoveryCodesEndpoint(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	resp := response.(recoveryCodesResponse)
+	return resp.RecoveryCodes, resp.Err
+}
+
+// RequestPasswordReset implements Service. Primarily useful in a client.
+func (e Endpoints) RequestPasswordReset(ctx context.Context, email string) error {
+	request := requestPasswordResetRequest{Email: email}
+	response, err := e.RequestPasswordResetEndpoint(ctx, request)
+	if err != nil {
+		return err
+	}
+	resp := response.(requestPasswordResetResponse)
+	return resp.Err
+}
+
+// ResetPassword implements Service. Primarily useful in a client.
+func (e Endpoints) ResetPassword(ctx context.Context, token, password string) error {
+	request := resetPasswordRequest{Token: token, Password: password}
+	response, err := e.ResetPasswordEndpoint(ctx, request)
+	if err != nil {
+		return err
+	}
+	resp := response.(resetPasswordResponse)
+	return resp.Err
+}
+
+// VerifyEmail implements Service. Primarily useful in a client.
+func (e Endpoints) VerifyEmail(ctx context.Context, username, token string) error {
+	request := verifyEmailRequest{Username: username, Token: token}
+	response, err := e.VerifyEmailEndpoint(ctx, request)
+	if err != nil {
+		return err
+	}
+	resp := response.(verifyEmailResponse)
+	return resp.Err
+}
+
+// Close implements Service. Clients leave nothing running to wait for.
+func (e Endpoints) Close(context.Context) error { return nil }
+
 /**
  * ENDPOINT FACTORIES
  */
@@ -147,6 +476,7 @@ func MakeGetUserEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		req := request.(getUserRequest)
 		u, e := s.GetUser(ctx, req.Username)
+		u.Password = "" // never leaves the service, whatever the implementation
 		return getUserResponse{User: u, Err: e}, nil
 	}
 }
@@ -156,7 +486,7 @@ func MakeGetUserEndpoint(s Service) endpoint.Endpoint {
 func MakePutUserEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		req := request.(putUserRequest)
-		e := s.PutUser(ctx, req.Username, req.User)
+		e := s.PutUser(ctx, req.Username, req.User, req.onCreate)
 		return putUserResponse{Err: e}, nil
 	}
 }
@@ -166,7 +496,7 @@ func MakePutUserEndpoint(s Service) endpoint.Endpoint {
 func MakePatchUserEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		req := request.(patchUserRequest)
-		e := s.PatchUser(ctx, req.Username, req.User)
+		e := s.PatchUser(ctx, req.Username, req.Patch)
 		return patchUserResponse{Err: e}, nil
 	}
 }
@@ -181,6 +511,149 @@ func MakeDeleteUserEndpoint(s Service) endpoint.Endpoint {
 	}
 }
 
+// MakeRestoreUserEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeRestoreUserEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(restoreUserRequest)
+		e := s.RestoreUser(ctx, req.Username)
+		return restoreUserResponse{Err: e}, nil
+	}
+}
+
+// MakePurgeUserEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakePurgeUserEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(purgeUserRequest)
+		e := s.PurgeUser(ctx, req.Username)
+		return purgeUserResponse{Err: e}, nil
+	}
+}
+
+// MakeUnlockUserEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeUnlockUserEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(unlockUserRequest)
+		e := s.UnlockUser(ctx, req.Username)
+		return unlockUserResponse{Err: e}, nil
+	}
+}
+
+// MakeListUsersEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeListUsersEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(listUsersRequest)
+		p, e := s.ListUsers(ctx, req.Options)
+		for i := range p.Users {
+			p.Users[i].Password = ""
+		}
+		return listUsersResponse{UserPage: p, Err: e}, nil
+	}
+}
+
+// MakeLoginEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeLoginEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(loginRequest)
+		t, e := s.Authenticate(ctx, req.Username, req.Password, req.OTP)
+		return loginResponse{Token: t, Err: e}, nil
+	}
+}
+
+// MakeRefreshEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeRefreshEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(refreshRequest)
+		t, e := s.Refresh(ctx, req.RefreshToken)
+		return refreshResponse{Token: t, Err: e}, nil
+	}
+}
+
+// MakeLogoutEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeLogoutEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(logoutRequest)
+		e := s.Logout(ctx, req.RefreshToken)
+		return logoutResponse{Err: e}, nil
+	}
+}
+
+// MakeRevokeSessionsEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeRevokeSessionsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(revokeSessionsRequest)
+		e := s.RevokeSessions(ctx, req.Username)
+		return revokeSessionsResponse{Err: e}, nil
+	}
+}
+
+// MakeEnrollMFAEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeEnrollMFAEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(enrollMFARequest)
+		m, e := s.EnrollMFA(ctx, req.Username)
+		return enrollMFAResponse{MFAEnrollment: m, Err: e}, nil
+	}
+}
+
+// MakeConfirmMFAEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeConfirmMFAEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(confirmMFARequest)
+		codes, e := s.ConfirmMFA(ctx, req.Username, req.Code)
+		return recoveryCodesResponse{RecoveryCodes: codes, Err: e}, nil
+	}
+}
+
+// MakeRegenerateRecoveryCodesEndpoint returns an endpoint via the passed
+// service. Primarily useful in a server.
+func MakeRegenerateRecoveryCodesEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(regenerateRecoveryCodesRequest)
+		codes, e := s.RegenerateRecoveryCodes(ctx, req.Username, req.Code)
+		return recoveryCodesResponse{RecoveryCodes: codes, Err: e}, nil
+	}
+}
+
+// MakeRequestPasswordResetEndpoint returns an endpoint via the passed
+// service. Primarily useful in a server.
+func MakeRequestPasswordResetEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(requestPasswordResetRequest)
+		e := s.RequestPasswordReset(ctx, req.Email)
+		return requestPasswordResetResponse{Err: e}, nil
+	}
+}
+
+// MakeResetPasswordEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeResetPasswordEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(resetPasswordRequest)
+		e := s.ResetPassword(ctx, req.Token, req.Password)
+		return resetPasswordResponse{Err: e}, nil
+	}
+}
+
+// MakeVerifyEmailEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeVerifyEmailEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(verifyEmailRequest)
+		e := s.VerifyEmail(ctx, req.Username, req.Token)
+		return verifyEmailResponse{Err: e}, nil
+	}
+}
+
 // We have two options to return errors from the business logic.
 //
 // We could return the error via the endpoint itself. That makes certain things
@@ -201,7 +674,7 @@ type postUserRequest struct {
 }
 
 type postUserResponse struct {
-	Err error `json:"err,omitempty"`
+	Err error `json:"-"`
 }
 
 func (r postUserResponse) error() error { return r.Err }
@@ -211,30 +684,33 @@ type getUserRequest struct {
 }
 
 type getUserResponse struct {
-	User    User    `json:"user,omitempty"`
-	Err     error   `json:"err,omitempty"`
+	User User  `json:"user,omitempty"`
+	Err  error `json:"-"`
 }
 
 func (r getUserResponse) error() error { return r.Err }
 
 type putUserRequest struct {
-	Username      string
-	User 		  User
+	Username string
+	User     User
+
+	// onCreate vets the user if the PUT creates it, set by Validating.
+	onCreate func(User) error
 }
 
 type putUserResponse struct {
-	Err error `json:"err,omitempty"`
+	Err error `json:"-"`
 }
 
-func (r putUserResponse) error() error { return nil }
+func (r putUserResponse) error() error { return r.Err }
 
 type patchUserRequest struct {
-	Username      string
-	User 		  User
+	Username string
+	Patch    Patch
 }
 
 type patchUserResponse struct {
-	Err error `json:"err,omitempty"`
+	Err error `json:"-"`
 }
 
 func (r patchUserResponse) error() error { return r.Err }
@@ -244,7 +720,156 @@ type deleteUserRequest struct {
 }
 
 type deleteUserResponse struct {
-	Err error `json:"err,omitempty"`
+	Err error `json:"-"`
+}
+
+func (r deleteUserResponse) error() error { return r.Err }
+
+type restoreUserRequest struct {
+	Username string
+}
+
+type restoreUserResponse struct {
+	Err error `json:"-"`
+}
+
+func (r restoreUserResponse) error() error { return r.Err }
+
+type purgeUserRequest struct {
+	Username string
+}
+
+type purgeUserResponse struct {
+	Err error `json:"-"`
+}
+
+func (r purgeUserResponse) error() error { return r.Err }
+
+type unlockUserRequest struct {
+	Username string
+}
+
+type unlockUserResponse struct {
+	Err error `json:"-"`
+}
+
+func (r unlockUserResponse) error() error { return r.Err }
+
+type listUsersRequest struct {
+	Options ListOptions
+}
+
+type listUsersResponse struct {
+	UserPage
+	Err error `json:"-"`
+}
+
+func (r listUsersResponse) error() error { return r.Err }
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	OTP      string `json:"otp,omitempty"` // TOTP or recovery code, when MFA is enabled
+}
+
+type loginResponse struct {
+	Token
+	Err error `json:"-"`
+}
+
+func (r loginResponse) error() error { return r.Err }
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type refreshResponse struct {
+	Token
+	Err error `json:"-"`
+}
+
+func (r refreshResponse) error() error { return r.Err }
+
+type logoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type logoutResponse struct {
+	Err error `json:"-"`
+}
+
+func (r logoutResponse) error() error { return r.Err }
+
+type revokeSessionsRequest struct {
+	Username string
+}
+
+type revokeSessionsResponse struct {
+	Err error `json:"-"`
+}
+
+func (r revokeSessionsResponse) error() error { return r.Err }
+
+type enrollMFARequest struct {
+	Username string
+}
+
+type enrollMFAResponse struct {
+	MFAEnrollment
+	Err error `json:"-"`
+}
+
+func (r enrollMFAResponse) error() error { return r.Err }
+
+type confirmMFARequest struct {
+	Username string `json:"-"`
+	Code     string `json:"code"`
+}
+
+type regenerateRecoveryCodesRequest struct {
+	Username string `json:"-"`
+	Code     string `json:"code"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+	Err           error    `json:"-"`
+}
+
+func (r recoveryCodesResponse) error() error { return r.Err }
+
+type requestPasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+type requestPasswordResetResponse struct {
+	Err error `json:"-"`
+}
+
+func (r requestPasswordResetResponse) error() error { return r.Err }
+
+// StatusCode is 202 whether the email is known or not, see
+// RequestPasswordReset.
+func (r requestPasswordResetResponse) StatusCode() int { return http.StatusAccepted }
+
+type resetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type resetPasswordResponse struct {
+	Err error `json:"-"`
+}
+
+func (r resetPasswordResponse) error() error { return r.Err }
+
+type verifyEmailRequest struct {
+	Username string `json:"-"`
+	Token    string `json:"token"`
+}
+
+type verifyEmailResponse struct {
+	Err error `json:"-"`
 }
 
-func (r deleteUserResponse) error() error { return r.Err }
\ No newline at end of file
+func (r verifyEmailResponse) error() error { return r.Err }
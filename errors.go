@@ -0,0 +1,197 @@
+package users
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Error is a typed service error. Every kind of error has a stable Code and
+// the HTTP Status it's rendered with; Detail, Instance and Extra describe one
+// occurrence. Over HTTP, errors are rendered as RFC 7807 problems.
+//
+// Errors match each other by Code, so errors.Is(err, ErrNotFound) holds for
+// any not found error, including ones decoded by a client or wrapped with
+// fmt.Errorf("...: %w", err).
+type Error struct {
+	Code     string
+	Status   int
+	Title    string
+	Detail   string
+	Instance string
+	Extra    map[string]interface{}
+}
+
+// errorsByCode lets clients turn problems back into the service's errors.
+var errorsByCode = map[string]*Error{}
+
+// newError returns a sentinel Error, registered for decoding.
+func newError(code string, status int, title string) *Error {
+	e := &Error{Code: code, Status: status, Title: title}
+	errorsByCode[code] = e
+	return e
+}
+
+func (e *Error) Error() string {
+	if e.Detail != "" {
+		return e.Detail
+	}
+	return e.Title
+}
+
+// Is reports whether target is an Error with the same code.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// WithDetail returns a copy of e describing a specific occurrence.
+func (e *Error) WithDetail(detail string) *Error {
+	c := *e
+	c.Detail = detail
+	return &c
+}
+
+// retryAfterMember is the problem member telling when to try again, in
+// seconds. Over HTTP it's also sent as the Retry-After header.
+const retryAfterMember = "retry_after"
+
+// WithRetryAfter returns a copy of e telling the caller to try again after d,
+// rounded up to the second.
+func (e *Error) WithRetryAfter(d time.Duration) *Error {
+	c := *e
+	c.Extra = make(map[string]interface{}, len(e.Extra)+1)
+	for k, v := range e.Extra {
+		c.Extra[k] = v
+	}
+	c.Extra[retryAfterMember] = int(math.Ceil(d.Seconds()))
+	return &c
+}
+
+// RetryAfter reports how long to wait before trying again, if e says so.
+func (e *Error) RetryAfter() (time.Duration, bool) {
+	switch v := e.Extra[retryAfterMember].(type) {
+	case int:
+		return time.Duration(v) * time.Second, true
+	case float64: // decoded from JSON
+		return time.Duration(v) * time.Second, true
+	}
+	return 0, false
+}
+
+var (
+	// ErrBadRequest is returned for requests that can't be decoded at all,
+	// e.g. malformed JSON.
+	ErrBadRequest = newError("bad_request", http.StatusBadRequest, "bad request")
+
+	// ErrValidation is matched by every ValidationError.
+	ErrValidation = newError("validation_failed", http.StatusUnprocessableEntity, "validation failed")
+
+	// errInternal stands for errors that aren't an *Error, without leaking
+	// their details to clients.
+	errInternal = &Error{Code: "internal", Status: http.StatusInternalServerError, Title: "internal error"}
+)
+
+// badRequest wraps an error decoding a request.
+func badRequest(err error) error {
+	return ErrBadRequest.WithDetail(err.Error())
+}
+
+// errorFrom returns the *Error that err is rendered as.
+func errorFrom(err error) *Error {
+	var ve ValidationError
+	if errors.As(err, &ve) {
+		e := ErrValidation.WithDetail(ve.Error())
+		e.Extra = map[string]interface{}{"fields": ve.Fields}
+		return e
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return errInternal
+}
+
+// problemTypePrefix prefixes codes into problem type URIs.
+const problemTypePrefix = "urn:users:error:"
+
+// MarshalJSON renders e as an application/problem+json document, with Extra
+// as extension members.
+func (e *Error) MarshalJSON() ([]byte, error) {
+	p := make(map[string]interface{}, len(e.Extra)+5)
+	for k, v := range e.Extra {
+		p[k] = v
+	}
+	p["type"] = problemTypePrefix + e.Code
+	p["title"] = e.Title
+	p["status"] = e.Status
+	if e.Detail != "" {
+		p["detail"] = e.Detail
+	}
+	if e.Instance != "" {
+		p["instance"] = e.Instance
+	}
+	return json.Marshal(p)
+}
+
+// UnmarshalJSON reads a problem document back into e.
+func (e *Error) UnmarshalJSON(data []byte) error {
+	var p map[string]json.RawMessage
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	var typ string
+	for k, v := range p {
+		var err error
+		switch k {
+		case "type":
+			err = json.Unmarshal(v, &typ)
+		case "title":
+			err = json.Unmarshal(v, &e.Title)
+		case "status":
+			err = json.Unmarshal(v, &e.Status)
+		case "detail":
+			err = json.Unmarshal(v, &e.Detail)
+		case "instance":
+			err = json.Unmarshal(v, &e.Instance)
+		default:
+			if e.Extra == nil {
+				e.Extra = map[string]interface{}{}
+			}
+			var x interface{}
+			err = json.Unmarshal(v, &x)
+			e.Extra[k] = x
+		}
+		if err != nil {
+			return err
+		}
+	}
+	e.Code = strings.TrimPrefix(typ, problemTypePrefix)
+	return nil
+}
+
+// decodeProblem returns the error described by a non-2xx response, nil for
+// successful ones. Problems with a known code match the service's errors with
+// errors.Is; validation problems are returned as a ValidationError.
+func decodeProblem(resp *http.Response) error {
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	e := &Error{}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/problem+json") ||
+		json.NewDecoder(resp.Body).Decode(e) != nil {
+		// Not one of ours, e.g. from a proxy.
+		return &Error{Code: "unknown", Status: resp.StatusCode, Title: http.StatusText(resp.StatusCode)}
+	}
+	if e.Code == ErrValidation.Code {
+		ve := ValidationError{}
+		if b, err := json.Marshal(e.Extra["fields"]); err == nil {
+			json.Unmarshal(b, &ve.Fields)
+		}
+		return ve
+	}
+	return e
+}
@@ -0,0 +1,115 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProblemRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantErr    error
+		wantHeader string // name: value
+		wantDetail string
+	}{
+		{"sentinel", ErrNotFound, http.StatusNotFound, ErrNotFound, "", "not found"},
+		{"wrapped", fmt.Errorf("get alice: %w", ErrNotFound), http.StatusNotFound, ErrNotFound, "", "not found"},
+		{"detail", ErrBadRequest.WithDetail("unexpected EOF"), http.StatusBadRequest, ErrBadRequest, "", "unexpected EOF"},
+		{"unauthorized", ErrMissingToken, http.StatusUnauthorized, ErrMissingToken, `WWW-Authenticate: Bearer realm="users"`, "missing bearer token"},
+		{"retry after", ErrForbidden.WithRetryAfter(1500 * time.Millisecond), http.StatusForbidden, ErrForbidden, "Retry-After: 2", "forbidden"},
+		{"validation", ValidationError{Fields: []FieldError{{Field: "email", Message: "is required"}}}, http.StatusUnprocessableEntity, ErrValidation, "", "invalid request: email: is required"},
+		{"internal", errors.New("pq: connection refused"), http.StatusInternalServerError, nil, "", "internal error"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			encodeError(context.Background(), tc.err, w)
+			resp := w.Result()
+			if resp.StatusCode != tc.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tc.wantStatus)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "application/problem+json" {
+				t.Errorf("Content-Type = %q, want application/problem+json", ct)
+			}
+			if tc.wantHeader != "" {
+				kv := strings.SplitN(tc.wantHeader, ": ", 2)
+				if got := resp.Header.Get(kv[0]); got != kv[1] {
+					t.Errorf("%s = %q, want %q", kv[0], got, kv[1])
+				}
+			}
+
+			err := decodeProblem(resp)
+			if tc.wantErr != nil && !errors.Is(err, tc.wantErr) {
+				t.Errorf("decoded %v, want it to match %v", err, tc.wantErr)
+			}
+			if err == nil || err.Error() != tc.wantDetail {
+				t.Errorf("decoded %v, want %q", err, tc.wantDetail)
+			}
+			var e *Error
+			if errors.As(err, &e) && tc.wantErr == ErrForbidden {
+				if after, _ := e.RetryAfter(); after != 2*time.Second {
+					t.Errorf("retry after %v, want 2s", after)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeProblemForeign(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		wantErr     bool
+	}{
+		{"ok", http.StatusOK, "application/json", "{}", false},
+		{"plain text", http.StatusBadGateway, "text/plain", "bad gateway", true},
+		{"broken problem", http.StatusBadGateway, "application/problem+json", "{", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode: tc.status,
+				Header:     http.Header{"Content-Type": {tc.contentType}},
+				Body:       http.NoBody,
+			}
+			if tc.body != "" {
+				w := httptest.NewRecorder()
+				w.Header().Set("Content-Type", tc.contentType)
+				w.WriteHeader(tc.status)
+				w.WriteString(tc.body)
+				resp = w.Result()
+			}
+			err := decodeProblem(resp)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tc.wantErr)
+			}
+			var e *Error
+			if err != nil && (!errors.As(err, &e) || e.Code != "unknown" || e.Status != tc.status) {
+				t.Errorf("err = %#v, want an unknown error with status %d", err, tc.status)
+			}
+		})
+	}
+}
+
+func TestHTTPProblemInstance(t *testing.T) {
+	ts := newTestServer(t)
+	resp, body := ts.do("GET", "/users/carol", ts.token("admin", "admin"), nil)
+	if ct := resp.Header.Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("Content-Type = %q, want application/problem+json", ct)
+	}
+	var e Error
+	if err := e.UnmarshalJSON(body); err != nil {
+		t.Fatal(err)
+	}
+	if e.Code != ErrNotFound.Code || e.Status != http.StatusNotFound || e.Instance != "/users/carol" {
+		t.Errorf("problem = %+v, want not_found at /users/carol", e)
+	}
+}
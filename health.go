@@ -0,0 +1,164 @@
+package users
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Checker checks a dependency of the service, such as its database.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// CheckerFunc is an adapter to use a function as a Checker.
+type CheckerFunc func(ctx context.Context) error
+
+// Check implements Checker.
+func (f CheckerFunc) Check(ctx context.Context) error { return f(ctx) }
+
+// DatabaseChecker pings db.
+func DatabaseChecker(db *sql.DB) Checker {
+	return CheckerFunc(db.PingContext)
+}
+
+// MigrationChecker fails while migrations are pending, since the service
+// expects the schema of the latest one.
+func MigrationChecker(m *Migrator) Checker {
+	return CheckerFunc(func(ctx context.Context) error {
+		pending, err := m.Pending(ctx)
+		if err != nil {
+			return err
+		}
+		if pending > 0 {
+			return fmt.Errorf("%d pending migrations", pending)
+		}
+		return nil
+	})
+}
+
+// DefaultCheckTimeout bounds each readiness check.
+const DefaultCheckTimeout = 2 * time.Second
+
+// Health reports the liveness and readiness of the service, for the probes of
+// orchestrators such as Kubernetes. The service is ready when every registered
+// check passes, and it isn't draining.
+type Health struct {
+	timeout time.Duration
+
+	mtx      sync.RWMutex
+	checks   []namedChecker
+	draining bool
+}
+
+type namedChecker struct {
+	name string
+	Checker
+}
+
+// NewHealth returns a Health without checks, bounding each one by timeout.
+func NewHealth(timeout time.Duration) *Health {
+	return &Health{timeout: timeout}
+}
+
+// Register adds a readiness check.
+func (h *Health) Register(name string, c Checker) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.checks = append(h.checks, namedChecker{name, c})
+}
+
+// SetDraining makes the service unready while it's shutting down, so load
+// balancers stop sending it requests while it finishes the ones it has.
+func (h *Health) SetDraining(draining bool) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.draining = draining
+}
+
+// CheckResult is the outcome of a check.
+type CheckResult struct {
+	Status    string  `json:"status"` // "ok" or "failed"
+	Error     string  `json:"error,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+// HealthReport is the readiness of the service, as served by ReadyHandler.
+type HealthReport struct {
+	Status   string                 `json:"status"` // "ok" or "unavailable"
+	Draining bool                   `json:"draining,omitempty"`
+	Checks   map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// Ready runs every check concurrently, and reports whether the service is
+// ready.
+func (h *Health) Ready(ctx context.Context) HealthReport {
+	h.mtx.RLock()
+	checks, draining := h.checks, h.draining
+	h.mtx.RUnlock()
+
+	var (
+		mtx    sync.Mutex
+		wg     sync.WaitGroup
+		report = HealthReport{Status: "ok", Draining: draining, Checks: map[string]CheckResult{}}
+	)
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c namedChecker) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, h.timeout)
+			defer cancel()
+			begin := time.Now()
+			err := c.Check(ctx)
+			r := CheckResult{Status: "ok", LatencyMS: float64(time.Since(begin)) / float64(time.Millisecond)}
+			if err != nil {
+				r.Status, r.Error = "failed", err.Error()
+			}
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			report.Checks[c.name] = r
+			if err != nil {
+				report.Status = "unavailable"
+			}
+		}(c)
+	}
+	wg.Wait()
+	if draining {
+		report.Status = "unavailable"
+	}
+	return report
+}
+
+// LiveHandler serves liveness probes, such as GET /healthz. It only tells
+// that the process serves requests: failing dependencies make the service
+// unready, but restarting it wouldn't help.
+func (h *Health) LiveHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, HealthReport{Status: "ok"})
+	})
+}
+
+// ReadyHandler serves readiness probes, such as GET /readyz: 200 when ready,
+// else 503, with the HealthReport either way.
+func (h *Health) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := h.Ready(r.Context())
+		status := http.StatusOK
+		if report.Status != "ok" {
+			status = http.StatusServiceUnavailable
+		}
+		writeHealth(w, status, report)
+	})
+}
+
+func writeHealth(w http.ResponseWriter, status int, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
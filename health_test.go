@@ -0,0 +1,79 @@
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	var (
+		ok     = CheckerFunc(func(context.Context) error { return nil })
+		failed = CheckerFunc(func(context.Context) error { return errors.New("connection refused") })
+		slow   = CheckerFunc(func(ctx context.Context) error { <-ctx.Done(); return ctx.Err() })
+	)
+	for _, tc := range []struct {
+		name     string
+		checks   map[string]Checker
+		draining bool
+		wantCode int
+		want     HealthReport // without latencies
+	}{
+		{"no checks", nil, false, http.StatusOK, HealthReport{Status: "ok"}},
+		{"ok", map[string]Checker{"db": ok, "cache": ok}, false, http.StatusOK, HealthReport{Status: "ok", Checks: map[string]CheckResult{
+			"db": {Status: "ok"}, "cache": {Status: "ok"},
+		}}},
+		{"failed", map[string]Checker{"db": failed, "cache": ok}, false, http.StatusServiceUnavailable, HealthReport{Status: "unavailable", Checks: map[string]CheckResult{
+			"db": {Status: "failed", Error: "connection refused"}, "cache": {Status: "ok"},
+		}}},
+		{"timed out", map[string]Checker{"db": slow}, false, http.StatusServiceUnavailable, HealthReport{Status: "unavailable", Checks: map[string]CheckResult{
+			"db": {Status: "failed", Error: context.DeadlineExceeded.Error()},
+		}}},
+		{"draining", map[string]Checker{"db": ok}, true, http.StatusServiceUnavailable, HealthReport{Status: "unavailable", Draining: true, Checks: map[string]CheckResult{
+			"db": {Status: "ok"},
+		}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := NewHealth(10 * time.Millisecond)
+			for name, c := range tc.checks {
+				h.Register(name, c)
+			}
+			h.SetDraining(tc.draining)
+
+			// However unready, the service is alive.
+			w := httptest.NewRecorder()
+			h.LiveHandler().ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("/healthz status = %d, want %d", w.Code, http.StatusOK)
+			}
+
+			w = httptest.NewRecorder()
+			h.ReadyHandler().ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+			if w.Code != tc.wantCode {
+				t.Errorf("/readyz status = %d, want %d", w.Code, tc.wantCode)
+			}
+			if got := w.Header().Get("Cache-Control"); got != "no-store" {
+				t.Errorf("Cache-Control = %q, want no-store", got)
+			}
+			var got HealthReport
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			for name, r := range got.Checks {
+				r.LatencyMS = 0
+				got.Checks[name] = r
+			}
+			if len(got.Checks) == 0 {
+				got.Checks = nil
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("report = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
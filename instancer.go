@@ -0,0 +1,125 @@
+package users
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+)
+
+// FileInstancer is an sd.Instancer reading instances from a file, one
+// host:port per line, ignoring blank lines and # comments. The file is read
+// again at an interval, so instances can be changed without a restart, e.g.
+// by a config management tool.
+//
+// Like the instancers of go-kit, it sends the instances sorted, and every
+// subscriber a copy of its own, since endpointers sort them in place.
+type FileInstancer struct {
+	path   string
+	logger log.Logger
+	quit   chan struct{}
+
+	mtx   sync.Mutex
+	state sd.Event
+	subs  map[chan<- sd.Event]struct{}
+}
+
+// NewFileInstancer returns a FileInstancer reading the file at path every
+// interval, until stopped.
+func NewFileInstancer(path string, interval time.Duration, logger log.Logger) *FileInstancer {
+	in := &FileInstancer{
+		path:   path,
+		logger: logger,
+		quit:   make(chan struct{}),
+		subs:   map[chan<- sd.Event]struct{}{},
+	}
+	in.update(in.read())
+	go in.loop(time.NewTicker(interval))
+	return in
+}
+
+func (in *FileInstancer) loop(t *time.Ticker) {
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			in.update(in.read())
+		case <-in.quit:
+			return
+		}
+	}
+}
+
+func (in *FileInstancer) read() sd.Event {
+	b, err := ioutil.ReadFile(in.path)
+	if err != nil {
+		in.logger.Log("path", in.path, "err", err)
+		return sd.Event{Err: err}
+	}
+	var instances []string
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			instances = append(instances, line)
+		}
+	}
+	sort.Strings(instances)
+	return sd.Event{Instances: instances}
+}
+
+// update broadcasts ev to the subscribers, unless nothing changed.
+func (in *FileInstancer) update(ev sd.Event) {
+	in.mtx.Lock()
+	defer in.mtx.Unlock()
+	// Keep serving the last instances read while the file is unreadable.
+	if ev.Err != nil {
+		ev.Instances = in.state.Instances
+	}
+	if reflect.DeepEqual(in.state.Instances, ev.Instances) && fmt.Sprint(in.state.Err) == fmt.Sprint(ev.Err) {
+		return
+	}
+	in.state = ev
+	for ch := range in.subs {
+		ch <- copyEvent(ev)
+	}
+}
+
+// Register implements sd.Instancer.
+func (in *FileInstancer) Register(ch chan<- sd.Event) {
+	in.mtx.Lock()
+	defer in.mtx.Unlock()
+	in.subs[ch] = struct{}{}
+	ch <- copyEvent(in.state)
+}
+
+// Deregister implements sd.Instancer.
+func (in *FileInstancer) Deregister(ch chan<- sd.Event) {
+	in.mtx.Lock()
+	defer in.mtx.Unlock()
+	delete(in.subs, ch)
+}
+
+// copyEvent returns ev with a copy of its instances.
+func copyEvent(ev sd.Event) sd.Event {
+	if ev.Instances != nil {
+		ev.Instances = append([]string(nil), ev.Instances...)
+	}
+	return ev
+}
+
+// Stop stops reading the file.
+func (in *FileInstancer) Stop() {
+	close(in.quit)
+}
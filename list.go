@@ -0,0 +1,140 @@
+package users
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// list errors
+var (
+	ErrInvalidCursor      = newError("invalid_cursor", http.StatusBadRequest, "invalid cursor")
+	ErrInvalidListOptions = newError("invalid_list_options", http.StatusBadRequest, "invalid list options")
+)
+
+// SortField is a field users can be listed by.
+type SortField string
+
+// sort fields
+const (
+	SortByCreated  SortField = "created"
+	SortByUpdated  SortField = "updated"
+	SortByUsername SortField = "username"
+)
+
+// page sizes
+const (
+	DefaultListLimit = 50
+	MaxListLimit     = 200
+)
+
+// ListOptions select, order and paginate users. Zero values mean no filter,
+// sorting by creation, and the first page of DefaultListLimit users.
+type ListOptions struct {
+	Role        string    // exact match
+	EmailDomain string    // e.g. example.com, case insensitive
+	NamePrefix  string    // prefix of the username, first or last name, case insensitive
+	SortBy      SortField // defaults to SortByCreated
+	Descending  bool
+	Limit       int
+	Cursor      string // NextCursor of the previous page
+}
+
+// UserPage is a page of users. NextCursor is empty on the last page.
+type UserPage struct {
+	Users      []User `json:"users"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// UserQuery is what repositories need to list a page of users. Users are
+// ordered by SortBy then ID, and After, if any, is the position of the last
+// user of the previous page.
+type UserQuery struct {
+	Role        string
+	EmailDomain string
+	NamePrefix  string
+	SortBy      SortField
+	Descending  bool
+	After       *ListCursor
+	Limit       int
+}
+
+// ListCursor is the position of a user in a listing. Only the field matching
+// SortBy is set, besides ID which breaks ties.
+type ListCursor struct {
+	SortBy     SortField `json:"s"`
+	Descending bool      `json:"d,omitempty"`
+	Time       time.Time `json:"t,omitempty"`
+	Username   string    `json:"u,omitempty"`
+	ID         uint      `json:"i"`
+}
+
+// cursorOf returns the position of m in a listing ordered as in q.
+func cursorOf(m UserModel, q UserQuery) ListCursor {
+	c := ListCursor{SortBy: q.SortBy, Descending: q.Descending, ID: m.ID}
+	switch q.SortBy {
+	case SortByCreated:
+		c.Time = m.CreatedAt
+	case SortByUpdated:
+		c.Time = m.UpdatedAt
+	case SortByUsername:
+		c.Username = m.Username
+	}
+	return c
+}
+
+// encodeCursor makes c opaque to clients.
+func encodeCursor(c ListCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (ListCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return ListCursor{}, ErrInvalidCursor
+	}
+	var c ListCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return ListCursor{}, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// queryFrom validates opts and turns them into a UserQuery.
+func queryFrom(opts ListOptions) (UserQuery, error) {
+	q := UserQuery{
+		Role:        opts.Role,
+		EmailDomain: opts.EmailDomain,
+		NamePrefix:  opts.NamePrefix,
+		SortBy:      opts.SortBy,
+		Descending:  opts.Descending,
+		Limit:       opts.Limit,
+	}
+	switch q.SortBy {
+	case "":
+		q.SortBy = SortByCreated
+	case SortByCreated, SortByUpdated, SortByUsername:
+	default:
+		return UserQuery{}, ErrInvalidListOptions
+	}
+	switch {
+	case q.Limit == 0:
+		q.Limit = DefaultListLimit
+	case q.Limit < 0 || q.Limit > MaxListLimit:
+		return UserQuery{}, ErrInvalidListOptions
+	}
+	if opts.Cursor != "" {
+		c, err := decodeCursor(opts.Cursor)
+		if err != nil {
+			return UserQuery{}, err
+		}
+		// A cursor only makes sense for the ordering it was made with.
+		if c.SortBy != q.SortBy || c.Descending != q.Descending {
+			return UserQuery{}, ErrInvalidCursor
+		}
+		q.After = &c
+	}
+	return q, nil
+}
@@ -0,0 +1,104 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHTTPListUsers(t *testing.T) {
+	ts := newTestServer(t)
+	for i, name := range []string{"dave", "alice", "erin", "carol", "bob", "frank", "grace"} {
+		u := User{Username: name, Email: name + "@example.com", Role: "user"}
+		if i%2 == 1 {
+			u.Email, u.Role = name+"@acme.com", "admin"
+		}
+		ts.seed(u)
+	}
+	admin := ts.token("admin", "admin")
+
+	// list follows next_cursor until the last page and returns the
+	// usernames of every page.
+	list := func(t *testing.T, query url.Values) []string {
+		t.Helper()
+		var names []string
+		for pages := 0; pages < 10; pages++ {
+			resp, body := ts.do("GET", "/users?"+query.Encode(), admin, nil)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d: %s", resp.StatusCode, body)
+			}
+			var page UserPage
+			if err := json.Unmarshal(body, &page); err != nil {
+				t.Fatal(err)
+			}
+			for _, u := range page.Users {
+				names = append(names, u.Username)
+			}
+			if page.NextCursor == "" {
+				return names
+			}
+			query.Set("cursor", page.NextCursor)
+		}
+		t.Fatal("too many pages")
+		return nil
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"", "dave alice erin carol bob frank grace"},
+		{"limit=2", "dave alice erin carol bob frank grace"},
+		{"limit=3&sort=-created", "grace frank bob carol erin alice dave"},
+		{"limit=2&sort=username", "alice bob carol dave erin frank grace"},
+		{"limit=3&sort=-username", "grace frank erin dave carol bob alice"},
+		{"limit=1&role=admin&sort=username", "alice carol frank"},
+		{"email_domain=ACME.com&sort=username", "alice carol frank"},
+		{"name_prefix=E", "erin"},
+		{"name_prefix=z", ""},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			query, err := url.ParseQuery(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(list(t, query), " "); got != tc.want {
+				t.Errorf("users = %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	// A cursor of the first page, sorted by username.
+	_, body := ts.do("GET", "/users?limit=1&sort=username", admin, nil)
+	var page UserPage
+	if err := json.Unmarshal(body, &page); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		query    string
+		wantCode int
+		wantErr  string
+	}{
+		{"cursor=garbage", http.StatusBadRequest, "invalid_cursor"},
+		{"sort=created&cursor=" + page.NextCursor, http.StatusBadRequest, "invalid_cursor"},
+		{"sort=-username&cursor=" + page.NextCursor, http.StatusBadRequest, "invalid_cursor"},
+		{"limit=ten", http.StatusBadRequest, "invalid_list_options"},
+		{"sort=email", http.StatusUnprocessableEntity, "validation_failed"},
+		{"role=nobody", http.StatusUnprocessableEntity, "validation_failed"},
+		{fmt.Sprintf("limit=%d", MaxListLimit+1), http.StatusUnprocessableEntity, "validation_failed"},
+		{"limit=-1", http.StatusUnprocessableEntity, "validation_failed"},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			resp, body := ts.do("GET", "/users?"+tc.query, admin, nil)
+			if resp.StatusCode != tc.wantCode {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode, tc.wantCode, body)
+			}
+			if got := problemCode(body); got != tc.wantErr {
+				t.Errorf("problem = %q, want %q", got, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	kitlog "github.com/go-kit/kit/log"
+)
+
+// ErrAccountLocked is returned for logins to an account, or from an IP, with
+// too many recent failures. It tells when to try again, see
+// Error.RetryAfter.
+var ErrAccountLocked = newError("account_locked", http.StatusTooManyRequests, "too many failed login attempts")
+
+// LockoutPolicy says when failed logins lock an account, or an IP, out.
+type LockoutPolicy struct {
+	// Threshold is the number of failures that starts a lockout.
+	Threshold int
+
+	// BaseDelay is how long the first lockout lasts, doubled by every failure
+	// after it, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// Window is how long failures are remembered after the last one. It
+	// should be longer than MaxDelay.
+	Window time.Duration
+}
+
+// Default lockout policies. IPs have a higher threshold, since many users may
+// share one behind a NAT.
+var (
+	DefaultAccountLockout = LockoutPolicy{Threshold: 5, BaseDelay: 30 * time.Second, MaxDelay: time.Hour, Window: 24 * time.Hour}
+	DefaultIPLockout      = LockoutPolicy{Threshold: 50, BaseDelay: 30 * time.Second, MaxDelay: time.Hour, Window: 24 * time.Hour}
+)
+
+// lockedUntil returns when the lockout following attempts ends, the zero time
+// if there's none.
+func (p LockoutPolicy) lockedUntil(a Attempts) time.Time {
+	if p.Threshold <= 0 || a.Failures < p.Threshold {
+		return time.Time{}
+	}
+	d := p.BaseDelay
+	for i := p.Threshold; i < a.Failures && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return a.Last.Add(d)
+}
+
+// Attempts are the recent failed logins of an account or IP.
+type Attempts struct {
+	Failures int
+	Last     time.Time
+}
+
+// AttemptCounter counts failed logins by key, such as "user:jane" or
+// "ip:192.0.2.1".
+type AttemptCounter interface {
+	Get(ctx context.Context, key string) (Attempts, error)
+
+	// Fail records a failure at now, forgetting earlier ones if the last was
+	// before now minus window, and returns the updated attempts.
+	Fail(ctx context.Context, key string, now time.Time, window time.Duration) (Attempts, error)
+
+	Reset(ctx context.Context, key string) error
+}
+
+// LockoutMiddleware locks accounts and IPs out after failed logins, as told by
+// the account and ip policies. Locked out logins fail with ErrAccountLocked
+// without checking credentials. Successful logins reset the failures of the
+// account, but not of the IP, and so does Service.UnlockUser.
+//
+// Lockouts and unlocks are logged to logger. IPs are read from the context,
+// see ClientIPFromContext.
+func LockoutMiddleware(counter AttemptCounter, account, ip LockoutPolicy, logger kitlog.Logger) Middleware {
+	return func(next Service) Service {
+		return lockoutMiddleware{next, counter, account, ip, logger}
+	}
+}
+
+type lockoutMiddleware struct {
+	Service
+	counter     AttemptCounter
+	account, ip LockoutPolicy
+	logger      kitlog.Logger
+}
+
+// lockoutKey is a key of the counter, with the policy it's locked out by.
+type lockoutKey struct {
+	key    string
+	policy LockoutPolicy
+}
+
+func accountLockoutKey(username string) string { return "user:" + username }
+
+func (mw lockoutMiddleware) keys(ctx context.Context, username string) []lockoutKey {
+	keys := []lockoutKey{{accountLockoutKey(username), mw.account}}
+	if ip, ok := ClientIPFromContext(ctx); ok {
+		keys = append(keys, lockoutKey{"ip:" + ip, mw.ip})
+	}
+	return keys
+}
+
+func (mw lockoutMiddleware) Authenticate(ctx context.Context, username, password, otp string) (Token, error) {
+	now := time.Now()
+	keys := mw.keys(ctx, username)
+	for _, k := range keys {
+		a, err := mw.counter.Get(ctx, k.key)
+		if err != nil {
+			return Token{}, err
+		}
+		if until := k.policy.lockedUntil(a); now.Before(until) {
+			return Token{}, ErrAccountLocked.WithRetryAfter(until.Sub(now))
+		}
+	}
+
+	t, err := mw.Service.Authenticate(ctx, username, password, otp)
+	switch {
+	case err == nil:
+		if rerr := mw.counter.Reset(ctx, accountLockoutKey(username)); rerr != nil {
+			mw.logger.Log("method", "Authenticate", "username", username, "err", rerr)
+		}
+	case errors.Is(err, ErrInvalidCredentials), errors.Is(err, ErrInvalidMFACode):
+		for _, k := range keys {
+			a, ferr := mw.counter.Fail(ctx, k.key, now, k.policy.Window)
+			if ferr != nil {
+				mw.logger.Log("method", "Authenticate", "username", username, "err", ferr)
+				continue
+			}
+			if until := k.policy.lockedUntil(a); now.Before(until) {
+				mw.logger.Log("method", "Authenticate", "event", "locked", "key", k.key, "failures", a.Failures, "until", until.UTC())
+			}
+		}
+	}
+	return t, err
+}
+
+func (mw lockoutMiddleware) UnlockUser(ctx context.Context, username string) error {
+	if err := mw.Service.UnlockUser(ctx, username); err != nil {
+		return err
+	}
+	if err := mw.counter.Reset(ctx, accountLockoutKey(username)); err != nil {
+		return err
+	}
+	mw.logger.Log("method", "UnlockUser", "event", "unlocked", "key", accountLockoutKey(username))
+	return nil
+}
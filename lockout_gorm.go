@@ -0,0 +1,68 @@
+package users
+
+import (
+	"context"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// LoginAttemptModel is the failed logins of an account or IP, as stored by the
+// GORM AttemptCounter.
+type LoginAttemptModel struct {
+	Key         string `gorm:"type:varchar(255);primary_key"`
+	Failures    int
+	LastFailure time.Time
+}
+
+// TableName implements gorm's tabler interface.
+func (LoginAttemptModel) TableName() string { return "login_attempts" }
+
+type gormAttemptCounter struct {
+	db *gorm.DB
+}
+
+// NewGormAttemptCounter returns an AttemptCounter backed by the given GORM
+// connection, see migrations for its login_attempts table. Unlike the in-memory
+// one, it's shared by every instance of the service.
+func NewGormAttemptCounter(db *gorm.DB) AttemptCounter {
+	return &gormAttemptCounter{db}
+}
+
+// with passes ctx along to the GORM callbacks, see TraceGorm.
+func (c *gormAttemptCounter) with(ctx context.Context) *gorm.DB {
+	return c.db.Set(gormContextKey, ctx)
+}
+
+func (c *gormAttemptCounter) Get(ctx context.Context, key string) (Attempts, error) {
+	var m LoginAttemptModel
+	err := c.with(ctx).Where("key = ?", key).First(&m).Error
+	if err == gorm.ErrRecordNotFound {
+		return Attempts{}, nil
+	}
+	if err != nil {
+		return Attempts{}, err
+	}
+	return Attempts{Failures: m.Failures, Last: m.LastFailure}, nil
+}
+
+func (c *gormAttemptCounter) Fail(ctx context.Context, key string, now time.Time, window time.Duration) (Attempts, error) {
+	// One upsert, so concurrent failures all count.
+	var m LoginAttemptModel
+	err := c.with(ctx).Raw(`
+		INSERT INTO login_attempts (key, failures, last_failure) VALUES (?, 1, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_attempts.last_failure < ? THEN 1 ELSE login_attempts.failures + 1 END,
+			last_failure = EXCLUDED.last_failure
+		RETURNING key, failures, last_failure`,
+		key, now, now.Add(-window),
+	).Scan(&m).Error
+	if err != nil {
+		return Attempts{}, err
+	}
+	return Attempts{Failures: m.Failures, Last: m.LastFailure}, nil
+}
+
+func (c *gormAttemptCounter) Reset(ctx context.Context, key string) error {
+	return c.with(ctx).Where("key = ?", key).Delete(&LoginAttemptModel{}).Error
+}
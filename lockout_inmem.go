@@ -0,0 +1,45 @@
+package users
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type inmemAttemptCounter struct {
+	mtx sync.Mutex
+	m   map[string]Attempts
+}
+
+// NewInmemAttemptCounter returns a concurrency-safe AttemptCounter that keeps
+// everything in memory, so each instance of the service counts on its own.
+// Useful in tests and local demos.
+func NewInmemAttemptCounter() AttemptCounter {
+	return &inmemAttemptCounter{m: map[string]Attempts{}}
+}
+
+func (c *inmemAttemptCounter) Get(_ context.Context, key string) (Attempts, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.m[key], nil
+}
+
+func (c *inmemAttemptCounter) Fail(_ context.Context, key string, now time.Time, window time.Duration) (Attempts, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	a := c.m[key]
+	if a.Last.Before(now.Add(-window)) {
+		a.Failures = 0
+	}
+	a.Failures++
+	a.Last = now
+	c.m[key] = a
+	return a, nil
+}
+
+func (c *inmemAttemptCounter) Reset(_ context.Context, key string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delete(c.m, key)
+	return nil
+}
@@ -0,0 +1,151 @@
+package users
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestLockoutPolicy(t *testing.T) {
+	var (
+		last   = time.Unix(1700000000, 0)
+		policy = LockoutPolicy{Threshold: 3, BaseDelay: time.Minute, MaxDelay: 10 * time.Minute}
+	)
+	for _, tc := range []struct {
+		name     string
+		policy   LockoutPolicy
+		failures int
+		want     time.Duration // after the last failure, 0 for no lockout
+	}{
+		{"below threshold", policy, 2, 0},
+		{"at threshold", policy, 3, time.Minute},
+		{"doubled", policy, 4, 2 * time.Minute},
+		{"doubled again", policy, 6, 8 * time.Minute},
+		{"capped", policy, 7, 10 * time.Minute},
+		{"capped long after", policy, 100, 10 * time.Minute},
+		{"disabled", LockoutPolicy{}, 100, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			until := tc.policy.lockedUntil(Attempts{Failures: tc.failures, Last: last})
+			var got time.Duration
+			if !until.IsZero() {
+				got = until.Sub(last)
+			}
+			if got != tc.want {
+				t.Errorf("locked for %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHTTPLockout(t *testing.T) {
+	var (
+		account = LockoutPolicy{Threshold: 2, BaseDelay: time.Hour, MaxDelay: 4 * time.Hour, Window: 24 * time.Hour}
+		ip      = LockoutPolicy{Threshold: 4, BaseDelay: time.Hour, MaxDelay: 4 * time.Hour, Window: 24 * time.Hour}
+	)
+	// Each step logs in from an IP, or unlocks a user as an admin.
+	type step struct {
+		user, password, ip string
+		unlock             bool
+		wantCode           int
+		wantRetry          int // Retry-After, in seconds
+	}
+	const wrong = "wrong password"
+	for _, tc := range []struct {
+		name     string
+		failures int // of alice, recorded before the steps
+		steps    []step
+	}{
+		{"locked out", 0, []step{
+			{"alice", wrong, "192.0.2.1", false, http.StatusUnauthorized, 0},
+			{"alice", wrong, "192.0.2.1", false, http.StatusUnauthorized, 0},
+			{"alice", testPassword, "192.0.2.1", false, http.StatusTooManyRequests, 3600},
+			{"alice", testPassword, "192.0.2.2", false, http.StatusTooManyRequests, 3600},
+			{"bob", testPassword, "192.0.2.1", false, http.StatusOK, 0},
+		}},
+		{"backoff doubles", 3, []step{
+			{"alice", testPassword, "192.0.2.1", false, http.StatusTooManyRequests, 7200},
+		}},
+		{"backoff capped", 10, []step{
+			{"alice", testPassword, "192.0.2.1", false, http.StatusTooManyRequests, 14400},
+		}},
+		{"locked again after unlock", 0, []step{
+			{"alice", wrong, "192.0.2.1", false, http.StatusUnauthorized, 0},
+			{"alice", wrong, "192.0.2.1", false, http.StatusUnauthorized, 0},
+			{"alice", "", "", true, http.StatusOK, 0},
+			{"alice", wrong, "192.0.2.1", false, http.StatusUnauthorized, 0},
+			{"alice", wrong, "192.0.2.1", false, http.StatusUnauthorized, 0},
+			{"alice", testPassword, "192.0.2.1", false, http.StatusTooManyRequests, 3600},
+		}},
+		{"success resets", 0, []step{
+			{"alice", wrong, "192.0.2.1", false, http.StatusUnauthorized, 0},
+			{"alice", testPassword, "192.0.2.1", false, http.StatusOK, 0},
+			{"alice", wrong, "192.0.2.1", false, http.StatusUnauthorized, 0},
+			{"alice", testPassword, "192.0.2.1", false, http.StatusOK, 0},
+		}},
+		{"unlock", 0, []step{
+			{"alice", wrong, "192.0.2.1", false, http.StatusUnauthorized, 0},
+			{"alice", wrong, "192.0.2.1", false, http.StatusUnauthorized, 0},
+			{"alice", "", "", true, http.StatusOK, 0},
+			{"alice", testPassword, "192.0.2.1", false, http.StatusOK, 0},
+		}},
+		{"unlock unknown", 0, []step{
+			{"carol", "", "", true, http.StatusNotFound, 0},
+		}},
+		{"ip locked out", 0, []step{
+			{"alice", wrong, "192.0.2.1", false, http.StatusUnauthorized, 0},
+			{"bob", wrong, "192.0.2.1", false, http.StatusUnauthorized, 0},
+			{"carol", wrong, "192.0.2.1", false, http.StatusUnauthorized, 0},
+			{"dave", wrong, "192.0.2.1", false, http.StatusUnauthorized, 0},
+			{"bob", testPassword, "192.0.2.1", false, http.StatusTooManyRequests, 3600},
+			{"bob", testPassword, "192.0.2.2", false, http.StatusOK, 0},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			counter := NewInmemAttemptCounter()
+			for i := 0; i < tc.failures; i++ {
+				if _, err := counter.Fail(context.Background(), accountLockoutKey("alice"), time.Now(), account.Window); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ts := newTestServer(t,
+				withMiddlewares(LockoutMiddleware(counter, account, ip, log.NewNopLogger())),
+				withEndpointOptions(WithTrustedProxies(1)),
+			)
+			for _, name := range []string{"alice", "bob"} {
+				ts.seed(User{Username: name, Email: name + "@example.com", Password: testPassword, Role: "user"})
+			}
+			admin := ts.token("admin", "admin")
+
+			for i, s := range tc.steps {
+				var (
+					resp *http.Response
+					body []byte
+				)
+				if s.unlock {
+					resp, body = ts.do("POST", "/users/"+s.user+":unlock", admin, nil)
+				} else {
+					resp, body = ts.do("POST", "/auth/login", "", loginRequest{Username: s.user, Password: s.password}, "X-Forwarded-For", s.ip)
+				}
+				if resp.StatusCode != s.wantCode {
+					t.Fatalf("step %d: status = %d, want %d: %s", i, resp.StatusCode, s.wantCode, body)
+				}
+				if s.wantRetry == 0 {
+					continue
+				}
+				// Rounded down, and a little time passed since the lockout.
+				retry, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+				if err != nil || retry > s.wantRetry || retry < s.wantRetry-5 {
+					t.Errorf("step %d: Retry-After = %q, want about %d", i, resp.Header.Get("Retry-After"), s.wantRetry)
+				}
+				if got := problemCode(body); got != "account_locked" {
+					t.Errorf("step %d: problem = %q, want account_locked", i, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package users
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails, such as password reset links.
+type Mailer interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// bytes returns m as an RFC 5322 message from the given address.
+func (m Message) bytes(from string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", m.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(m.Body)
+	return b.Bytes()
+}
+
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPMailer returns a Mailer sending from the given address through the
+// SMTP server at addr, authenticating with auth unless nil.
+func NewSMTPMailer(addr, from string, auth smtp.Auth) Mailer {
+	return smtpMailer{addr: addr, from: from, auth: auth}
+}
+
+func (s smtpMailer) Send(_ context.Context, m Message) error {
+	return smtp.SendMail(s.addr, s.auth, s.from, []string{m.To}, m.bytes(s.from))
+}
+
+type fileMailer struct {
+	dir  string
+	from string
+}
+
+// NewFileMailer returns a Mailer writing every message to an .eml file in dir,
+// for local development without an SMTP server.
+func NewFileMailer(dir, from string) Mailer {
+	return fileMailer{dir: dir, from: from}
+}
+
+func (f fileMailer) Send(_ context.Context, m Message) error {
+	if err := os.MkdirAll(f.dir, 0700); err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := time.Now().UTC().Format("20060102T150405.000000000") + "-" + hex.EncodeToString(suffix) + ".eml"
+	return ioutil.WriteFile(filepath.Join(f.dir, name), m.bytes(f.from), 0600)
+}
+
+// InmemMailer is a Mailer keeping messages in memory, for tests.
+type InmemMailer struct {
+	mtx      sync.Mutex
+	messages []Message
+}
+
+// NewInmemMailer returns an empty InmemMailer.
+func NewInmemMailer() *InmemMailer {
+	return &InmemMailer{}
+}
+
+// Send implements Mailer.
+func (i *InmemMailer) Send(_ context.Context, m Message) error {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	i.messages = append(i.messages, m)
+	return nil
+}
+
+// Messages returns the messages sent so far.
+func (i *InmemMailer) Messages() []Message {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	return append([]Message(nil), i.messages...)
+}
@@ -0,0 +1,223 @@
+package users
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// MFA errors
+var (
+	ErrMFARequired       = newError("mfa_required", http.StatusUnauthorized, "second factor required")
+	ErrInvalidMFACode    = newError("invalid_mfa_code", http.StatusUnauthorized, "invalid second factor code")
+	ErrMFANotEnrolled    = newError("mfa_not_enrolled", http.StatusConflict, "two-factor authentication not enrolled")
+	ErrMFAAlreadyEnabled = newError("mfa_already_enabled", http.StatusConflict, "two-factor authentication already enabled")
+
+	ErrNoSecretBox = errors.New("no secret box configured")
+)
+
+// authentication methods, as in the amr claim of tokens, see RFC 8176
+const (
+	AMRPassword = "pwd"
+	AMROTP      = "otp" // a TOTP or recovery code
+	AMRMFA      = "mfa" // more than one factor
+)
+
+// MFAState is the two-factor authentication state of a user, stored with it.
+type MFAState struct {
+	// Secret is the TOTP secret, sealed by the service's SecretBox. It is
+	// set on enrollment, but only used once Enabled by a confirmation.
+	Secret  string `gorm:"type:text"`
+	Enabled bool   `gorm:"not null;default:false"`
+
+	// RecoveryCodes are the hashes of the unused recovery codes, separated
+	// by spaces, see hashRecoveryCode.
+	RecoveryCodes string `gorm:"type:text"`
+
+	// LastStep is the time step of the last TOTP code accepted, so codes
+	// can't be replayed.
+	LastStep int64 `gorm:"not null;default:0"`
+}
+
+// MFAEnrollment is a new TOTP secret, to add to an authenticator app, usually
+// by scanning URI as a QR code.
+type MFAEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// TOTP parameters, the defaults of RFC 6238 every authenticator app supports
+const (
+	totpDigits = 6
+	totpPeriod = 30 // seconds
+	totpSkew   = 1  // steps accepted before and after the current one
+
+	totpSecretLength = 20 // bytes, as the SHA-1 output, see RFC 4226
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a random TOTP secret, base32 encoded.
+func newTOTPSecret() (string, error) {
+	b := make([]byte, totpSecretLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32NoPadding.EncodeToString(b), nil
+}
+
+// totpURI returns the otpauth URI of a secret, see
+// https://github.com/google/google-authenticator/wiki/Key-Uri-Format.
+func totpURI(issuer, username, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + username,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+// totpCode returns the code of secret at the time step, see RFC 4226.
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%1000000), nil
+}
+
+// verifyTOTP returns the time step code is valid for at now, allowing for
+// totpSkew, if later than lastStep. It returns 0 if the code is invalid.
+func verifyTOTP(secret, code string, now time.Time, lastStep int64) (int64, error) {
+	if len(code) != totpDigits {
+		return 0, nil
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		want, err := totpCode(secret, step)
+		if err != nil {
+			return 0, err
+		}
+		if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return step, nil
+		}
+	}
+	return 0, nil
+}
+
+// recoveryCodeCount is how many recovery codes are generated at a time.
+const recoveryCodeCount = 10
+
+// newRecoveryCodes returns new recovery codes, like "k7xq2-mb4rt", and their
+// hashes, separated by spaces as in MFAState.
+func newRecoveryCodes() (codes []string, hashes string, err error) {
+	hs := make([]string, recoveryCodeCount)
+	codes = make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, "", err
+		}
+		s := strings.ToLower(base32NoPadding.EncodeToString(b))[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+		hs[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, strings.Join(hs, " "), nil
+}
+
+// hashRecoveryCode returns the hash recovery codes are stored as. Like refresh
+// tokens, they are random enough not to need a slow, salted hash.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// useRecoveryCode removes code from the hashes, separated by spaces, and
+// reports whether it was there.
+func useRecoveryCode(hashes, code string) (string, bool) {
+	h := hashRecoveryCode(code)
+	left := strings.Fields(hashes)
+	for i, stored := range left {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(h)) == 1 {
+			return strings.Join(append(left[:i], left[i+1:]...), " "), true
+		}
+	}
+	return hashes, false
+}
+
+// SecretBox encrypts secrets stored in the database, such as TOTP secrets,
+// so a leaked database doesn't leak them too.
+type SecretBox interface {
+	Seal(plaintext []byte) (string, error)
+	Open(sealed string) ([]byte, error)
+}
+
+type aesSecretBox struct {
+	aead cipher.AEAD
+}
+
+// NewAESSecretBox returns a SecretBox encrypting with AES-GCM and key, which
+// must be 16, 24 or 32 bytes long.
+func NewAESSecretBox(key []byte) (SecretBox, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return aesSecretBox{aead}, nil
+}
+
+func (b aesSecretBox) Seal(plaintext []byte) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(b.aead.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+func (b aesSecretBox) Open(sealed string) ([]byte, error) {
+	data, err := base64.RawStdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	n := b.aead.NonceSize()
+	if len(data) < n {
+		return nil, errors.New("sealed secret too short")
+	}
+	return b.aead.Open(nil, data[:n], data[n:], nil)
+}
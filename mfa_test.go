@@ -0,0 +1,195 @@
+package users
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// The SHA-1 test vectors of RFC 6238, truncated to 6 digits.
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" // "12345678901234567890"
+	for _, tc := range []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	} {
+		got, err := totpCode(secret, tc.unix/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("code at %d = %s, want %s", tc.unix, got, tc.want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	current := now.Unix() / totpPeriod
+	code := func(step int64) string {
+		c, err := totpCode(secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	for _, tc := range []struct {
+		name     string
+		code     string
+		lastStep int64
+		want     int64
+	}{
+		{"current", code(current), 0, current},
+		{"previous", code(current - 1), 0, current - 1},
+		{"next", code(current + 1), 0, current + 1},
+		{"too old", code(current - 2), 0, 0},
+		{"too new", code(current + 2), 0, 0},
+		{"replayed", code(current), current, 0},
+		{"after a later one", code(current - 1), current, 0},
+		{"short", code(current)[1:], 0, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := verifyTOTP(secret, tc.code, now, tc.lastStep)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("step = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(strings.Fields(hashes)) != recoveryCodeCount {
+		t.Fatalf("got %d codes and %d hashes, want %d", len(codes), len(strings.Fields(hashes)), recoveryCodeCount)
+	}
+
+	// Codes are forgiving about case and dashes, but single use.
+	left, ok := useRecoveryCode(hashes, strings.ToUpper(strings.Replace(codes[3], "-", "", 1)))
+	if !ok || len(strings.Fields(left)) != recoveryCodeCount-1 {
+		t.Fatalf("first use: ok %v with %d codes left", ok, len(strings.Fields(left)))
+	}
+	if _, ok := useRecoveryCode(left, codes[3]); ok {
+		t.Error("code used twice")
+	}
+	if _, ok := useRecoveryCode(left, "aaaaa-bbbbb"); ok {
+		t.Error("unknown code accepted")
+	}
+}
+
+func TestHTTPMFA(t *testing.T) {
+	box, err := NewAESSecretBox(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestServer(t, withServiceOptions(WithMFA(box, "test")))
+	ts.seed(User{Username: "alice", Email: "alice@example.com", Password: testPassword, Role: "user"})
+	alice := ts.token("alice", "user", AMRPassword)
+
+	// Codes of three consecutive steps are used below, which must all be
+	// within the skew of now.
+	if left := totpPeriod - time.Now().Unix()%totpPeriod; left < 3 {
+		time.Sleep(time.Duration(left) * time.Second)
+	}
+	step := time.Now().Unix() / totpPeriod
+
+	var enrollment MFAEnrollment
+	var codes []string
+	for _, s := range []struct {
+		name     string
+		path     string
+		body     func() interface{}
+		wantCode int
+		wantErr  string
+		out      interface{}
+	}{
+		{"regenerate before enrolling", "/users/alice/mfa/recovery-codes", func() interface{} {
+			return regenerateRecoveryCodesRequest{Code: "123456"}
+		}, http.StatusConflict, "mfa_not_enrolled", nil},
+		{"enroll", "/users/alice/mfa", func() interface{} { return nil }, http.StatusOK, "", &enrollment},
+		{"confirm wrong code", "/users/alice/mfa:confirm", func() interface{} {
+			return confirmMFARequest{Code: "000000"}
+		}, http.StatusUnauthorized, "invalid_mfa_code", nil},
+		{"confirm", "/users/alice/mfa:confirm", func() interface{} {
+			return confirmMFARequest{Code: mustTOTPCode(t, enrollment.Secret, step-1)}
+		}, http.StatusOK, "", &struct {
+			RecoveryCodes *[]string `json:"recovery_codes"`
+		}{&codes}},
+		{"enroll again", "/users/alice/mfa", func() interface{} { return nil }, http.StatusConflict, "mfa_already_enabled", nil},
+		{"login without code", "/auth/login", func() interface{} {
+			return loginRequest{Username: "alice", Password: testPassword}
+		}, http.StatusUnauthorized, "mfa_required", nil},
+		{"login with wrong password", "/auth/login", func() interface{} {
+			return loginRequest{Username: "alice", Password: "wrong", OTP: mustTOTPCode(t, enrollment.Secret, step)}
+		}, http.StatusUnauthorized, "invalid_credentials", nil},
+		{"login with replayed code", "/auth/login", func() interface{} {
+			return loginRequest{Username: "alice", Password: testPassword, OTP: mustTOTPCode(t, enrollment.Secret, step-1)}
+		}, http.StatusUnauthorized, "invalid_mfa_code", nil},
+		{"login with code", "/auth/login", func() interface{} {
+			return loginRequest{Username: "alice", Password: testPassword, OTP: mustTOTPCode(t, enrollment.Secret, step)}
+		}, http.StatusOK, "", nil},
+		{"login with recovery code", "/auth/login", func() interface{} {
+			return loginRequest{Username: "alice", Password: testPassword, OTP: codes[0]}
+		}, http.StatusOK, "", nil},
+		{"login with used recovery code", "/auth/login", func() interface{} {
+			return loginRequest{Username: "alice", Password: testPassword, OTP: codes[0]}
+		}, http.StatusUnauthorized, "invalid_mfa_code", nil},
+		{"regenerate", "/users/alice/mfa/recovery-codes", func() interface{} {
+			return regenerateRecoveryCodesRequest{Code: mustTOTPCode(t, enrollment.Secret, step+1)}
+		}, http.StatusOK, "", nil},
+		{"login with replaced recovery code", "/auth/login", func() interface{} {
+			return loginRequest{Username: "alice", Password: testPassword, OTP: codes[1]}
+		}, http.StatusUnauthorized, "invalid_mfa_code", nil},
+	} {
+		token := alice
+		if strings.HasPrefix(s.path, "/auth/") {
+			token = ""
+		}
+		resp, body := ts.do("POST", s.path, token, s.body())
+		if resp.StatusCode != s.wantCode {
+			t.Fatalf("%s: status = %d, want %d: %s", s.name, resp.StatusCode, s.wantCode, body)
+		}
+		if got := problemCode(body); got != s.wantErr {
+			t.Fatalf("%s: problem = %q, want %q", s.name, got, s.wantErr)
+		}
+		if s.out != nil {
+			if err := json.Unmarshal(body, s.out); err != nil {
+				t.Fatalf("%s: %v", s.name, err)
+			}
+		}
+		if s.path == "/auth/login" && s.wantErr == "" {
+			var token Token
+			json.Unmarshal(body, &token)
+			if claims, err := ParseToken(ts.keys, token.AccessToken); err != nil || !claims.MultiFactor() {
+				t.Errorf("%s: claims %+v, %v; want multi-factor ones", s.name, claims, err)
+			}
+		}
+	}
+}
+
+func mustTOTPCode(t *testing.T, secret string, step int64) string {
+	t.Helper()
+	code, err := totpCode(secret, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	kitlog "github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
 )
 
 // Middleware describes a service (as opposed to endpoint) middleware.
@@ -37,26 +38,263 @@ func (mw loggingMiddleware) GetUser(ctx context.Context, username string) (u Use
 	return mw.Service.GetUser(ctx, username)
 }
 
-func (mw loggingMiddleware) PutUser(ctx context.Context, username string, u User) (err error) {
+func (mw loggingMiddleware) PutUser(ctx context.Context, username string, u User, onCreate func(User) error) (err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log("method", "PutProfile", "username", username, "took", time.Since(begin), "err", err)
+		mw.logger.Log("method", "PutUser", "username", username, "took", time.Since(begin), "err", err)
 	}(time.Now())
 
-	return mw.Service.PutUser(ctx, username, u)
+	return mw.Service.PutUser(ctx, username, u, onCreate)
 }
 
-func (mw loggingMiddleware) PatchUser(ctx context.Context, username string, u User) (err error) {
+func (mw loggingMiddleware) PatchUser(ctx context.Context, username string, patch Patch) (err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log("method", "PatchProfile", "username", username, "took", time.Since(begin), "err", err)
+		mw.logger.Log("method", "PatchUser", "username", username, "took", time.Since(begin), "err", err)
 	}(time.Now())
 
-	return mw.Service.PatchUser(ctx, username, u)
+	return mw.Service.PatchUser(ctx, username, patch)
 }
 
-func (mw loggingMiddleware) DeleteProfile(ctx context.Context, username string) (err error) {
+func (mw loggingMiddleware) DeleteUser(ctx context.Context, username string) (err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log("method", "DeleteProfile", "username", username, "took", time.Since(begin), "err", err)
+		mw.logger.Log("method", "DeleteUser", "username", username, "took", time.Since(begin), "err", err)
 	}(time.Now())
 
 	return mw.Service.DeleteUser(ctx, username)
-}
\ No newline at end of file
+}
+
+func (mw loggingMiddleware) RestoreUser(ctx context.Context, username string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "RestoreUser", "username", username, "took", time.Since(begin), "err", err)
+	}(time.Now())
+
+	return mw.Service.RestoreUser(ctx, username)
+}
+
+func (mw loggingMiddleware) PurgeUser(ctx context.Context, username string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "PurgeUser", "username", username, "took", time.Since(begin), "err", err)
+	}(time.Now())
+
+	return mw.Service.PurgeUser(ctx, username)
+}
+
+func (mw loggingMiddleware) UnlockUser(ctx context.Context, username string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "UnlockUser", "username", username, "took", time.Since(begin), "err", err)
+	}(time.Now())
+
+	return mw.Service.UnlockUser(ctx, username)
+}
+
+func (mw loggingMiddleware) ListUsers(ctx context.Context, opts ListOptions) (p UserPage, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "ListUsers", "sort", opts.SortBy, "limit", opts.Limit, "users", len(p.Users), "took", time.Since(begin), "err", err)
+	}(time.Now())
+
+	return mw.Service.ListUsers(ctx, opts)
+}
+
+func (mw loggingMiddleware) Authenticate(ctx context.Context, username, password, otp string) (t Token, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "Authenticate", "username", username, "took", time.Since(begin), "err", err)
+	}(time.Now())
+
+	return mw.Service.Authenticate(ctx, username, password, otp)
+}
+
+func (mw loggingMiddleware) Refresh(ctx context.Context, refreshToken string) (t Token, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "Refresh", "took", time.Since(begin), "err", err)
+	}(time.Now())
+
+	return mw.Service.Refresh(ctx, refreshToken)
+}
+
+func (mw loggingMiddleware) Logout(ctx context.Context, refreshToken string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "Logout", "took", time.Since(begin), "err", err)
+	}(time.Now())
+
+	return mw.Service.Logout(ctx, refreshToken)
+}
+
+func (mw loggingMiddleware) RevokeSessions(ctx context.Context, username string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "RevokeSessions", "username", username, "took", time.Since(begin), "err", err)
+	}(time.Now())
+
+	return mw.Service.RevokeSessions(ctx, username)
+}
+
+func (mw loggingMiddleware) EnrollMFA(ctx context.Context, username string) (e MFAEnrollment, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "EnrollMFA", "username", username, "took", time.Since(begin), "err", err)
+	}(time.Now())
+
+	return mw.Service.EnrollMFA(ctx, username)
+}
+
+func (mw loggingMiddleware) ConfirmMFA(ctx context.Context, username, code string) (codes []string, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "ConfirmMFA", "username", username, "took", time.Since(begin), "err", err)
+	}(time.Now())
+
+	return mw.Service.ConfirmMFA(ctx, username, code)
+}
+
+func (mw loggingMiddleware) RegenerateRecoveryCodes(ctx context.Context, username, code string) (codes []string, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "RegenerateRecoveryCodes", "username", username, "took", time.Since(begin), "err", err)
+	}(time.Now())
+
+	return mw.Service.RegenerateRecoveryCodes(ctx, username, code)
+}
+
+func (mw loggingMiddleware) RequestPasswordReset(ctx context.Context, email string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "RequestPasswordReset", "took", time.Since(begin), "err", err)
+	}(time.Now())
+
+	return mw.Service.RequestPasswordReset(ctx, email)
+}
+
+func (mw loggingMiddleware) ResetPassword(ctx context.Context, token, password string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "ResetPassword", "took", time.Since(begin), "err", err)
+	}(time.Now())
+
+	return mw.Service.ResetPassword(ctx, token, password)
+}
+
+func (mw loggingMiddleware) VerifyEmail(ctx context.Context, username, token string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "VerifyEmail", "username", username, "took", time.Since(begin), "err", err)
+	}(time.Now())
+
+	return mw.Service.VerifyEmail(ctx, username, token)
+}
+
+// InstrumentingMiddleware records the number of requests, the number of errors
+// and the latency of every method. All metrics are labeled by "method", and
+// errors by "kind" too, see errorKind.
+func InstrumentingMiddleware(requestCount, errorCount metrics.Counter, requestLatency metrics.Histogram) Middleware {
+	return func(next Service) Service {
+		return instrumentingMiddleware{next, requestCount, errorCount, requestLatency}
+	}
+}
+
+type instrumentingMiddleware struct {
+	Service
+	requestCount   metrics.Counter
+	errorCount     metrics.Counter
+	requestLatency metrics.Histogram
+}
+
+func (mw instrumentingMiddleware) observe(method string, begin time.Time, err error) {
+	mw.requestCount.With("method", method).Add(1)
+	mw.requestLatency.With("method", method).Observe(time.Since(begin).Seconds())
+	if err != nil {
+		mw.errorCount.With("method", method, "kind", errorKind(err)).Add(1)
+	}
+}
+
+func (mw instrumentingMiddleware) PostUser(ctx context.Context, u User) (err error) {
+	defer func(begin time.Time) { mw.observe("PostUser", begin, err) }(time.Now())
+	return mw.Service.PostUser(ctx, u)
+}
+
+func (mw instrumentingMiddleware) GetUser(ctx context.Context, username string) (u User, err error) {
+	defer func(begin time.Time) { mw.observe("GetUser", begin, err) }(time.Now())
+	return mw.Service.GetUser(ctx, username)
+}
+
+func (mw instrumentingMiddleware) PutUser(ctx context.Context, username string, u User, onCreate func(User) error) (err error) {
+	defer func(begin time.Time) { mw.observe("PutUser", begin, err) }(time.Now())
+	return mw.Service.PutUser(ctx, username, u, onCreate)
+}
+
+func (mw instrumentingMiddleware) PatchUser(ctx context.Context, username string, patch Patch) (err error) {
+	defer func(begin time.Time) { mw.observe("PatchUser", begin, err) }(time.Now())
+	return mw.Service.PatchUser(ctx, username, patch)
+}
+
+func (mw instrumentingMiddleware) DeleteUser(ctx context.Context, username string) (err error) {
+	defer func(begin time.Time) { mw.observe("DeleteUser", begin, err) }(time.Now())
+	return mw.Service.DeleteUser(ctx, username)
+}
+
+func (mw instrumentingMiddleware) RestoreUser(ctx context.Context, username string) (err error) {
+	defer func(begin time.Time) { mw.observe("RestoreUser", begin, err) }(time.Now())
+	return mw.Service.RestoreUser(ctx, username)
+}
+
+func (mw instrumentingMiddleware) PurgeUser(ctx context.Context, username string) (err error) {
+	defer func(begin time.Time) { mw.observe("PurgeUser", begin, err) }(time.Now())
+	return mw.Service.PurgeUser(ctx, username)
+}
+
+func (mw instrumentingMiddleware) UnlockUser(ctx context.Context, username string) (err error) {
+	defer func(begin time.Time) { mw.observe("UnlockUser", begin, err) }(time.Now())
+	return mw.Service.UnlockUser(ctx, username)
+}
+
+func (mw instrumentingMiddleware) ListUsers(ctx context.Context, opts ListOptions) (p UserPage, err error) {
+	defer func(begin time.Time) { mw.observe("ListUsers", begin, err) }(time.Now())
+	return mw.Service.ListUsers(ctx, opts)
+}
+
+func (mw instrumentingMiddleware) Authenticate(ctx context.Context, username, password, otp string) (t Token, err error) {
+	defer func(begin time.Time) { mw.observe("Authenticate", begin, err) }(time.Now())
+	return mw.Service.Authenticate(ctx, username, password, otp)
+}
+
+func (mw instrumentingMiddleware) Refresh(ctx context.Context, refreshToken string) (t Token, err error) {
+	defer func(begin time.Time) { mw.observe("Refresh", begin, err) }(time.Now())
+	return mw.Service.Refresh(ctx, refreshToken)
+}
+
+func (mw instrumentingMiddleware) Logout(ctx context.Context, refreshToken string) (err error) {
+	defer func(begin time.Time) { mw.observe("Logout", begin, err) }(time.Now())
+	return mw.Service.Logout(ctx, refreshToken)
+}
+
+func (mw instrumentingMiddleware) RevokeSessions(ctx context.Context, username string) (err error) {
+	defer func(begin time.Time) { mw.observe("RevokeSessions", begin, err) }(time.Now())
+	return mw.Service.RevokeSessions(ctx, username)
+}
+
+func (mw instrumentingMiddleware) EnrollMFA(ctx context.Context, username string) (e MFAEnrollment, err error) {
+	defer func(begin time.Time) { mw.observe("EnrollMFA", begin, err) }(time.Now())
+	return mw.Service.EnrollMFA(ctx, username)
+}
+
+func (mw instrumentingMiddleware) ConfirmMFA(ctx context.Context, username, code string) (codes []string, err error) {
+	defer func(begin time.Time) { mw.observe("ConfirmMFA", begin, err) }(time.Now())
+	return mw.Service.ConfirmMFA(ctx, username, code)
+}
+
+func (mw instrumentingMiddleware) RegenerateRecoveryCodes(ctx context.Context, username, code string) (codes []string, err error) {
+	defer func(begin time.Time) { mw.observe("RegenerateRecoveryCodes", begin, err) }(time.Now())
+	return mw.Service.RegenerateRecoveryCodes(ctx, username, code)
+}
+
+func (mw instrumentingMiddleware) RequestPasswordReset(ctx context.Context, email string) (err error) {
+	defer func(begin time.Time) { mw.observe("RequestPasswordReset", begin, err) }(time.Now())
+	return mw.Service.RequestPasswordReset(ctx, email)
+}
+
+func (mw instrumentingMiddleware) ResetPassword(ctx context.Context, token, password string) (err error) {
+	defer func(begin time.Time) { mw.observe("ResetPassword", begin, err) }(time.Now())
+	return mw.Service.ResetPassword(ctx, token, password)
+}
+
+func (mw instrumentingMiddleware) VerifyEmail(ctx context.Context, username, token string) (err error) {
+	defer func(begin time.Time) { mw.observe("VerifyEmail", begin, err) }(time.Now())
+	return mw.Service.VerifyEmail(ctx, username, token)
+}
+
+// errorKind is the label value of err: the code of the *Error it's rendered
+// as. Codes are a fixed set, which keeps the cardinality of the label bounded.
+func errorKind(err error) string {
+	return errorFrom(err).Code
+}
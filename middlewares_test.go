@@ -0,0 +1,88 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// erringService fails GetUser with err, nil included.
+type erringService struct {
+	Service
+	err error
+}
+
+func (s erringService) GetUser(context.Context, string) (User, error) { return User{}, s.err }
+
+func TestInstrumentingMiddleware(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		err      error
+		wantKind string // empty for no error counted
+	}{
+		{"success", nil, ""},
+		{"coded", fmt.Errorf("get alice: %w", ErrNotFound), "not_found"},
+		{"validation", ValidationError{Fields: []FieldError{{Field: "email", Message: "is required"}}}, "validation_failed"},
+		{"unknown", errors.New("pq: connection refused"), "internal"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				reg      = stdprometheus.NewRegistry()
+				requests = stdprometheus.NewCounterVec(stdprometheus.CounterOpts{Name: "requests_total"}, []string{"method"})
+				failures = stdprometheus.NewCounterVec(stdprometheus.CounterOpts{Name: "errors_total"}, []string{"method", "kind"})
+				latency  = stdprometheus.NewHistogramVec(stdprometheus.HistogramOpts{Name: "request_duration_seconds"}, []string{"method"})
+			)
+			reg.MustRegister(requests, failures, latency)
+			s := InstrumentingMiddleware(
+				kitprometheus.NewCounter(requests),
+				kitprometheus.NewCounter(failures),
+				kitprometheus.NewHistogram(latency),
+			)(erringService{err: tc.err})
+
+			s.GetUser(context.Background(), "alice")
+
+			families, err := reg.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string][]*dto.Metric{}
+			for _, f := range families {
+				got[f.GetName()] = f.GetMetric()
+			}
+			if ms := got["requests_total"]; len(ms) != 1 || labels(ms[0]) != "method=GetUser" || ms[0].GetCounter().GetValue() != 1 {
+				t.Errorf("requests_total = %v, want 1 labeled method=GetUser", ms)
+			}
+			if ms := got["request_duration_seconds"]; len(ms) != 1 || labels(ms[0]) != "method=GetUser" || ms[0].GetHistogram().GetSampleCount() != 1 {
+				t.Errorf("request_duration_seconds = %v, want 1 sample labeled method=GetUser", ms)
+			}
+			ms := got["errors_total"]
+			if tc.wantKind == "" {
+				if len(ms) != 0 {
+					t.Errorf("errors_total = %v, want none", ms)
+				}
+				return
+			}
+			if want := "kind=" + tc.wantKind + ",method=GetUser"; len(ms) != 1 || labels(ms[0]) != want || ms[0].GetCounter().GetValue() != 1 {
+				t.Errorf("errors_total = %v, want 1 labeled %s", ms, want)
+			}
+		})
+	}
+}
+
+// labels renders the labels of m as name=value pairs, sorted by name as
+// gathered.
+func labels(m *dto.Metric) string {
+	var s string
+	for i, l := range m.GetLabel() {
+		if i > 0 {
+			s += ","
+		}
+		s += l.GetName() + "=" + l.GetValue()
+	}
+	return s
+}
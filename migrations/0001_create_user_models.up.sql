@@ -0,0 +1,18 @@
+-- Matches the table GORM's AutoMigrate created for UserModel, so databases
+-- set up before versioned migrations adopt this one without changes.
+CREATE TABLE IF NOT EXISTS user_models (
+    id         SERIAL PRIMARY KEY,
+    created_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ,
+    deleted_at TIMESTAMPTZ,
+    first_name TEXT,
+    last_name  TEXT,
+    username   VARCHAR(100),
+    email      VARCHAR(100),
+    password   TEXT,
+    role       VARCHAR(255)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_models_deleted_at ON user_models (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_user_models_username ON user_models (username);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_user_models_email ON user_models (email);
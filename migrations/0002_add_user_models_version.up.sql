@@ -0,0 +1,2 @@
+-- Version counts the writes to a user, for optimistic concurrency control.
+ALTER TABLE user_models ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
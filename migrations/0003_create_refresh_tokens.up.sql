@@ -0,0 +1,16 @@
+-- Refresh tokens are stored hashed; a family is a session, rotated on every
+-- refresh, see RefreshTokenModel.
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id         SERIAL PRIMARY KEY,
+    token_hash CHAR(64)     NOT NULL,
+    family     VARCHAR(32)  NOT NULL,
+    username   VARCHAR(100) NOT NULL,
+    created_at TIMESTAMPTZ  NOT NULL,
+    expires_at TIMESTAMPTZ  NOT NULL,
+    used_at    TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS uix_refresh_tokens_token_hash ON refresh_tokens (token_hash);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family ON refresh_tokens (family);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_username ON refresh_tokens (username);
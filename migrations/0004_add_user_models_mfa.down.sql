@@ -0,0 +1,6 @@
+ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS amr;
+
+ALTER TABLE user_models DROP COLUMN IF EXISTS mfa_last_step;
+ALTER TABLE user_models DROP COLUMN IF EXISTS mfa_recovery_codes;
+ALTER TABLE user_models DROP COLUMN IF EXISTS mfa_enabled;
+ALTER TABLE user_models DROP COLUMN IF EXISTS mfa_secret;
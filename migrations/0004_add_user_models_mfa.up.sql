@@ -0,0 +1,9 @@
+-- Two-factor authentication state of users, see MFAState. The TOTP secret is
+-- stored encrypted, recovery codes hashed.
+ALTER TABLE user_models ADD COLUMN IF NOT EXISTS mfa_secret TEXT;
+ALTER TABLE user_models ADD COLUMN IF NOT EXISTS mfa_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE user_models ADD COLUMN IF NOT EXISTS mfa_recovery_codes TEXT;
+ALTER TABLE user_models ADD COLUMN IF NOT EXISTS mfa_last_step BIGINT NOT NULL DEFAULT 0;
+
+-- How sessions were authenticated, carried over to refreshed access tokens.
+ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS amr VARCHAR(32);
@@ -0,0 +1,13 @@
+-- Password reset tokens are stored hashed, and single-use, see
+-- PasswordResetTokenModel.
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+    id         SERIAL PRIMARY KEY,
+    token_hash CHAR(64)     NOT NULL,
+    username   VARCHAR(100) NOT NULL,
+    created_at TIMESTAMPTZ  NOT NULL,
+    expires_at TIMESTAMPTZ  NOT NULL,
+    used_at    TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS uix_password_reset_tokens_token_hash ON password_reset_tokens (token_hash);
+CREATE INDEX IF NOT EXISTS idx_password_reset_tokens_username ON password_reset_tokens (username);
@@ -0,0 +1,2 @@
+ALTER TABLE user_models DROP COLUMN IF EXISTS pending_email;
+ALTER TABLE user_models DROP COLUMN IF EXISTS email_verified;
@@ -0,0 +1,4 @@
+-- Emails are verified by mailed links, and changes to them pending until the
+-- new address is verified.
+ALTER TABLE user_models ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE user_models ADD COLUMN IF NOT EXISTS pending_email VARCHAR(100);
@@ -0,0 +1,6 @@
+-- Failed logins by account or IP, see LockoutMiddleware.
+CREATE TABLE IF NOT EXISTS login_attempts (
+    key          VARCHAR(255) PRIMARY KEY,
+    failures     INTEGER      NOT NULL,
+    last_failure TIMESTAMPTZ  NOT NULL
+);
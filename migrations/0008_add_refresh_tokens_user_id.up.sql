@@ -0,0 +1,12 @@
+-- Refresh tokens are bound to the user they were issued to, not only its
+-- username, which a new user can take once the old one is purged.
+ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS user_id INTEGER NOT NULL DEFAULT 0;
+
+-- Existing tokens belong to the user of their username only if it predates
+-- them; the others can't be trusted, and are revoked.
+UPDATE refresh_tokens SET user_id = u.id
+    FROM user_models u
+    WHERE u.username = refresh_tokens.username AND u.created_at <= refresh_tokens.created_at;
+UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = 0 AND revoked_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens (user_id);
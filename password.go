@@ -0,0 +1,144 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher hashes passwords for storage and verifies candidates against
+// stored hashes. Hashes are self-describing strings carrying the algorithm and
+// its parameters, so they can be verified after the parameters change.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of password using the current parameters.
+	Hash(password string) (string, error)
+
+	// Verify reports whether password matches the encoded hash, and whether
+	// the hash should be replaced because it was produced by another
+	// algorithm or with outdated parameters.
+	Verify(password, encoded string) (match, rehash bool, err error)
+}
+
+// Argon2Params are the tunables of argon2id. See RFC 9106 for guidance.
+type Argon2Params struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params follow the second recommended option of RFC 9106.
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 4,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// Bounds of the argon2id parameters Verify accepts. Stored hashes are only
+// as trusted as the database, so a tampered one must not make a login burn
+// the memory or time of the server, nor match with a short key.
+const (
+	maxArgon2Memory     = 1024 * 1024 // KiB
+	maxArgon2Iterations = 16
+	minArgon2Length     = 16 // bytes, of the salt and the key
+)
+
+// password hash errors
+var (
+	ErrInvalidHash         = errors.New("invalid password hash")
+	ErrIncompatibleVersion = errors.New("incompatible argon2 version")
+)
+
+type passwordHasher struct {
+	params Argon2Params
+}
+
+// NewPasswordHasher returns a PasswordHasher producing argon2id hashes with the
+// given parameters. It also verifies bcrypt hashes, e.g. imported from another
+// system, and flags them for rehashing.
+func NewPasswordHasher(params Argon2Params) PasswordHasher {
+	return passwordHasher{params}
+}
+
+// Hash encodes as $argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<key>,
+// the format used by the reference implementation.
+func (h passwordHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.params.Iterations, h.params.Memory, h.params.Parallelism, h.params.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.params.Memory, h.params.Iterations, h.params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h passwordHasher) Verify(password, encoded string) (match, rehash bool, err error) {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return h.verifyArgon2id(password, encoded)
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, false, nil
+		}
+		if err != nil {
+			return false, false, ErrInvalidHash
+		}
+		return true, true, nil // bcrypt is only supported for imported hashes
+	default:
+		return false, false, ErrInvalidHash
+	}
+}
+
+func (h passwordHasher) verifyArgon2id(password, encoded string) (match, rehash bool, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return false, false, ErrInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, false, ErrInvalidHash
+	}
+	if version != argon2.Version {
+		return false, false, ErrIncompatibleVersion
+	}
+
+	var p Argon2Params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return false, false, ErrInvalidHash
+	}
+	if p.Memory == 0 || p.Memory > maxArgon2Memory || p.Iterations == 0 || p.Iterations > maxArgon2Iterations || p.Parallelism == 0 {
+		return false, false, ErrInvalidHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false, ErrInvalidHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, false, ErrInvalidHash
+	}
+	if len(salt) < minArgon2Length || len(key) < minArgon2Length {
+		return false, false, ErrInvalidHash
+	}
+	p.SaltLength, p.KeyLength = uint32(len(salt)), uint32(len(key))
+
+	candidate := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	if subtle.ConstantTimeCompare(key, candidate) != 1 {
+		return false, false, nil
+	}
+	return true, p != h.params, nil
+}
@@ -0,0 +1,130 @@
+package users
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordHasher(t *testing.T) {
+	h := NewPasswordHasher(testArgon2Params)
+	hash, err := h.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("hash = %q, want an encoded argon2id hash", hash)
+	}
+	if other, _ := h.Hash("secret"); other == hash {
+		t.Error("hashes of the same password are equal, want them salted")
+	}
+
+	stronger := testArgon2Params
+	stronger.Iterations++
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		hasher     PasswordHasher
+		password   string
+		encoded    string
+		wantMatch  bool
+		wantRehash bool
+		wantErr    error
+	}{
+		{"match", h, "secret", hash, true, false, nil},
+		{"mismatch", h, "Secret", hash, false, false, nil},
+		{"outdated params", NewPasswordHasher(stronger), "secret", hash, true, true, nil},
+		{"outdated params mismatch", NewPasswordHasher(stronger), "Secret", hash, false, false, nil},
+		{"bcrypt", h, "secret", string(bcryptHash), true, true, nil},
+		{"bcrypt mismatch", h, "Secret", string(bcryptHash), false, false, nil},
+		{"unknown algorithm", h, "secret", "$md5$abc", false, false, ErrInvalidHash},
+		{"truncated", h, "secret", hash[:20], false, false, ErrInvalidHash},
+		{"other version", h, "secret", strings.Replace(hash, "v=19", "v=16", 1), false, false, ErrIncompatibleVersion},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			match, rehash, err := tc.hasher.Verify(tc.password, tc.encoded)
+			if match != tc.wantMatch || rehash != tc.wantRehash || err != tc.wantErr {
+				t.Errorf("Verify = %v, %v, %v; want %v, %v, %v", match, rehash, err, tc.wantMatch, tc.wantRehash, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestPasswordHasherMalformedHashes(t *testing.T) {
+	var (
+		h     = NewPasswordHasher(testArgon2Params)
+		salt  = base64.RawStdEncoding.EncodeToString(make([]byte, 16))
+		key   = base64.RawStdEncoding.EncodeToString(make([]byte, 32))
+		short = base64.RawStdEncoding.EncodeToString(make([]byte, 8))
+	)
+	encode := func(params, salt, key string) string {
+		return "$argon2id$v=19$" + params + "$" + salt + "$" + key
+	}
+
+	for _, tc := range []struct {
+		name    string
+		encoded string
+	}{
+		{"no memory", encode("m=0,t=1,p=1", salt, key)},
+		{"no iterations", encode("m=64,t=0,p=1", salt, key)},
+		{"no parallelism", encode("m=64,t=1,p=0", salt, key)},
+		{"too much memory", encode("m=4194304,t=1,p=1", salt, key)},
+		{"too many iterations", encode("m=64,t=1000000,p=1", salt, key)},
+		{"parallelism overflow", encode("m=64,t=1,p=256", salt, key)},
+		{"negative memory", encode("m=-64,t=1,p=1", salt, key)},
+		{"malformed params", encode("m=64;t=1;p=1", salt, key)},
+		{"short salt", encode("m=64,t=1,p=1", short, key)},
+		{"short key", encode("m=64,t=1,p=1", salt, short)},
+		{"empty key", encode("m=64,t=1,p=1", salt, "")},
+		{"malformed salt", encode("m=64,t=1,p=1", "not base64!", key)},
+		{"malformed key", encode("m=64,t=1,p=1", salt, "not base64!")},
+		{"malformed version", "$argon2id$v=x$m=64,t=1,p=1$" + salt + "$" + key},
+		{"extra field", encode("m=64,t=1,p=1", salt, key) + "$"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			match, rehash, err := h.Verify("secret", tc.encoded)
+			if match || rehash || err != ErrInvalidHash {
+				t.Errorf("Verify = %v, %v, %v; want false, false, %v", match, rehash, err, ErrInvalidHash)
+			}
+		})
+	}
+}
+
+func TestLoginRehashesPassword(t *testing.T) {
+	ts := newTestServer(t)
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := ts.seed(User{Username: "alice", Email: "alice@example.com", Role: "user"})
+	m.Password = string(bcryptHash)
+	if err := ts.repo.Update(context.Background(), &m); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, body := ts.do("POST", "/auth/login", "", loginRequest{Username: "alice", Password: testPassword})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("login status = %d: %s", resp.StatusCode, body)
+	}
+	m, err = ts.repo.GetByUsername(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(m.Password, "$argon2id$") {
+		t.Errorf("stored hash = %q, want it rehashed with argon2id", m.Password)
+	}
+
+	// The new hash verifies too.
+	resp, body = ts.do("POST", "/auth/login", "", loginRequest{Username: "alice", Password: testPassword})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("second login status = %d: %s", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,478 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Media types of the patches accepted by PATCH /users/:id. Plain
+// application/json is taken as a merge patch.
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+var (
+	// ErrPatchConflict is returned when a patch doesn't apply to the current
+	// state of the user, e.g. a failed test operation.
+	ErrPatchConflict = newError("patch_conflict", http.StatusConflict, "patch doesn't apply")
+
+	// ErrUnsupportedMediaType is returned for patches of unknown types.
+	ErrUnsupportedMediaType = newError("unsupported_media_type", http.StatusUnsupportedMediaType, "unsupported media type")
+)
+
+// Patch is a partial update of a user. Service.PatchUser applies it to the
+// current state of the user, and stores the result only if the whole patch
+// applies.
+//
+// Patches work on the JSON document of a user, see userFields. The password is
+// write-only: it isn't part of the document, but can be added to it.
+type Patch interface {
+	Apply(u User) (User, error)
+}
+
+// fieldKind tells what patches may do to a field of users.
+type fieldKind int
+
+const (
+	immutableField fieldKind = iota // can't change, e.g. for test operations
+	mutableField                    // can change, but not be removed
+	clearableField                  // can also be removed or set to null
+)
+
+// userFields lists the fields of the JSON document of users, and what patches
+// may do to them.
+var userFields = []struct {
+	name string
+	kind fieldKind
+}{
+	{"username", immutableField},
+	{"first_name", clearableField},
+	{"last_name", clearableField},
+	{"email", mutableField},
+	{"role", mutableField},
+	{"password", mutableField},
+}
+
+// MergePatch is an RFC 7396 JSON merge patch: an object whose members replace
+// those of the user, null removing them. For example:
+//
+//	{"first_name": "Jane", "last_name": null}
+type MergePatch json.RawMessage
+
+// Apply implements Patch.
+func (p MergePatch) Apply(u User) (User, error) {
+	if err := p.check(); err != nil {
+		return User{}, err
+	}
+	var patch map[string]interface{}
+	json.Unmarshal(p, &patch)
+	return applyToUser(u, func(doc interface{}) (interface{}, error) {
+		return mergePatch(doc, patch), nil
+	})
+}
+
+// MarshalJSON returns p itself.
+func (p MergePatch) MarshalJSON() ([]byte, error) {
+	if p == nil {
+		return []byte("null"), nil
+	}
+	return p, nil
+}
+
+// UnmarshalJSON sets *p to a copy of data.
+func (p *MergePatch) UnmarshalJSON(data []byte) error {
+	*p = append((*p)[0:0], data...)
+	return nil
+}
+
+// check reports whether p is a JSON object. Other merge patches would replace
+// the whole user.
+func (p MergePatch) check() error {
+	var patch map[string]interface{}
+	if err := json.Unmarshal(p, &patch); err != nil || patch == nil {
+		return ErrBadRequest.WithDetail("merge patch must be a JSON object")
+	}
+	return nil
+}
+
+// mergePatch implements the MergePatch algorithm of RFC 7396.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// JSONPatch is an RFC 6902 JSON patch: operations applied in order. For
+// example:
+//
+//	[
+//	  {"op": "test", "path": "/email", "value": "jane@example.com"},
+//	  {"op": "remove", "path": "/last_name"}
+//	]
+type JSONPatch []PatchOperation
+
+// PatchOperation is an operation of a JSONPatch: add, remove, replace, move,
+// copy or test. Paths are JSON pointers, such as /first_name.
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Apply implements Patch.
+func (p JSONPatch) Apply(u User) (User, error) {
+	if err := p.check(); err != nil {
+		return User{}, err
+	}
+	return applyToUser(u, func(doc interface{}) (interface{}, error) {
+		for i, op := range p {
+			var err error
+			if doc, err = op.apply(doc); err != nil {
+				return nil, ErrPatchConflict.WithDetail(fmt.Sprintf("operation %d (%s %s): %v", i, op.Op, op.Path, err))
+			}
+		}
+		return doc, nil
+	})
+}
+
+// check reports whether the operations of p are well-formed.
+func (p JSONPatch) check() error {
+	for i, op := range p {
+		if err := op.check(); err != nil {
+			return ErrBadRequest.WithDetail(fmt.Sprintf("operation %d: %v", i, err))
+		}
+	}
+	return nil
+}
+
+func (op PatchOperation) check() error {
+	switch op.Op {
+	case "add", "replace", "test":
+		var v interface{}
+		if op.Value == nil || json.Unmarshal(op.Value, &v) != nil {
+			return fmt.Errorf("%s needs a value", op.Op)
+		}
+	case "move", "copy":
+		if _, err := parsePointer(op.From); err != nil {
+			return fmt.Errorf("from: %v", err)
+		}
+	case "remove":
+	default:
+		return fmt.Errorf("unknown op %q", op.Op)
+	}
+	if _, err := parsePointer(op.Path); err != nil {
+		return fmt.Errorf("path: %v", err)
+	}
+	return nil
+}
+
+func (op PatchOperation) apply(doc interface{}) (interface{}, error) {
+	path, _ := parsePointer(op.Path)
+	var value interface{}
+	json.Unmarshal(op.Value, &value)
+
+	switch op.Op {
+	case "add":
+		return addValue(doc, path, value)
+	case "remove":
+		doc, _, err := removeValue(doc, path)
+		return doc, err
+	case "replace":
+		doc, _, err := removeValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "move":
+		from, _ := parsePointer(op.From)
+		if len(path) > len(from) && reflect.DeepEqual(path[:len(from)], from) {
+			return nil, fmt.Errorf("can't move %s into itself", op.From)
+		}
+		doc, v, err := removeValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, v)
+	case "copy":
+		from, _ := parsePointer(op.From)
+		v, err := getValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, deepCopy(v))
+	case "test":
+		v, err := getValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(v, value) {
+			return nil, fmt.Errorf("test failed")
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown op %q", op.Op)
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into its reference tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("%q must start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(t)
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses token as an index into an array of n elements. With end,
+// the index may be n, or "-".
+func arrayIndex(token string, n int, end bool) (int, error) {
+	if end && token == "-" {
+		return n, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if i > n || (i == n && !end) {
+		return 0, fmt.Errorf("array index %d out of range", i)
+	}
+	return i, nil
+}
+
+func getValue(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			v, ok := d[token]
+			if !ok {
+				return nil, fmt.Errorf("%q doesn't exist", token)
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(token, len(d), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = d[i]
+		default:
+			return nil, fmt.Errorf("%q doesn't exist", token)
+		}
+	}
+	return doc, nil
+}
+
+// addValue adds value at path in doc, returning the new document.
+func addValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	token := path[0]
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			d[token] = value
+			return d, nil
+		}
+		child, ok := d[token]
+		if !ok {
+			return nil, fmt.Errorf("%q doesn't exist", token)
+		}
+		v, err := addValue(child, path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		d[token] = v
+		return d, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(d), len(path) == 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(path) == 1 {
+			d = append(d, nil)
+			copy(d[i+1:], d[i:])
+			d[i] = value
+			return d, nil
+		}
+		v, err := addValue(d[i], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		d[i] = v
+		return d, nil
+	}
+	return nil, fmt.Errorf("%q doesn't exist", token)
+}
+
+// removeValue removes the value at path in doc, returning the new document
+// and the value removed.
+func removeValue(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+	token := path[0]
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		child, ok := d[token]
+		if !ok {
+			return nil, nil, fmt.Errorf("%q doesn't exist", token)
+		}
+		if len(path) == 1 {
+			delete(d, token)
+			return d, child, nil
+		}
+		v, removed, err := removeValue(child, path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		d[token] = v
+		return d, removed, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(d), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(path) == 1 {
+			removed := d[i]
+			return append(d[:i:i], d[i+1:]...), removed, nil
+		}
+		v, removed, err := removeValue(d[i], path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		d[i] = v
+		return d, removed, nil
+	}
+	return nil, nil, fmt.Errorf("%q doesn't exist", token)
+}
+
+func deepCopy(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			c[k] = deepCopy(e)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, e := range v {
+			c[i] = deepCopy(e)
+		}
+		return c
+	}
+	return v
+}
+
+// applyToUser applies a patch of the JSON document of u, and reads the user
+// back from the result, enforcing userFields.
+func applyToUser(u User, apply func(doc interface{}) (interface{}, error)) (User, error) {
+	doc, err := apply(map[string]interface{}{
+		"username":   u.Username,
+		"first_name": u.FirstName,
+		"last_name":  u.LastName,
+		"email":      u.Email,
+		"role":       u.Role,
+	})
+	if err != nil {
+		return User{}, err
+	}
+	obj, ok := doc.(map[string]interface{})
+	if !ok {
+		return User{}, ErrPatchConflict.WithDetail("a user must be a JSON object")
+	}
+
+	var (
+		fe      fieldErrors
+		patched = User{Version: u.Version}
+		fields  = map[string]*string{
+			"username":   &patched.Username,
+			"first_name": &patched.FirstName,
+			"last_name":  &patched.LastName,
+			"email":      &patched.Email,
+			"role":       &patched.Role,
+			"password":   &patched.Password,
+		}
+	)
+	for _, f := range userFields {
+		v, ok := obj[f.name]
+		switch {
+		case (!ok || v == nil) && f.name == "password":
+			if ok {
+				fe.add(f.name, "can't be cleared")
+			}
+		case !ok || v == nil:
+			if f.kind != clearableField {
+				fe.add(f.name, "can't be removed")
+			}
+		default:
+			s, ok := v.(string)
+			if !ok {
+				fe.add(f.name, "must be a string")
+			}
+			*fields[f.name] = s
+		}
+	}
+	if username, ok := obj["username"].(string); ok && username != u.Username {
+		fe.add("username", "can't be changed")
+	}
+
+	var unknown []string
+	for name := range obj {
+		if _, ok := fields[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		fe.add(name, "is not a field of users")
+	}
+
+	if err := fe.err(); err != nil {
+		return User{}, err
+	}
+	return patched, nil
+}
+
+// checkedPatch is a Patch whose result must pass check, which lets middlewares
+// inspect what a patch does to a user.
+type checkedPatch struct {
+	Patch
+	check func(before, after User) error
+}
+
+func (p checkedPatch) Apply(u User) (User, error) {
+	after, err := p.Patch.Apply(u)
+	if err != nil {
+		return User{}, err
+	}
+	if err := p.check(u, after); err != nil {
+		return User{}, err
+	}
+	return after, nil
+}
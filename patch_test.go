@@ -0,0 +1,112 @@
+package users
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestPatchApply(t *testing.T) {
+	jane := User{Username: "jane", FirstName: "Jane", LastName: "Doe", Email: "jane@example.com", Role: "user", Version: 3}
+	ops := func(s string) Patch {
+		var p JSONPatch
+		if err := json.Unmarshal([]byte(s), &p); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	for _, tc := range []struct {
+		name    string
+		patch   Patch
+		want    User
+		wantErr error
+	}{
+		{"merge", MergePatch(`{"first_name": "Janet", "last_name": null}`),
+			User{Username: "jane", FirstName: "Janet", Email: "jane@example.com", Role: "user", Version: 3}, nil},
+		{"merge password", MergePatch(`{"password": "s3cret-pass"}`),
+			User{Username: "jane", FirstName: "Jane", LastName: "Doe", Email: "jane@example.com", Role: "user", Password: "s3cret-pass", Version: 3}, nil},
+		{"merge empty", MergePatch(`{}`), jane, nil},
+		{"merge array", MergePatch(`["first_name"]`), User{}, ErrBadRequest},
+		{"merge remove email", MergePatch(`{"email": null}`), User{}, ErrValidation},
+		{"merge username", MergePatch(`{"username": "janet"}`), User{}, ErrValidation},
+		{"merge unknown field", MergePatch(`{"admin": "true"}`), User{}, ErrValidation},
+		{"merge number", MergePatch(`{"first_name": 1}`), User{}, ErrValidation},
+
+		{"json patch", ops(`[
+			{"op": "test", "path": "/email", "value": "jane@example.com"},
+			{"op": "replace", "path": "/email", "value": "jane@example.org"},
+			{"op": "remove", "path": "/last_name"}
+		]`), User{Username: "jane", FirstName: "Jane", Email: "jane@example.org", Role: "user", Version: 3}, nil},
+		{"json patch move", ops(`[{"op": "move", "from": "/first_name", "path": "/last_name"}]`),
+			User{Username: "jane", LastName: "Jane", Email: "jane@example.com", Role: "user", Version: 3}, nil},
+		{"json patch copy", ops(`[{"op": "copy", "from": "/first_name", "path": "/last_name"}]`),
+			User{Username: "jane", FirstName: "Jane", LastName: "Jane", Email: "jane@example.com", Role: "user", Version: 3}, nil},
+		{"json patch add password", ops(`[{"op": "add", "path": "/password", "value": "s3cret-pass"}]`),
+			User{Username: "jane", FirstName: "Jane", LastName: "Doe", Email: "jane@example.com", Role: "user", Password: "s3cret-pass", Version: 3}, nil},
+		{"json patch failed test", ops(`[
+			{"op": "test", "path": "/email", "value": "john@example.com"},
+			{"op": "remove", "path": "/last_name"}
+		]`), User{}, ErrPatchConflict},
+		{"json patch missing path", ops(`[{"op": "remove", "path": "/middle_name"}]`), User{}, ErrPatchConflict},
+		{"json patch replace document", ops(`[{"op": "replace", "path": "", "value": 1}]`), User{}, ErrPatchConflict},
+		{"json patch unknown op", ops(`[{"op": "append", "path": "/first_name", "value": "x"}]`), User{}, ErrBadRequest},
+		{"json patch no value", ops(`[{"op": "add", "path": "/first_name"}]`), User{}, ErrBadRequest},
+		{"json patch relative path", ops(`[{"op": "remove", "path": "first_name"}]`), User{}, ErrBadRequest},
+		{"json patch remove role", ops(`[{"op": "remove", "path": "/role"}]`), User{}, ErrValidation},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.patch.Apply(jane)
+			if !errors.Is(err, tc.wantErr) || (err != nil && tc.wantErr == nil) {
+				t.Fatalf("err = %v, want %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("user = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHTTPPatchUser(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		body        interface{}
+		wantCode    int
+		wantErr     string
+		wantLast    string
+	}{
+		{"json", "application/json", map[string]interface{}{"last_name": nil}, http.StatusOK, "", ""},
+		{"merge patch", MergePatchType, map[string]interface{}{"last_name": "Doe"}, http.StatusOK, "", "Doe"},
+		{"json patch", JSONPatchType, JSONPatch{{Op: "replace", Path: "/last_name", Value: json.RawMessage(`"Doe"`)}}, http.StatusOK, "", "Doe"},
+		{"json patch conflict", JSONPatchType, JSONPatch{{Op: "test", Path: "/last_name", Value: json.RawMessage(`"Doe"`)}}, http.StatusConflict, "patch_conflict", "Liddell"},
+		{"json patch as merge patch", MergePatchType, JSONPatch{{Op: "remove", Path: "/last_name"}}, http.StatusBadRequest, "bad_request", "Liddell"},
+		{"unsupported", "text/plain", "last_name=Doe", http.StatusUnsupportedMediaType, "unsupported_media_type", "Liddell"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.seed(User{Username: "alice", Email: "alice@example.com", LastName: "Liddell"})
+			admin := ts.token("admin", "admin")
+			resp, body := ts.do("PATCH", "/users/alice", admin, tc.body, "Content-Type", tc.contentType)
+			if resp.StatusCode != tc.wantCode {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tc.wantCode, body)
+			}
+			if got := problemCode(body); got != tc.wantErr {
+				t.Errorf("problem = %q, want %q", got, tc.wantErr)
+			}
+			if tc.wantCode == http.StatusUnsupportedMediaType && resp.Header.Get("Accept-Patch") == "" {
+				t.Error("no Accept-Patch header")
+			}
+
+			_, body = ts.do("GET", "/users/alice", admin, nil)
+			var got getUserResponse
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.User.LastName != tc.wantLast {
+				t.Errorf("last name = %q, want %q", got.User.LastName, tc.wantLast)
+			}
+		})
+	}
+}
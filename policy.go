@@ -0,0 +1,307 @@
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+)
+
+// ErrForbidden is returned when the caller isn't allowed to do what it asked.
+var ErrForbidden = newError("forbidden", http.StatusForbidden, "forbidden")
+
+// Permission is something a role may be allowed to do.
+type Permission string
+
+// permissions
+const (
+	PermCreateUsers Permission = "users:create"     // create users other than by signup
+	PermReadSelf    Permission = "users:read:self"  // get own user
+	PermReadAny     Permission = "users:read:any"   // get any user
+	PermWriteSelf   Permission = "users:write:self" // put or patch own user
+	PermWriteAny    Permission = "users:write:any"  // put or patch any user
+	PermDeleteSelf  Permission = "users:delete:self"
+	PermDeleteAny   Permission = "users:delete:any"
+	PermRestore     Permission = "users:restore"  // undo the deletion of any user
+	PermPurge       Permission = "users:purge"    // permanently remove any user
+	PermUnlock      Permission = "users:unlock"   // end the lockout of any user
+	PermSetRole     Permission = "users:role:set" // change the role of a user
+)
+
+// Policy declares the roles known to the service and what they may do.
+type Policy struct {
+	// DefaultRole is given to users created without a role, and assumed for
+	// tokens without one.
+	DefaultRole string `json:"default_role"`
+
+	// AllowSignup lets anonymous callers create users with DefaultRole.
+	AllowSignup bool `json:"allow_signup"`
+
+	Roles map[string][]Permission `json:"roles"`
+
+	// MFARoles must authenticate with a second factor to use their
+	// permissions. Until they do, they only have those of DefaultRole,
+	// enough to enroll.
+	MFARoles []string `json:"mfa_roles"`
+}
+
+// DefaultPolicy lets users read and update themselves, and admins do anything.
+var DefaultPolicy = Policy{
+	DefaultRole: "user",
+	AllowSignup: true,
+	Roles: map[string][]Permission{
+		"admin": {PermCreateUsers, PermReadAny, PermWriteAny, PermDeleteAny, PermRestore, PermPurge, PermUnlock, PermSetRole},
+		"user":  {PermReadSelf, PermWriteSelf},
+	},
+	MFARoles: []string{"admin"},
+}
+
+// LoadPolicy reads a JSON encoded Policy from the file at path.
+func LoadPolicy(path string) (Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Policy{}, err
+	}
+	defer f.Close()
+
+	var p Policy
+	if err := json.NewDecoder(f).Decode(&p); err != nil {
+		return Policy{}, err
+	}
+	if _, ok := p.Roles[p.DefaultRole]; !ok {
+		return Policy{}, errors.New("policy: default role " + p.DefaultRole + " is not declared")
+	}
+	return p, nil
+}
+
+// Allows reports whether role has the permission.
+func (p Policy) Allows(role string, perm Permission) bool {
+	for _, granted := range p.Roles[role] {
+		if granted == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// RequiresMFA reports whether role must authenticate with a second factor.
+func (p Policy) RequiresMFA(role string) bool {
+	for _, r := range p.MFARoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthorizationMiddleware enforces the policy on the principal found in the
+// context, see PrincipalFromContext.
+func AuthorizationMiddleware(p Policy) Middleware {
+	return func(next Service) Service {
+		return authorizationMiddleware{next, p}
+	}
+}
+
+type authorizationMiddleware struct {
+	Service
+	policy Policy
+}
+
+func (mw authorizationMiddleware) PostUser(ctx context.Context, u User) error {
+	if u.Role == "" {
+		u.Role = mw.policy.DefaultRole
+	}
+	if _, ok := mw.policy.Roles[u.Role]; !ok {
+		return ErrForbidden
+	}
+
+	principal, ok := PrincipalFromContext(ctx)
+	switch {
+	case ok && mw.allows(principal, PermCreateUsers):
+		if u.Role != mw.policy.DefaultRole && !mw.allows(principal, PermSetRole) {
+			return ErrForbidden
+		}
+	case mw.policy.AllowSignup:
+		if u.Role != mw.policy.DefaultRole {
+			return ErrForbidden
+		}
+	default:
+		return ErrForbidden
+	}
+	return mw.Service.PostUser(ctx, u)
+}
+
+func (mw authorizationMiddleware) GetUser(ctx context.Context, username string) (User, error) {
+	if !mw.allowsOn(ctx, username, PermReadSelf, PermReadAny) {
+		return User{}, ErrForbidden
+	}
+	return mw.Service.GetUser(ctx, username)
+}
+
+func (mw authorizationMiddleware) PutUser(ctx context.Context, username string, u User, onCreate func(User) error) error {
+	if !mw.allowsOn(ctx, username, PermWriteSelf, PermWriteAny) {
+		return ErrForbidden
+	}
+	current, err := mw.currentRole(ctx, username)
+	if err != nil {
+		return err
+	}
+	if u.Role == "" {
+		// Leaving the role out keeps it, rather than demoting the user.
+		u.Role = current
+	}
+	if err := mw.checkRoleChange(ctx, u.Role, current); err != nil {
+		return err
+	}
+	return mw.Service.PutUser(ctx, username, u, onCreate)
+}
+
+func (mw authorizationMiddleware) PatchUser(ctx context.Context, username string, patch Patch) error {
+	if !mw.allowsOn(ctx, username, PermWriteSelf, PermWriteAny) {
+		return ErrForbidden
+	}
+	// Whether a patch changes the role is only known once applied.
+	patch = checkedPatch{patch, func(before, after User) error {
+		if after.Role == before.Role {
+			return nil
+		}
+		if _, ok := mw.policy.Roles[after.Role]; !ok {
+			return ErrForbidden
+		}
+		if principal, ok := PrincipalFromContext(ctx); ok && mw.allows(principal, PermSetRole) {
+			return nil
+		}
+		return ErrForbidden
+	}}
+	return mw.Service.PatchUser(ctx, username, patch)
+}
+
+func (mw authorizationMiddleware) DeleteUser(ctx context.Context, username string) error {
+	if !mw.allowsOn(ctx, username, PermDeleteSelf, PermDeleteAny) {
+		return ErrForbidden
+	}
+	return mw.Service.DeleteUser(ctx, username)
+}
+
+func (mw authorizationMiddleware) RestoreUser(ctx context.Context, username string) error {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok || !mw.allows(principal, PermRestore) {
+		return ErrForbidden
+	}
+	return mw.Service.RestoreUser(ctx, username)
+}
+
+func (mw authorizationMiddleware) PurgeUser(ctx context.Context, username string) error {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok || !mw.allows(principal, PermPurge) {
+		return ErrForbidden
+	}
+	return mw.Service.PurgeUser(ctx, username)
+}
+
+func (mw authorizationMiddleware) UnlockUser(ctx context.Context, username string) error {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok || !mw.allows(principal, PermUnlock) {
+		return ErrForbidden
+	}
+	return mw.Service.UnlockUser(ctx, username)
+}
+
+// RevokeSessions logs users out everywhere, which is a write to the user.
+func (mw authorizationMiddleware) RevokeSessions(ctx context.Context, username string) error {
+	if !mw.allowsOn(ctx, username, PermWriteSelf, PermWriteAny) {
+		return ErrForbidden
+	}
+	return mw.Service.RevokeSessions(ctx, username)
+}
+
+func (mw authorizationMiddleware) EnrollMFA(ctx context.Context, username string) (MFAEnrollment, error) {
+	if !mw.allowsOnSelf(ctx, username) {
+		return MFAEnrollment{}, ErrForbidden
+	}
+	return mw.Service.EnrollMFA(ctx, username)
+}
+
+func (mw authorizationMiddleware) ConfirmMFA(ctx context.Context, username, code string) ([]string, error) {
+	if !mw.allowsOnSelf(ctx, username) {
+		return nil, ErrForbidden
+	}
+	return mw.Service.ConfirmMFA(ctx, username, code)
+}
+
+func (mw authorizationMiddleware) RegenerateRecoveryCodes(ctx context.Context, username, code string) ([]string, error) {
+	if !mw.allowsOnSelf(ctx, username) {
+		return nil, ErrForbidden
+	}
+	return mw.Service.RegenerateRecoveryCodes(ctx, username, code)
+}
+
+func (mw authorizationMiddleware) ListUsers(ctx context.Context, opts ListOptions) (UserPage, error) {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok || !mw.allows(principal, PermReadAny) {
+		return UserPage{}, ErrForbidden
+	}
+	return mw.Service.ListUsers(ctx, opts)
+}
+
+// currentRole returns the role of username, or DefaultRole for users not
+// created yet, or created without one.
+func (mw authorizationMiddleware) currentRole(ctx context.Context, username string) (string, error) {
+	existing, err := mw.Service.GetUser(ctx, username)
+	switch {
+	case err == nil && existing.Role != "":
+		return existing.Role, nil
+	case err == nil, errors.Is(err, ErrNotFound):
+		return mw.policy.DefaultRole, nil
+	default:
+		return "", err
+	}
+}
+
+// checkRoleChange allows giving a user the role only to principals with
+// PermSetRole, unless it's the current role of the user.
+func (mw authorizationMiddleware) checkRoleChange(ctx context.Context, role, current string) error {
+	if _, ok := mw.policy.Roles[role]; !ok {
+		return ErrForbidden
+	}
+	if principal, ok := PrincipalFromContext(ctx); ok && mw.allows(principal, PermSetRole) {
+		return nil
+	}
+	if role != current {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// allowsOn reports whether the principal may act on username, either with
+// self because it's its own user, or with others.
+func (mw authorizationMiddleware) allowsOn(ctx context.Context, username string, self, others Permission) bool {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok {
+		return false
+	}
+	if mw.allows(principal, others) {
+		return true
+	}
+	return principal.Username == username && mw.allows(principal, self)
+}
+
+// allowsOnSelf reports whether the principal is username, and may write to
+// its user. Second factors only make sense for oneself: nobody else should
+// hold the secret.
+func (mw authorizationMiddleware) allowsOnSelf(ctx context.Context, username string) bool {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok || principal.Username != username {
+		return false
+	}
+	return mw.allows(principal, PermWriteSelf) || mw.allows(principal, PermWriteAny)
+}
+
+func (mw authorizationMiddleware) allows(principal Claims, perm Permission) bool {
+	role := principal.Role
+	if role == "" || (mw.policy.RequiresMFA(role) && !principal.MultiFactor()) {
+		role = mw.policy.DefaultRole
+	}
+	return mw.policy.Allows(role, perm)
+}
@@ -0,0 +1,139 @@
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestHTTPPolicy(t *testing.T) {
+	const (
+		admin      = "admin"
+		adminNoMFA = "admin without mfa"
+		alice      = "alice"
+		anonymous  = "anonymous"
+	)
+	for _, tc := range []struct {
+		caller   string
+		method   string
+		path     string
+		body     interface{}
+		wantCode int
+	}{
+		{anonymous, "POST", "/users", User{Username: "carol", Email: "carol@example.com", Password: testPassword}, http.StatusOK},
+		{anonymous, "POST", "/users", User{Username: "carol", Email: "carol@example.com", Password: testPassword, Role: "admin"}, http.StatusForbidden},
+		{anonymous, "GET", "/users/alice", nil, http.StatusUnauthorized},
+		{alice, "POST", "/users", User{Username: "carol", Email: "carol@example.com", Password: testPassword, Role: "admin"}, http.StatusForbidden},
+		{alice, "POST", "/users", User{Username: "carol", Email: "carol@example.com", Password: testPassword, Role: "root"}, http.StatusUnprocessableEntity},
+		{alice, "GET", "/users/alice", nil, http.StatusOK},
+		{alice, "GET", "/users/bob", nil, http.StatusForbidden},
+		{alice, "GET", "/users", nil, http.StatusForbidden},
+		{alice, "PUT", "/users/alice", User{Username: "alice", Email: "alice@example.com"}, http.StatusOK},
+		{alice, "PUT", "/users/alice", User{Username: "alice", Email: "alice@example.com", Role: "admin"}, http.StatusForbidden},
+		{alice, "PUT", "/users/bob", User{Username: "bob", Email: "bob@example.com"}, http.StatusForbidden},
+		{alice, "PATCH", "/users/alice", map[string]string{"first_name": "Alice"}, http.StatusOK},
+		{alice, "PATCH", "/users/alice", map[string]string{"role": "admin"}, http.StatusForbidden},
+		{alice, "PATCH", "/users/bob", map[string]string{"first_name": "Bob"}, http.StatusForbidden},
+		{alice, "DELETE", "/users/alice", nil, http.StatusForbidden},
+		{alice, "DELETE", "/users/bob", nil, http.StatusForbidden},
+		{alice, "POST", "/users/bob:restore", nil, http.StatusForbidden},
+		{alice, "POST", "/users/bob:purge", nil, http.StatusForbidden},
+		{alice, "POST", "/users/bob:unlock", nil, http.StatusForbidden},
+		{alice, "DELETE", "/users/alice/sessions", nil, http.StatusOK},
+		{alice, "DELETE", "/users/bob/sessions", nil, http.StatusForbidden},
+		{admin, "POST", "/users", User{Username: "carol", Email: "carol@example.com", Password: testPassword, Role: "admin"}, http.StatusOK},
+		{admin, "GET", "/users/bob", nil, http.StatusOK},
+		{admin, "GET", "/users", nil, http.StatusOK},
+		{admin, "PATCH", "/users/bob", map[string]string{"role": "admin"}, http.StatusOK},
+		{admin, "PATCH", "/users/bob", map[string]string{"role": "root"}, http.StatusUnprocessableEntity},
+		{admin, "DELETE", "/users/bob", nil, http.StatusOK},
+		{adminNoMFA, "GET", "/users/bob", nil, http.StatusForbidden},
+		{adminNoMFA, "GET", "/users/admin", nil, http.StatusOK},
+		{adminNoMFA, "DELETE", "/users/bob", nil, http.StatusForbidden},
+	} {
+		t.Run(tc.caller+" "+tc.method+" "+tc.path, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.seed(User{Username: "alice", Email: "alice@example.com", Password: testPassword, Role: "user"})
+			ts.seed(User{Username: "bob", Email: "bob@example.com", Password: testPassword, Role: "user"})
+			ts.seed(User{Username: "admin", Email: "admin@example.com", Password: testPassword, Role: "admin"})
+			var token string
+			switch tc.caller {
+			case admin:
+				token = ts.token("admin", "admin")
+			case adminNoMFA:
+				token = ts.token("admin", "admin", AMRPassword)
+			case alice:
+				token = ts.token("alice", "user")
+			}
+			resp, body := ts.do(tc.method, tc.path, token, tc.body)
+			if resp.StatusCode != tc.wantCode {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode, tc.wantCode, body)
+			}
+		})
+	}
+}
+
+func TestHTTPPutKeepsRole(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		stored   string
+		wantRole string
+	}{
+		{"admin", "admin", "admin"},
+		{"user", "user", "user"},
+		{"none", "", "user"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.seed(User{Username: "carol", Email: "carol@example.com", Password: testPassword, Role: tc.stored})
+			token := ts.token("carol", "user")
+			if tc.stored == "admin" {
+				token = ts.token("admin", "admin")
+			}
+
+			resp, body := ts.do("PUT", "/users/carol", token, User{Username: "carol", Email: "carol@example.org"})
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("PUT status = %d: %s", resp.StatusCode, body)
+			}
+			m, err := ts.repo.GetByUsername(context.Background(), "carol")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Role != tc.wantRole {
+				t.Errorf("role = %q, want %q", m.Role, tc.wantRole)
+			}
+		})
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		policy  Policy
+		wantErr bool
+	}{
+		{"default", DefaultPolicy, false},
+		{"undeclared default role", Policy{DefaultRole: "guest", Roles: DefaultPolicy.Roles}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := json.Marshal(tc.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "policy.json")
+			if err := ioutil.WriteFile(path, b, 0600); err != nil {
+				t.Fatal(err)
+			}
+			p, err := LoadPolicy(path)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tc.wantErr)
+			}
+			if err == nil && !p.Allows("admin", PermPurge) {
+				t.Error("loaded policy doesn't let admins purge")
+			}
+		})
+	}
+}
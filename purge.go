@@ -0,0 +1,49 @@
+package users
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// DefaultRetention is how long deleted users can be restored.
+const DefaultRetention = 30 * 24 * time.Hour
+
+// RunPurgeJob permanently removes the users deleted for longer than retention,
+// every interval, until ctx is done. Run it alongside a service using the same
+// retention and repositories, see WithRetention: the sessions and password
+// reset tokens of purged users are removed with them, unless nil.
+func RunPurgeJob(ctx context.Context, repo UserRepository, sessions RefreshTokenRepository, resets PasswordResetRepository, retention, interval time.Duration, logger log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		purged, err := repo.PurgeDeleted(ctx, time.Now().Add(-retention))
+		logger.Log("job", "purge", "purged", len(purged), "err", err)
+		for _, username := range purged {
+			if err := purgeTokens(ctx, sessions, resets, username); err != nil {
+				logger.Log("job", "purge", "user", username, "tokens", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeTokens revokes the sessions of a purged user and removes its password
+// reset tokens, so none can be used by whoever takes the username next.
+func purgeTokens(ctx context.Context, sessions RefreshTokenRepository, resets PasswordResetRepository, username string) error {
+	if sessions != nil {
+		if err := sessions.RevokeUser(ctx, username); err != nil {
+			return err
+		}
+	}
+	if resets != nil {
+		return resets.Purge(ctx, username)
+	}
+	return nil
+}
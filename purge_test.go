@@ -0,0 +1,149 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestHTTPSoftDelete(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		retention time.Duration
+		deleted   bool
+		method    string
+		path      string
+		wantCode  int
+		wantUser  bool // alice can be read afterwards
+	}{
+		{"get deleted", DefaultRetention, true, "GET", "/users/alice", http.StatusNotFound, false},
+		{"delete deleted", DefaultRetention, true, "DELETE", "/users/alice", http.StatusNotFound, false},
+		{"restore", DefaultRetention, true, "POST", "/users/alice:restore", http.StatusOK, true},
+		{"restore past retention", -time.Minute, true, "POST", "/users/alice:restore", http.StatusNotFound, false},
+		{"restore live", DefaultRetention, false, "POST", "/users/alice:restore", http.StatusNotFound, true},
+		{"restore unknown", DefaultRetention, false, "POST", "/users/carol:restore", http.StatusNotFound, true},
+		{"purge deleted", DefaultRetention, true, "POST", "/users/alice:purge", http.StatusOK, false},
+		{"purge live", DefaultRetention, false, "POST", "/users/alice:purge", http.StatusOK, false},
+		{"purge unknown", DefaultRetention, false, "POST", "/users/carol:purge", http.StatusNotFound, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newTestServer(t, withServiceOptions(WithRetention(tc.retention)))
+			ts.seed(User{Username: "alice", Email: "alice@example.com", Password: testPassword, Role: "user"})
+			admin := ts.token("admin", "admin")
+			if tc.deleted {
+				if resp, body := ts.do("DELETE", "/users/alice", admin, nil); resp.StatusCode != http.StatusOK {
+					t.Fatalf("DELETE status = %d: %s", resp.StatusCode, body)
+				}
+			}
+
+			resp, body := ts.do(tc.method, tc.path, admin, nil)
+			if resp.StatusCode != tc.wantCode {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tc.wantCode, body)
+			}
+			resp, _ = ts.do("GET", "/users/alice", admin, nil)
+			if got := resp.StatusCode == http.StatusOK; got != tc.wantUser {
+				t.Errorf("alice readable = %v, want %v", got, tc.wantUser)
+			}
+		})
+	}
+}
+
+func TestHTTPDeleteRevokesTokens(t *testing.T) {
+	var (
+		sessions = NewInmemRefreshTokenRepository()
+		resets   = NewInmemPasswordResetRepository()
+		ts       = newTestServer(t, withServiceOptions(
+			WithRefreshTokens(sessions, time.Hour),
+			WithPasswordReset(resets, NewInmemMailer(), "http://localhost/reset", time.Hour),
+		))
+		admin = ts.token("admin", "admin")
+		ctx   = context.Background()
+	)
+	alice := ts.seed(User{Username: "alice", Email: "alice@example.com", Password: testPassword, Role: "user"})
+	refresh := func(token string) int {
+		resp, _ := ts.do("POST", "/auth/refresh", "", refreshRequest{RefreshToken: token})
+		return resp.StatusCode
+	}
+
+	// Deleting logs alice out, and restoring doesn't log her back in.
+	session := ts.login("alice", testPassword, "").RefreshToken
+	ts.do("DELETE", "/users/alice", admin, nil)
+	ts.do("POST", "/users/alice:restore", admin, nil)
+	if code := refresh(session); code != http.StatusUnauthorized {
+		t.Errorf("refresh after delete status = %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	// Purging also removes her password reset tokens.
+	session = ts.login("alice", testPassword, "").RefreshToken
+	reset := PasswordResetTokenModel{TokenHash: hashToken("reset"), Username: "alice", ExpiresAt: time.Now().Add(time.Hour)}
+	if err := resets.Create(ctx, &reset); err != nil {
+		t.Fatal(err)
+	}
+	ts.do("DELETE", "/users/alice", admin, nil)
+	if resp, body := ts.do("POST", "/users/alice:purge", admin, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("purge status = %d: %s", resp.StatusCode, body)
+	}
+	if _, err := resets.GetByHash(ctx, reset.TokenHash); !errors.Is(err, ErrNotFound) {
+		t.Errorf("reset token of purged user: err = %v, want %v", err, ErrNotFound)
+	}
+
+	// Whoever takes the username next inherits nothing.
+	ts.seed(User{Username: "alice", Email: "alice@example.org", Password: testPassword, Role: "user"})
+	if code := refresh(session); code != http.StatusUnauthorized {
+		t.Errorf("refresh of purged user status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if resp, _ := ts.do("POST", "/auth/password-reset/confirm", "", resetPasswordRequest{Token: "reset", Password: "another Passw0rd"}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("reset of purged user status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	if m, _ := ts.repo.GetByUsername(ctx, "alice"); m.ID == alice.ID {
+		t.Error("purged user is back")
+	}
+}
+
+func TestRunPurgeJob(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		repo     = NewInmemRepository()
+		sessions = NewInmemRefreshTokenRepository()
+		resets   = NewInmemPasswordResetRepository()
+	)
+	for _, name := range []string{"alice", "bob"} {
+		if err := repo.Create(ctx, &UserModel{Username: name, Email: name + "@example.com"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.Delete(ctx, "alice", 0); err != nil {
+		t.Fatal(err)
+	}
+	session := RefreshTokenModel{TokenHash: hashToken("session"), Family: "f", Username: "alice", ExpiresAt: time.Now().Add(time.Hour)}
+	if err := sessions.Create(ctx, &session); err != nil {
+		t.Fatal(err)
+	}
+	reset := PasswordResetTokenModel{TokenHash: hashToken("reset"), Username: "alice", ExpiresAt: time.Now().Add(time.Hour)}
+	if err := resets.Create(ctx, &reset); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond) // alice was deleted before the job runs
+
+	// A done context stops the job after its first run.
+	done, cancel := context.WithCancel(ctx)
+	cancel()
+	RunPurgeJob(done, repo, sessions, resets, 0, time.Hour, log.NewNopLogger())
+
+	if err := repo.Restore(ctx, "alice", time.Time{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("restore purged user: err = %v, want %v", err, ErrNotFound)
+	}
+	if _, err := repo.GetByUsername(ctx, "bob"); err != nil {
+		t.Errorf("live user purged: %v", err)
+	}
+	if rt, err := sessions.GetByHash(ctx, session.TokenHash); err == nil && rt.RevokedAt == nil {
+		t.Error("session of purged user not revoked")
+	}
+	if _, err := resets.GetByHash(ctx, reset.TokenHash); !errors.Is(err, ErrNotFound) {
+		t.Errorf("reset token of purged user: err = %v, want %v", err, ErrNotFound)
+	}
+}
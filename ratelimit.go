@@ -0,0 +1,286 @@
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	grpctransport "github.com/go-kit/kit/transport/grpc"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"google.golang.org/grpc/metadata"
+)
+
+// ErrRateLimited is returned for requests over their rate limit. It tells
+// when to try again, see Error.RetryAfter.
+var ErrRateLimited = newError("rate_limited", http.StatusTooManyRequests, "rate limit exceeded")
+
+// RateLimit is a token bucket: clients may make Burst requests at once, and
+// then PerMinute requests a minute.
+type RateLimit struct {
+	PerMinute float64 `json:"per_minute"`
+	Burst     int     `json:"burst"`
+}
+
+// RateLimits are the rate limits of endpoints, by name, such as "PostUser" or
+// "Login". The limit named "*" applies to endpoints without one of their own.
+type RateLimits map[string]RateLimit
+
+// DefaultRateLimits are strict on the open endpoints, which bots go after,
+// and generous on the others, whose callers must authenticate.
+var DefaultRateLimits = RateLimits{
+	"*":                    {PerMinute: 600, Burst: 100},
+	"PostUser":             {PerMinute: 5, Burst: 5},
+	"Login":                {PerMinute: 30, Burst: 10},
+	"Refresh":              {PerMinute: 60, Burst: 20},
+	"RequestPasswordReset": {PerMinute: 5, Burst: 5},
+	"ResetPassword":        {PerMinute: 10, Burst: 10},
+	"VerifyEmail":          {PerMinute: 10, Burst: 10},
+}
+
+// LoadRateLimits reads JSON encoded RateLimits from the file at path. Every
+// limit must let requests through: a zero one, such as a misspelled field
+// left out, would otherwise block its endpoint.
+func LoadRateLimits(path string) (RateLimits, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var l RateLimits
+	if err := json.NewDecoder(f).Decode(&l); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch limit := l[name]; {
+		case limit.PerMinute <= 0:
+			return nil, fmt.Errorf("rate limits: %s: per_minute must be positive, got %v", name, limit.PerMinute)
+		case limit.Burst <= 0:
+			return nil, fmt.Errorf("rate limits: %s: burst must be positive, got %d", name, limit.Burst)
+		}
+	}
+	return l, nil
+}
+
+// For returns the rate limit of the named endpoint, if it has one.
+func (l RateLimits) For(name string) (RateLimit, bool) {
+	if limit, ok := l[name]; ok {
+		return limit, true
+	}
+	limit, ok := l["*"]
+	return limit, ok
+}
+
+// RateLimitStatus is the state of a bucket after taking a token from it.
+type RateLimitStatus struct {
+	Allowed bool
+
+	// Limit and Remaining are the size of the bucket, and the requests left
+	// in it.
+	Limit     int
+	Remaining int
+
+	// Reset is how long until the bucket is full again, RetryAfter until the
+	// next request is allowed.
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// RateLimiter keeps token buckets by key.
+type RateLimiter interface {
+	// Take takes a token from the bucket of key, refilled as limit says.
+	Take(ctx context.Context, key string, limit RateLimit) (RateLimitStatus, error)
+}
+
+type inmemRateLimiter struct {
+	mtx       sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last request, up to the burst.
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Minutes()*b.limit.PerMinute)
+	b.last = now
+}
+
+// NewInmemRateLimiter returns a concurrency-safe RateLimiter keeping its
+// buckets in memory, so each instance of the service limits on its own.
+func NewInmemRateLimiter() RateLimiter {
+	return &inmemRateLimiter{buckets: map[string]*bucket{}}
+}
+
+// sweepInterval is how often full buckets, which nobody used lately, are
+// forgotten.
+const sweepInterval = time.Minute
+
+func (l *inmemRateLimiter) Take(_ context.Context, key string, limit RateLimit) (RateLimitStatus, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastSweep) > sweepInterval {
+		for k, b := range l.buckets {
+			if b.refill(now); b.tokens >= float64(b.limit.Burst) {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok || b.limit != limit {
+		b = &bucket{limit: limit, tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.refill(now)
+	st := RateLimitStatus{Limit: limit.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		st.Allowed = true
+	} else {
+		st.RetryAfter = perMinute(1-b.tokens, limit.PerMinute)
+	}
+	st.Remaining = int(b.tokens)
+	st.Reset = perMinute(float64(limit.Burst)-b.tokens, limit.PerMinute)
+	return st, nil
+}
+
+// perMinute returns how long it takes to earn n tokens at rate a minute.
+func perMinute(n, rate float64) time.Duration {
+	if rate <= 0 {
+		return math.MaxInt64
+	}
+	return time.Duration(n / rate * float64(time.Minute))
+}
+
+// RateLimitKey returns the key that the rate limits of a request count by.
+type RateLimitKey func(ctx context.Context) string
+
+// RateLimitByClient counts the requests of authenticated users by username,
+// and others by client IP, see ClientIPFromContext. It's the default.
+func RateLimitByClient(ctx context.Context) string {
+	if p, ok := PrincipalFromContext(ctx); ok {
+		return "user:" + p.Username
+	}
+	if ip, ok := ClientIPFromContext(ctx); ok {
+		return "ip:" + ip
+	}
+	return "anonymous"
+}
+
+// RateLimitByAPIKey is like RateLimitByClient, but counts the requests with
+// an API key by key, see APIKeyFromContext. The service doesn't check API
+// keys: only use it behind a gateway that does, or clients could dodge their
+// limits by making keys up.
+func RateLimitByAPIKey(ctx context.Context) string {
+	if key, ok := APIKeyFromContext(ctx); ok {
+		return "key:" + hashToken(key)
+	}
+	return RateLimitByClient(ctx)
+}
+
+// RateLimiting returns an endpoint middleware failing requests over limit,
+// counted by key in buckets of limiter, with ErrRateLimited. The endpoint
+// name keeps the buckets of endpoints apart.
+//
+// The state of the bucket is passed along to the transport, which sends it
+// as RateLimit-* headers, see HTTPRateLimitToContext.
+func RateLimiting(limiter RateLimiter, name string, limit RateLimit, key RateLimitKey) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			st, err := limiter.Take(ctx, name+" "+key(ctx), limit)
+			if err != nil {
+				return nil, err
+			}
+			if s, ok := ctx.Value(rateLimitContextKey).(*RateLimitStatus); ok {
+				*s = st
+			}
+			if !st.Allowed {
+				return nil, ErrRateLimited.WithRetryAfter(st.RetryAfter)
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// HTTPRateLimitToContext makes room in the context for the RateLimitStatus of
+// the request, which encodeError and HTTPRateLimitToHeaders then send. Use it
+// as an httptransport.ServerBefore hook.
+func HTTPRateLimitToContext() httptransport.RequestFunc {
+	return func(ctx context.Context, _ *http.Request) context.Context {
+		return context.WithValue(ctx, rateLimitContextKey, &RateLimitStatus{})
+	}
+}
+
+// HTTPRateLimitToHeaders sets the RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset headers of successful responses. Use it as an
+// httptransport.ServerAfter hook.
+func HTTPRateLimitToHeaders() httptransport.ServerResponseFunc {
+	return func(ctx context.Context, w http.ResponseWriter) context.Context {
+		setRateLimitHeaders(ctx, w.Header())
+		return ctx
+	}
+}
+
+// setRateLimitHeaders sets the RateLimit-* headers of the response to a
+// request that went through RateLimiting, see
+// draft-ietf-httpapi-ratelimit-headers.
+func setRateLimitHeaders(ctx context.Context, h http.Header) {
+	st, ok := ctx.Value(rateLimitContextKey).(*RateLimitStatus)
+	if !ok || st.Limit == 0 {
+		return
+	}
+	h.Set("RateLimit-Limit", strconv.Itoa(st.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(st.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(st.Reset.Seconds()))))
+}
+
+// ContextWithAPIKey returns a copy of ctx carrying the API key of the caller.
+func ContextWithAPIKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey, key)
+}
+
+// APIKeyFromContext returns the API key of the caller, as set by
+// HTTPAPIKeyToContext or GRPCAPIKeyToContext.
+func APIKeyFromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(apiKeyContextKey).(string)
+	return key, ok && key != ""
+}
+
+// HTTPAPIKeyToContext moves an API key from the X-API-Key header to the
+// context. Use it as an httptransport.ServerBefore hook.
+func HTTPAPIKeyToContext() httptransport.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		return ContextWithAPIKey(ctx, r.Header.Get("X-API-Key"))
+	}
+}
+
+// GRPCAPIKeyToContext moves an API key from the x-api-key metadata to the
+// context. Use it as a grpctransport.ServerBefore hook.
+func GRPCAPIKeyToContext() grpctransport.ServerRequestFunc {
+	return func(ctx context.Context, md metadata.MD) context.Context {
+		if values := md.Get("x-api-key"); len(values) > 0 {
+			return ContextWithAPIKey(ctx, values[0])
+		}
+		return ctx
+	}
+}
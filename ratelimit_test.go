@@ -0,0 +1,176 @@
+package users
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimitsFor(t *testing.T) {
+	limits := RateLimits{"*": {PerMinute: 60, Burst: 10}, "Login": {PerMinute: 5, Burst: 1}}
+	for _, tc := range []struct {
+		limits RateLimits
+		name   string
+		want   RateLimit
+		wantOK bool
+	}{
+		{limits, "Login", RateLimit{PerMinute: 5, Burst: 1}, true},
+		{limits, "GetUser", RateLimit{PerMinute: 60, Burst: 10}, true},
+		{RateLimits{"Login": {PerMinute: 5, Burst: 1}}, "GetUser", RateLimit{}, false},
+	} {
+		if got, ok := tc.limits.For(tc.name); got != tc.want || ok != tc.wantOK {
+			t.Errorf("For(%s) = %+v, %v; want %+v, %v", tc.name, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
+
+func TestLoadRateLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		limits  string
+		wantErr string // in the error, empty for none
+	}{
+		{"valid", `{"*": {"per_minute": 60, "burst": 10}, "Login": {"per_minute": 0.5, "burst": 1}}`, ""},
+		{"zero rate", `{"*": {"per_minute": 60, "burst": 10}, "Login": {"per_minute": 0, "burst": 1}}`, "Login: per_minute"},
+		{"negative rate", `{"PostUser": {"per_minute": -1, "burst": 1}}`, "PostUser: per_minute"},
+		{"missing rate", `{"Login": {"perMinute": 30, "burst": 10}}`, "Login: per_minute"},
+		{"zero burst", `{"*": {"per_minute": 60}}`, "*: burst"},
+		{"negative burst", `{"Refresh": {"per_minute": 60, "burst": -5}}`, "Refresh: burst"},
+		{"malformed", `{"Login": 30}`, "cannot unmarshal"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ratelimits.json")
+			if err := ioutil.WriteFile(path, []byte(tc.limits), 0600); err != nil {
+				t.Fatal(err)
+			}
+			l, err := LoadRateLimits(path)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if limit, _ := l.For("Login"); limit != (RateLimit{PerMinute: 0.5, Burst: 1}) {
+					t.Errorf("Login limit = %+v", limit)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("err = %v, want one about %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadShippedRateLimits(t *testing.T) {
+	l, err := LoadRateLimits("ratelimits.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(l, DefaultRateLimits) {
+		t.Errorf("ratelimits.json = %v, want DefaultRateLimits %v", l, DefaultRateLimits)
+	}
+}
+
+func TestInmemRateLimiter(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		limiter = NewInmemRateLimiter()
+		limit   = RateLimit{PerMinute: 60, Burst: 2}
+	)
+	for i, tc := range []struct {
+		key           string
+		limit         RateLimit
+		wantAllowed   bool
+		wantRemaining int
+	}{
+		{"a", limit, true, 1},
+		{"a", limit, true, 0},
+		{"a", limit, false, 0},
+		{"b", limit, true, 1},
+		{"a", RateLimit{PerMinute: 60, Burst: 3}, true, 2}, // a new limit starts over
+	} {
+		st, err := limiter.Take(ctx, tc.key, tc.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Allowed != tc.wantAllowed || st.Remaining != tc.wantRemaining || st.Limit != tc.limit.Burst {
+			t.Errorf("take %d: %+v, want allowed %v with %d of %d remaining", i, st, tc.wantAllowed, tc.wantRemaining, tc.limit.Burst)
+		}
+		// A token a second: the next one is at most a second away, and the
+		// bucket full again within as many seconds as it's missing tokens.
+		if !st.Allowed && (st.RetryAfter <= 0 || st.RetryAfter > time.Second) {
+			t.Errorf("take %d: retry after %v, want at most a second", i, st.RetryAfter)
+		}
+		if missing := time.Duration(tc.limit.Burst-st.Remaining) * time.Second; st.Reset > missing || st.Reset < missing-time.Second {
+			t.Errorf("take %d: reset after %v, want about %v", i, st.Reset, missing)
+		}
+	}
+}
+
+func TestHTTPRateLimits(t *testing.T) {
+	// Each step logs in, or reads a user, from an IP with an API key.
+	type step struct {
+		path, ip, key string
+		wantCode      int
+		wantHeaders   [3]string // RateLimit-Limit, -Remaining and Retry-After
+	}
+	limits := RateLimits{"Login": {PerMinute: 1, Burst: 2}}
+	for _, tc := range []struct {
+		name  string
+		key   RateLimitKey
+		steps []step
+	}{
+		{"by client", RateLimitByClient, []step{
+			{"/auth/login", "192.0.2.1", "", http.StatusUnauthorized, [3]string{"2", "1", ""}},
+			{"/auth/login", "192.0.2.1", "", http.StatusUnauthorized, [3]string{"2", "0", ""}},
+			{"/auth/login", "192.0.2.1", "", http.StatusTooManyRequests, [3]string{"2", "0", "60"}},
+			{"/auth/login", "192.0.2.2", "", http.StatusUnauthorized, [3]string{"2", "1", ""}},
+			{"/users/alice", "192.0.2.1", "", http.StatusOK, [3]string{"", "", ""}},
+		}},
+		{"by API key", RateLimitByAPIKey, []step{
+			{"/auth/login", "192.0.2.1", "one", http.StatusUnauthorized, [3]string{"2", "1", ""}},
+			{"/auth/login", "192.0.2.2", "one", http.StatusUnauthorized, [3]string{"2", "0", ""}},
+			{"/auth/login", "192.0.2.3", "one", http.StatusTooManyRequests, [3]string{"2", "0", "60"}},
+			{"/auth/login", "192.0.2.1", "two", http.StatusUnauthorized, [3]string{"2", "1", ""}},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newTestServer(t, withEndpointOptions(
+				WithRateLimits(NewInmemRateLimiter(), limits),
+				WithRateLimitKey(tc.key),
+				WithTrustedProxies(1),
+			))
+			ts.seed(User{Username: "alice", Email: "alice@example.com", Password: testPassword, Role: "user"})
+			admin := ts.token("admin", "admin")
+
+			for i, s := range tc.steps {
+				var (
+					resp *http.Response
+					body []byte
+				)
+				if s.path == "/auth/login" {
+					resp, body = ts.do("POST", s.path, "", loginRequest{Username: "alice", Password: "wrong"}, "X-Forwarded-For", s.ip, "X-API-Key", s.key)
+				} else {
+					resp, body = ts.do("GET", s.path, admin, nil, "X-Forwarded-For", s.ip, "X-API-Key", s.key)
+				}
+				if resp.StatusCode != s.wantCode {
+					t.Fatalf("step %d: status = %d, want %d: %s", i, resp.StatusCode, s.wantCode, body)
+				}
+				for j, h := range []string{"RateLimit-Limit", "RateLimit-Remaining", "Retry-After"} {
+					if got := resp.Header.Get(h); got != s.wantHeaders[j] {
+						t.Errorf("step %d: %s = %q, want %q", i, h, got, s.wantHeaders[j])
+					}
+				}
+				if s.wantCode == http.StatusTooManyRequests {
+					if got := problemCode(body); got != "rate_limited" {
+						t.Errorf("step %d: problem = %q, want rate_limited", i, got)
+					}
+				}
+			}
+		})
+	}
+}
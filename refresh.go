@@ -0,0 +1,88 @@
+package users
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+var (
+	// ErrInvalidRefreshToken is returned for refresh tokens that are unknown,
+	// expired or revoked.
+	ErrInvalidRefreshToken = newError("invalid_refresh_token", http.StatusUnauthorized, "invalid refresh token")
+
+	// ErrRefreshTokenReused is returned when a refresh token is used twice.
+	// Only one of the client and a thief can have used it first, so the whole
+	// session is revoked.
+	ErrRefreshTokenReused = newError("refresh_token_reused", http.StatusUnauthorized, "refresh token reused, session revoked")
+)
+
+// DefaultRefreshTTL is how long refresh tokens can be used, by default.
+const DefaultRefreshTTL = 30 * 24 * time.Hour
+
+// RefreshTokenModel is a refresh token, as stored. Every refresh rotates the
+// token: it is marked used, and a new one of the same family, i.e. session,
+// is issued.
+type RefreshTokenModel struct {
+	ID        uint   `gorm:"primary_key"`
+	TokenHash string `gorm:"type:char(64);unique_index"` // SHA-256 of the token, which isn't stored
+	Family    string `gorm:"type:varchar(32);index"`
+	UserID    uint   `gorm:"index"` // the user the token was issued to, see Refresh
+	Username  string `gorm:"type:varchar(100);index"`
+	AMR       string `gorm:"type:varchar(32)"` // how the session was authenticated, see Claims
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+}
+
+// TableName implements gorm's tabler interface.
+func (RefreshTokenModel) TableName() string { return "refresh_tokens" }
+
+// RefreshTokenRepository stores refresh tokens.
+type RefreshTokenRepository interface {
+	Create(ctx context.Context, t *RefreshTokenModel) error
+	GetByHash(ctx context.Context, hash string) (RefreshTokenModel, error)
+
+	// Use marks the token with the given ID used, failing with
+	// ErrRefreshTokenReused if it already was.
+	Use(ctx context.Context, id uint) error
+
+	// RevokeFamily revokes every token of a session.
+	RevokeFamily(ctx context.Context, family string) error
+	// RevokeUser revokes every token of every session of a user.
+	RevokeUser(ctx context.Context, username string) error
+}
+
+// newRefreshToken returns a random refresh token, and a random family when
+// family is empty.
+func newRefreshToken(family string) (token, newFamily string, err error) {
+	b := make([]byte, 32+16)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	if family == "" {
+		family = hex.EncodeToString(b[32:])
+	}
+	return base64.RawURLEncoding.EncodeToString(b[:32]), family, nil
+}
+
+// newToken returns a random token, as sent by email for password resets.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hash random tokens, such as refresh tokens, are stored
+// and looked up by. They are random enough not to need a slow, salted hash.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,62 @@
+package users
+
+import (
+	"context"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+type gormRefreshTokenRepository struct {
+	db *gorm.DB
+}
+
+// NewGormRefreshTokenRepository returns a RefreshTokenRepository backed by the
+// given GORM connection, see migrations for its refresh_tokens table.
+func NewGormRefreshTokenRepository(db *gorm.DB) RefreshTokenRepository {
+	return &gormRefreshTokenRepository{db}
+}
+
+// with passes ctx along to the GORM callbacks, see TraceGorm.
+func (r *gormRefreshTokenRepository) with(ctx context.Context) *gorm.DB {
+	return r.db.Set(gormContextKey, ctx)
+}
+
+func (r *gormRefreshTokenRepository) Create(ctx context.Context, t *RefreshTokenModel) error {
+	return gormError(r.with(ctx).Create(t).Error)
+}
+
+func (r *gormRefreshTokenRepository) GetByHash(ctx context.Context, hash string) (RefreshTokenModel, error) {
+	var t RefreshTokenModel
+	if err := r.with(ctx).Where("token_hash = ?", hash).First(&t).Error; err != nil {
+		return RefreshTokenModel{}, gormError(err)
+	}
+	return t, nil
+}
+
+func (r *gormRefreshTokenRepository) Use(ctx context.Context, id uint) error {
+	res := r.with(ctx).Model(&RefreshTokenModel{}).
+		Where("id = ? AND used_at IS NULL", id).
+		Update("used_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrRefreshTokenReused
+	}
+	return nil
+}
+
+func (r *gormRefreshTokenRepository) RevokeFamily(ctx context.Context, family string) error {
+	return r.revoke(ctx, "family = ?", family)
+}
+
+func (r *gormRefreshTokenRepository) RevokeUser(ctx context.Context, username string) error {
+	return r.revoke(ctx, "username = ?", username)
+}
+
+func (r *gormRefreshTokenRepository) revoke(ctx context.Context, where string, arg interface{}) error {
+	return r.with(ctx).Model(&RefreshTokenModel{}).
+		Where(where, arg).Where("revoked_at IS NULL").
+		Update("revoked_at", time.Now()).Error
+}
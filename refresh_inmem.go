@@ -0,0 +1,85 @@
+package users
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type inmemRefreshTokenRepository struct {
+	mtx    sync.Mutex
+	m      map[uint]RefreshTokenModel
+	hashes map[string]uint
+	nextID uint
+}
+
+// NewInmemRefreshTokenRepository returns a concurrency-safe
+// RefreshTokenRepository that keeps everything in memory. Useful in tests and
+// local demos.
+func NewInmemRefreshTokenRepository() RefreshTokenRepository {
+	return &inmemRefreshTokenRepository{
+		m:      map[uint]RefreshTokenModel{},
+		hashes: map[string]uint{},
+	}
+}
+
+func (r *inmemRefreshTokenRepository) Create(_ context.Context, t *RefreshTokenModel) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, ok := r.hashes[t.TokenHash]; ok {
+		return ErrAlreadyExists
+	}
+	r.nextID++
+	t.ID, t.CreatedAt = r.nextID, time.Now()
+	r.m[t.ID] = *t
+	r.hashes[t.TokenHash] = t.ID
+	return nil
+}
+
+func (r *inmemRefreshTokenRepository) GetByHash(_ context.Context, hash string) (RefreshTokenModel, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	id, ok := r.hashes[hash]
+	if !ok {
+		return RefreshTokenModel{}, ErrNotFound
+	}
+	return r.m[id], nil
+}
+
+func (r *inmemRefreshTokenRepository) Use(_ context.Context, id uint) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	t, ok := r.m[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if t.UsedAt != nil {
+		return ErrRefreshTokenReused
+	}
+	now := time.Now()
+	t.UsedAt = &now
+	r.m[id] = t
+	return nil
+}
+
+func (r *inmemRefreshTokenRepository) RevokeFamily(_ context.Context, family string) error {
+	r.revoke(func(t RefreshTokenModel) bool { return t.Family == family })
+	return nil
+}
+
+func (r *inmemRefreshTokenRepository) RevokeUser(_ context.Context, username string) error {
+	r.revoke(func(t RefreshTokenModel) bool { return t.Username == username })
+	return nil
+}
+
+func (r *inmemRefreshTokenRepository) revoke(match func(RefreshTokenModel) bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	now := time.Now()
+	for id, t := range r.m {
+		if t.RevokedAt == nil && match(t) {
+			t.RevokedAt = &now
+			r.m[id] = t
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHTTPRefresh(t *testing.T) {
+	// Each step refreshes with the token from an earlier login or refresh, by
+	// index, 0 being the login.
+	type step struct {
+		from     int
+		wantCode int
+		wantErr  string
+	}
+	for _, tc := range []struct {
+		name   string
+		before func(ts *testServer)
+		ttl    time.Duration
+		steps  []step
+	}{
+		{"rotation", nil, time.Hour, []step{
+			{0, http.StatusOK, ""},
+			{1, http.StatusOK, ""},
+			{2, http.StatusOK, ""},
+		}},
+		{"reuse revokes the session", nil, time.Hour, []step{
+			{0, http.StatusOK, ""},
+			{0, http.StatusUnauthorized, "refresh_token_reused"},
+			{1, http.StatusUnauthorized, "invalid_refresh_token"},
+		}},
+		{"reuse of an older token", nil, time.Hour, []step{
+			{0, http.StatusOK, ""},
+			{1, http.StatusOK, ""},
+			{1, http.StatusUnauthorized, "refresh_token_reused"},
+			{2, http.StatusUnauthorized, "invalid_refresh_token"},
+		}},
+		{"expired", nil, -time.Second, []step{
+			{0, http.StatusUnauthorized, "invalid_refresh_token"},
+		}},
+		{"revoked sessions", func(ts *testServer) {
+			ts.do("DELETE", "/users/alice/sessions", ts.token("alice", "user"), nil)
+		}, time.Hour, []step{
+			{0, http.StatusUnauthorized, "invalid_refresh_token"},
+		}},
+		{"deleted user", func(ts *testServer) {
+			ts.do("DELETE", "/users/alice", ts.token("admin", "admin"), nil)
+		}, time.Hour, []step{
+			{0, http.StatusUnauthorized, "invalid_refresh_token"},
+		}},
+		{"username taken over", func(ts *testServer) {
+			// Purged behind the service's back, so the sessions are left:
+			// only the user ID they're bound to tells the users apart.
+			if err := ts.repo.Purge(context.Background(), "alice"); err != nil {
+				ts.t.Fatal(err)
+			}
+			ts.seed(User{Username: "alice", Email: "alice@example.org", Password: testPassword, Role: "admin"})
+		}, time.Hour, []step{
+			{0, http.StatusUnauthorized, "invalid_refresh_token"},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newTestServer(t, withServiceOptions(WithRefreshTokens(NewInmemRefreshTokenRepository(), tc.ttl)))
+			ts.seed(User{Username: "alice", Email: "alice@example.com", Password: testPassword, Role: "user"})
+			tokens := []Token{ts.login("alice", testPassword, "")}
+			if tc.before != nil {
+				tc.before(ts)
+			}
+
+			for i, s := range tc.steps {
+				resp, body := ts.do("POST", "/auth/refresh", "", refreshRequest{RefreshToken: tokens[s.from].RefreshToken})
+				if resp.StatusCode != s.wantCode {
+					t.Fatalf("step %d: status = %d, want %d: %s", i, resp.StatusCode, s.wantCode, body)
+				}
+				if got := problemCode(body); got != s.wantErr {
+					t.Fatalf("step %d: problem = %q, want %q", i, got, s.wantErr)
+				}
+				var token Token
+				json.Unmarshal(body, &token)
+				if s.wantErr == "" {
+					claims, err := ParseToken(ts.keys, token.AccessToken)
+					if err != nil {
+						t.Fatalf("step %d: %v", i, err)
+					}
+					if claims.Username != "alice" || len(claims.AMR) != 1 || claims.AMR[0] != AMRPassword {
+						t.Errorf("step %d: claims = %+v, want alice authenticated with a password", i, claims)
+					}
+					if token.RefreshToken == "" || token.RefreshToken == tokens[s.from].RefreshToken {
+						t.Errorf("step %d: refresh token not rotated", i)
+					}
+				}
+				tokens = append(tokens, token)
+			}
+		})
+	}
+}
+
+// failingRevocations fails to revoke sessions.
+type failingRevocations struct {
+	RefreshTokenRepository
+}
+
+func (failingRevocations) RevokeFamily(context.Context, string) error {
+	return errors.New("pq: connection refused")
+}
+
+func TestHTTPRefreshRevocationFailure(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		before func(ts *testServer, token Token)
+	}{
+		{"reused", func(ts *testServer, token Token) {
+			ts.do("POST", "/auth/refresh", "", refreshRequest{RefreshToken: token.RefreshToken})
+		}},
+		{"username taken over", func(ts *testServer, _ Token) {
+			if err := ts.repo.Purge(context.Background(), "alice"); err != nil {
+				ts.t.Fatal(err)
+			}
+			ts.seed(User{Username: "alice", Email: "alice@example.org", Password: testPassword, Role: "admin"})
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sessions := failingRevocations{NewInmemRefreshTokenRepository()}
+			ts := newTestServer(t, withServiceOptions(WithRefreshTokens(sessions, time.Hour)))
+			ts.seed(User{Username: "alice", Email: "alice@example.com", Password: testPassword, Role: "user"})
+			token := ts.login("alice", testPassword, "")
+			tc.before(ts, token)
+
+			// The session couldn't be revoked: that's the error, rather than
+			// the token being merely invalid.
+			resp, body := ts.do("POST", "/auth/refresh", "", refreshRequest{RefreshToken: token.RefreshToken})
+			if resp.StatusCode != http.StatusInternalServerError {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode, http.StatusInternalServerError, body)
+			}
+		})
+	}
+}
+
+func TestHTTPLogout(t *testing.T) {
+	ts := newTestServer(t, withServiceOptions(WithRefreshTokens(NewInmemRefreshTokenRepository(), time.Hour)))
+	ts.seed(User{Username: "alice", Email: "alice@example.com", Password: testPassword, Role: "user"})
+	phone, laptop := ts.login("alice", testPassword, ""), ts.login("alice", testPassword, "")
+
+	for _, tc := range []struct {
+		name     string
+		path     string
+		token    string
+		wantCode int
+	}{
+		{"logout", "/auth/logout", phone.RefreshToken, http.StatusOK},
+		{"logged out", "/auth/refresh", phone.RefreshToken, http.StatusUnauthorized},
+		{"other session", "/auth/refresh", laptop.RefreshToken, http.StatusOK},
+		{"logout unknown", "/auth/logout", "garbage", http.StatusOK},
+		{"refresh unknown", "/auth/refresh", "garbage", http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, body := ts.do("POST", tc.path, "", refreshRequest{RefreshToken: tc.token})
+			if resp.StatusCode != tc.wantCode {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode, tc.wantCode, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package users
+
+import (
+	"context"
+	"time"
+)
+
+// UserRepository abstracts the storage of users away from the service, so the
+// business logic can run against Postgres in production and an in-memory
+// store in tests and local demos.
+//
+// Delete only soft-deletes users: they're left out of every other method, but
+// keep their username and email, until restored or purged.
+type UserRepository interface {
+	Create(ctx context.Context, m *UserModel) error
+	GetByUsername(ctx context.Context, username string) (UserModel, error)
+	GetByID(ctx context.Context, id uint) (UserModel, error)
+	GetByEmail(ctx context.Context, email string) (UserModel, error)
+	Update(ctx context.Context, m *UserModel) error
+	Delete(ctx context.Context, username string, version uint64) error
+	List(ctx context.Context, q UserQuery) ([]UserModel, error)
+
+	// Restore undoes the deletion of a user deleted since the given time.
+	Restore(ctx context.Context, username string, deletedSince time.Time) error
+	// Purge permanently removes a user, deleted or not.
+	Purge(ctx context.Context, username string) error
+	// PurgeDeleted permanently removes the users deleted before the given
+	// time, returning their usernames.
+	PurgeDeleted(ctx context.Context, deletedBefore time.Time) ([]string, error)
+}
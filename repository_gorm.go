@@ -0,0 +1,225 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/lib/pq"
+)
+
+// uniqueViolation is the Postgres SQLSTATE raised when a unique index, such as
+// the ones on username and email, rejects a row.
+const uniqueViolation = "23505"
+
+type gormRepository struct {
+	db *gorm.DB
+}
+
+// NewGormRepository returns a UserRepository backed by the given GORM
+// connection, typically a Postgres (or CockroachDB) database.
+func NewGormRepository(db *gorm.DB) UserRepository {
+	return &gormRepository{db}
+}
+
+// with passes ctx along to the GORM callbacks, see TraceGorm.
+func (r *gormRepository) with(ctx context.Context) *gorm.DB {
+	return r.db.Set(gormContextKey, ctx)
+}
+
+func (r *gormRepository) Create(ctx context.Context, m *UserModel) error {
+	m.Version = 1
+	return gormError(r.with(ctx).Create(m).Error)
+}
+
+func (r *gormRepository) GetByUsername(ctx context.Context, username string) (UserModel, error) {
+	var m UserModel
+	if err := r.with(ctx).Where("username = ?", username).First(&m).Error; err != nil {
+		return UserModel{}, gormError(err)
+	}
+	return m, nil
+}
+
+func (r *gormRepository) GetByID(ctx context.Context, id uint) (UserModel, error) {
+	var m UserModel
+	if err := r.with(ctx).First(&m, id).Error; err != nil {
+		return UserModel{}, gormError(err)
+	}
+	return m, nil
+}
+
+func (r *gormRepository) GetByEmail(ctx context.Context, email string) (UserModel, error) {
+	var m UserModel
+	if err := r.with(ctx).Where("email = ?", email).First(&m).Error; err != nil {
+		return UserModel{}, gormError(err)
+	}
+	return m, nil
+}
+
+func (r *gormRepository) Update(ctx context.Context, m *UserModel) error {
+	if m.ID == 0 {
+		return ErrNotFound
+	}
+	// Compare and swap on the version, rather than Save which would insert
+	// the row again if it was deleted in the meantime.
+	version := m.Version
+	res := r.with(ctx).Model(m).Where("version = ?", version).Updates(map[string]interface{}{
+		"first_name": m.FirstName,
+		"last_name":  m.LastName,
+		"username":   m.Username,
+		"email":      m.Email,
+		"password":   m.Password,
+		"role":       m.Role,
+		"version":    version + 1,
+
+		"email_verified": m.EmailVerified,
+		"pending_email":  m.PendingEmail,
+
+		"mfa_secret":         m.MFA.Secret,
+		"mfa_enabled":        m.MFA.Enabled,
+		"mfa_recovery_codes": m.MFA.RecoveryCodes,
+		"mfa_last_step":      m.MFA.LastStep,
+	})
+	if res.Error != nil {
+		return gormError(res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return r.missing(ctx, r.db.Where("id = ?", m.ID))
+	}
+	m.Version = version + 1
+	return nil
+}
+
+func (r *gormRepository) Delete(ctx context.Context, username string, version uint64) error {
+	db := r.with(ctx).Model(&UserModel{}).Where("username = ?", username)
+	if version != 0 {
+		db = db.Where("version = ?", version)
+	}
+	// Soft delete, bumping the version like any other write.
+	res := db.Updates(map[string]interface{}{
+		"deleted_at": time.Now(),
+		"version":    gorm.Expr("version + 1"),
+	})
+	if res.Error != nil {
+		return gormError(res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return r.missing(ctx, r.db.Where("username = ?", username))
+	}
+	return nil
+}
+
+func (r *gormRepository) Restore(ctx context.Context, username string, deletedSince time.Time) error {
+	res := r.with(ctx).Unscoped().Model(&UserModel{}).
+		Where("username = ? AND deleted_at >= ?", username, deletedSince).
+		Updates(map[string]interface{}{
+			"deleted_at": nil,
+			"version":    gorm.Expr("version + 1"),
+		})
+	if res.Error != nil {
+		return gormError(res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *gormRepository) Purge(ctx context.Context, username string) error {
+	res := r.with(ctx).Unscoped().Where("username = ?", username).Delete(&UserModel{})
+	if res.Error != nil {
+		return gormError(res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *gormRepository) PurgeDeleted(ctx context.Context, deletedBefore time.Time) ([]string, error) {
+	rows, err := r.with(ctx).Raw("DELETE FROM user_models WHERE deleted_at < ? RETURNING username", deletedBefore).Rows()
+	if err != nil {
+		return nil, gormError(err)
+	}
+	defer rows.Close()
+	var purged []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		purged = append(purged, username)
+	}
+	return purged, rows.Err()
+}
+
+// missing explains why a write matched no row: ErrPreconditionFailed if the
+// user matching where still exists, with another version, else ErrNotFound.
+func (r *gormRepository) missing(ctx context.Context, where *gorm.DB) error {
+	var n int
+	if err := where.Set(gormContextKey, ctx).Model(&UserModel{}).Count(&n).Error; err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrPreconditionFailed.WithDetail("concurrent modification")
+	}
+	return ErrNotFound
+}
+
+// sortColumns maps sort fields to the columns they order by.
+var sortColumns = map[SortField]string{
+	SortByCreated:  "created_at",
+	SortByUpdated:  "updated_at",
+	SortByUsername: "username",
+}
+
+func (r *gormRepository) List(ctx context.Context, q UserQuery) ([]UserModel, error) {
+	db := r.with(ctx)
+	if q.Role != "" {
+		db = db.Where("role = ?", q.Role)
+	}
+	if q.EmailDomain != "" {
+		db = db.Where("lower(email) LIKE ?", "%@"+escapeLike(strings.ToLower(q.EmailDomain)))
+	}
+	if q.NamePrefix != "" {
+		prefix := escapeLike(strings.ToLower(q.NamePrefix)) + "%"
+		db = db.Where("lower(username) LIKE ? OR lower(first_name) LIKE ? OR lower(last_name) LIKE ?", prefix, prefix, prefix)
+	}
+
+	col, op, dir := sortColumns[q.SortBy], ">", "ASC"
+	if q.Descending {
+		op, dir = "<", "DESC"
+	}
+	if q.After != nil {
+		var v interface{} = q.After.Time
+		if q.SortBy == SortByUsername {
+			v = q.After.Username
+		}
+		db = db.Where(fmt.Sprintf("%[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?)", col, op), v, v, q.After.ID)
+	}
+
+	var ms []UserModel
+	if err := db.Order(col + " " + dir).Order("id " + dir).Limit(q.Limit).Find(&ms).Error; err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// escapeLike escapes the wildcards of LIKE patterns in s.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// gormError translates GORM errors into the service's sentinel errors.
+func gormError(err error) error {
+	if err == gorm.ErrRecordNotFound {
+		return ErrNotFound
+	}
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == uniqueViolation {
+		return ErrAlreadyExists
+	}
+	return err
+}
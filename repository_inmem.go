@@ -0,0 +1,238 @@
+package users
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type inmemRepository struct {
+	mtx    sync.RWMutex
+	m      map[uint]UserModel
+	names  map[string]uint
+	nextID uint
+}
+
+// NewInmemRepository returns a concurrency-safe UserRepository that keeps
+// everything in memory. Useful in tests and local demos.
+func NewInmemRepository() UserRepository {
+	return &inmemRepository{
+		m:     map[uint]UserModel{},
+		names: map[string]uint{},
+	}
+}
+
+func (r *inmemRepository) Create(_ context.Context, m *UserModel) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, ok := r.names[m.Username]; ok || r.emailTaken(m.Email, 0) {
+		return ErrAlreadyExists
+	}
+	r.nextID++
+	now := time.Now()
+	m.ID, m.CreatedAt, m.UpdatedAt, m.Version = r.nextID, now, now, 1
+	r.m[m.ID] = *m
+	r.names[m.Username] = m.ID
+	return nil
+}
+
+func (r *inmemRepository) GetByUsername(_ context.Context, username string) (UserModel, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	id, ok := r.names[username]
+	if !ok || r.m[id].DeletedAt != nil {
+		return UserModel{}, ErrNotFound
+	}
+	return r.m[id], nil
+}
+
+func (r *inmemRepository) GetByID(_ context.Context, id uint) (UserModel, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	m, ok := r.m[id]
+	if !ok || m.DeletedAt != nil {
+		return UserModel{}, ErrNotFound
+	}
+	return m, nil
+}
+
+func (r *inmemRepository) GetByEmail(_ context.Context, email string) (UserModel, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	for _, m := range r.m {
+		if m.Email == email && m.DeletedAt == nil {
+			return m, nil
+		}
+	}
+	return UserModel{}, ErrNotFound
+}
+
+func (r *inmemRepository) Update(_ context.Context, m *UserModel) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	existing, ok := r.m[m.ID]
+	if !ok || existing.DeletedAt != nil {
+		return ErrNotFound
+	}
+	if existing.Version != m.Version {
+		return ErrPreconditionFailed.WithDetail("concurrent modification")
+	}
+	if r.emailTaken(m.Email, m.ID) {
+		return ErrAlreadyExists
+	}
+	if existing.Username != m.Username {
+		if _, taken := r.names[m.Username]; taken {
+			return ErrAlreadyExists
+		}
+		delete(r.names, existing.Username)
+		r.names[m.Username] = m.ID
+	}
+	m.CreatedAt, m.UpdatedAt = existing.CreatedAt, time.Now()
+	m.Version++
+	r.m[m.ID] = *m
+	return nil
+}
+
+func (r *inmemRepository) Delete(_ context.Context, username string, version uint64) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	id, ok := r.names[username]
+	if !ok || r.m[id].DeletedAt != nil {
+		return ErrNotFound
+	}
+	m := r.m[id]
+	if version != 0 && m.Version != version {
+		return ErrPreconditionFailed.WithDetail("concurrent modification")
+	}
+	now := time.Now()
+	m.DeletedAt, m.UpdatedAt = &now, now
+	m.Version++
+	r.m[id] = m
+	return nil
+}
+
+func (r *inmemRepository) Restore(_ context.Context, username string, deletedSince time.Time) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	id, ok := r.names[username]
+	if !ok {
+		return ErrNotFound
+	}
+	m := r.m[id]
+	if m.DeletedAt == nil || m.DeletedAt.Before(deletedSince) {
+		return ErrNotFound
+	}
+	m.DeletedAt, m.UpdatedAt = nil, time.Now()
+	m.Version++
+	r.m[id] = m
+	return nil
+}
+
+func (r *inmemRepository) Purge(_ context.Context, username string) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	id, ok := r.names[username]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(r.m, id)
+	delete(r.names, username)
+	return nil
+}
+
+func (r *inmemRepository) PurgeDeleted(_ context.Context, deletedBefore time.Time) ([]string, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	var purged []string
+	for id, m := range r.m {
+		if m.DeletedAt != nil && m.DeletedAt.Before(deletedBefore) {
+			delete(r.m, id)
+			delete(r.names, m.Username)
+			purged = append(purged, m.Username)
+		}
+	}
+	return purged, nil
+}
+
+func (r *inmemRepository) List(_ context.Context, q UserQuery) ([]UserModel, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	var (
+		domain = "@" + strings.ToLower(q.EmailDomain)
+		prefix = strings.ToLower(q.NamePrefix)
+	)
+	ms := make([]UserModel, 0, len(r.m))
+	for _, m := range r.m {
+		if m.DeletedAt != nil {
+			continue
+		}
+		if q.Role != "" && m.Role != q.Role {
+			continue
+		}
+		if q.EmailDomain != "" && !strings.HasSuffix(strings.ToLower(m.Email), domain) {
+			continue
+		}
+		if q.NamePrefix != "" &&
+			!strings.HasPrefix(strings.ToLower(m.Username), prefix) &&
+			!strings.HasPrefix(strings.ToLower(m.FirstName), prefix) &&
+			!strings.HasPrefix(strings.ToLower(m.LastName), prefix) {
+			continue
+		}
+		if q.After != nil && !listedAfter(cursorOf(m, q), *q.After) {
+			continue
+		}
+		ms = append(ms, m)
+	}
+
+	sort.Slice(ms, func(i, j int) bool {
+		return listedAfter(cursorOf(ms[j], q), cursorOf(ms[i], q))
+	})
+	if len(ms) > q.Limit {
+		ms = ms[:q.Limit]
+	}
+	return ms, nil
+}
+
+// listedAfter reports whether the user at position a comes after the one at
+// b, in the order both cursors were made for.
+func listedAfter(a, b ListCursor) bool {
+	var cmp int
+	switch a.SortBy {
+	case SortByUsername:
+		cmp = strings.Compare(a.Username, b.Username)
+	default:
+		switch {
+		case a.Time.After(b.Time):
+			cmp = 1
+		case a.Time.Before(b.Time):
+			cmp = -1
+		}
+	}
+	if cmp == 0 {
+		switch {
+		case a.ID > b.ID:
+			cmp = 1
+		case a.ID < b.ID:
+			cmp = -1
+		}
+	}
+	if a.Descending {
+		cmp = -cmp
+	}
+	return cmp > 0
+}
+
+// emailTaken reports whether a user other than the one with the given ID
+// already has the email, mirroring the unique index in Postgres. Deleted users
+// keep theirs until purged.
+func (r *inmemRepository) emailTaken(email string, except uint) bool {
+	for id, m := range r.m {
+		if id != except && m.Email == email {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestInmemRepository(t *testing.T) {
+	ctx := context.Background()
+	seed := func(t *testing.T) UserRepository {
+		repo := NewInmemRepository()
+		for _, m := range []UserModel{
+			{Username: "alice", Email: "alice@example.com"},
+			{Username: "bob", Email: "bob@example.com"},
+		} {
+			if err := repo.Create(ctx, &m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return repo
+	}
+
+	for _, tc := range []struct {
+		name string
+		run  func(UserRepository) error
+		want error
+	}{
+		{"create", func(r UserRepository) error {
+			return r.Create(ctx, &UserModel{Username: "carol", Email: "carol@example.com"})
+		}, nil},
+		{"create taken username", func(r UserRepository) error {
+			return r.Create(ctx, &UserModel{Username: "alice", Email: "other@example.com"})
+		}, ErrAlreadyExists},
+		{"create taken email", func(r UserRepository) error {
+			return r.Create(ctx, &UserModel{Username: "carol", Email: "bob@example.com"})
+		}, ErrAlreadyExists},
+		{"get", func(r UserRepository) error {
+			_, err := r.GetByUsername(ctx, "alice")
+			return err
+		}, nil},
+		{"get unknown", func(r UserRepository) error {
+			_, err := r.GetByUsername(ctx, "carol")
+			return err
+		}, ErrNotFound},
+		{"get by email", func(r UserRepository) error {
+			_, err := r.GetByEmail(ctx, "bob@example.com")
+			return err
+		}, nil},
+		{"update", func(r UserRepository) error {
+			m, _ := r.GetByUsername(ctx, "alice")
+			m.FirstName = "Alice"
+			return r.Update(ctx, &m)
+		}, nil},
+		{"update to taken email", func(r UserRepository) error {
+			m, _ := r.GetByUsername(ctx, "alice")
+			m.Email = "bob@example.com"
+			return r.Update(ctx, &m)
+		}, ErrAlreadyExists},
+		{"update stale version", func(r UserRepository) error {
+			m, _ := r.GetByUsername(ctx, "alice")
+			stale := m
+			if err := r.Update(ctx, &m); err != nil {
+				return err
+			}
+			return r.Update(ctx, &stale)
+		}, ErrPreconditionFailed},
+		{"update unknown", func(r UserRepository) error {
+			m := UserModel{Username: "carol"}
+			m.ID = 42
+			return r.Update(ctx, &m)
+		}, ErrNotFound},
+		{"delete", func(r UserRepository) error {
+			return r.Delete(ctx, "alice", 0)
+		}, nil},
+		{"delete unknown", func(r UserRepository) error {
+			return r.Delete(ctx, "carol", 0)
+		}, ErrNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.run(seed(t)); !errors.Is(err, tc.want) {
+				t.Errorf("err = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestInmemRepositoryVersions(t *testing.T) {
+	ctx := context.Background()
+	repo := NewInmemRepository()
+	m := UserModel{Username: "alice", Email: "alice@example.com"}
+	if err := repo.Create(ctx, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.ID == 0 || m.Version != 1 {
+		t.Fatalf("created ID %d, version %d; want an ID and version 1", m.ID, m.Version)
+	}
+	if err := repo.Update(ctx, &m); err != nil {
+		t.Fatal(err)
+	}
+	got, err := repo.GetByID(ctx, m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != 2 || m.Version != 2 {
+		t.Errorf("version after update = %d (stored %d), want 2", m.Version, got.Version)
+	}
+}
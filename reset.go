@@ -0,0 +1,54 @@
+package users
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// ErrInvalidResetToken is returned for password reset tokens that are unknown,
+// expired or already used.
+var ErrInvalidResetToken = newError("invalid_reset_token", http.StatusBadRequest, "invalid or expired password reset token")
+
+// DefaultPasswordResetTTL is how long password reset tokens can be used, by
+// default.
+const DefaultPasswordResetTTL = time.Hour
+
+// PasswordResetTokenModel is a password reset token, as stored. Like refresh
+// tokens, only its hash is.
+type PasswordResetTokenModel struct {
+	ID        uint   `gorm:"primary_key"`
+	TokenHash string `gorm:"type:char(64);unique_index"`
+	Username  string `gorm:"type:varchar(100);index"`
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// TableName implements gorm's tabler interface.
+func (PasswordResetTokenModel) TableName() string { return "password_reset_tokens" }
+
+// PasswordResetRepository stores password reset tokens.
+type PasswordResetRepository interface {
+	Create(ctx context.Context, t *PasswordResetTokenModel) error
+	GetByHash(ctx context.Context, hash string) (PasswordResetTokenModel, error)
+
+	// Use marks every unused token of the user of the token with the given
+	// ID used, failing with ErrInvalidResetToken if that one already was.
+	Use(ctx context.Context, id uint) error
+
+	// Purge removes every token of a user, used or not.
+	Purge(ctx context.Context, username string) error
+}
+
+// passwordResetMessage is the email sent with a reset link.
+func passwordResetMessage(to, link string, ttl time.Duration) Message {
+	return Message{
+		To:      to,
+		Subject: "Reset your password",
+		Body: "Someone, hopefully you, asked to reset your password.\n\n" +
+			"Follow this link within " + ttl.String() + " to choose a new one:\n\n" +
+			link + "\n\n" +
+			"If you didn't ask for it, ignore this email: your password won't change.\n",
+	}
+}
@@ -0,0 +1,54 @@
+package users
+
+import (
+	"context"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+type gormPasswordResetRepository struct {
+	db *gorm.DB
+}
+
+// NewGormPasswordResetRepository returns a PasswordResetRepository backed by
+// the given GORM connection, see migrations for its password_reset_tokens
+// table.
+func NewGormPasswordResetRepository(db *gorm.DB) PasswordResetRepository {
+	return &gormPasswordResetRepository{db}
+}
+
+// with passes ctx along to the GORM callbacks, see TraceGorm.
+func (r *gormPasswordResetRepository) with(ctx context.Context) *gorm.DB {
+	return r.db.Set(gormContextKey, ctx)
+}
+
+func (r *gormPasswordResetRepository) Create(ctx context.Context, t *PasswordResetTokenModel) error {
+	return gormError(r.with(ctx).Create(t).Error)
+}
+
+func (r *gormPasswordResetRepository) GetByHash(ctx context.Context, hash string) (PasswordResetTokenModel, error) {
+	var t PasswordResetTokenModel
+	if err := r.with(ctx).Where("token_hash = ?", hash).First(&t).Error; err != nil {
+		return PasswordResetTokenModel{}, gormError(err)
+	}
+	return t, nil
+}
+
+func (r *gormPasswordResetRepository) Use(ctx context.Context, id uint) error {
+	// One statement, so two concurrent uses can't both succeed.
+	res := r.with(ctx).Model(&PasswordResetTokenModel{}).
+		Where("used_at IS NULL AND username = (SELECT username FROM password_reset_tokens WHERE id = ? AND used_at IS NULL)", id).
+		Update("used_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrInvalidResetToken
+	}
+	return nil
+}
+
+func (r *gormPasswordResetRepository) Purge(ctx context.Context, username string) error {
+	return gormError(r.with(ctx).Where("username = ?", username).Delete(&PasswordResetTokenModel{}).Error)
+}
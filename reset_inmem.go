@@ -0,0 +1,76 @@
+package users
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type inmemPasswordResetRepository struct {
+	mtx    sync.Mutex
+	m      map[uint]PasswordResetTokenModel
+	hashes map[string]uint
+	nextID uint
+}
+
+// NewInmemPasswordResetRepository returns a concurrency-safe
+// PasswordResetRepository that keeps everything in memory. Useful in tests
+// and local demos.
+func NewInmemPasswordResetRepository() PasswordResetRepository {
+	return &inmemPasswordResetRepository{
+		m:      map[uint]PasswordResetTokenModel{},
+		hashes: map[string]uint{},
+	}
+}
+
+func (r *inmemPasswordResetRepository) Create(_ context.Context, t *PasswordResetTokenModel) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, ok := r.hashes[t.TokenHash]; ok {
+		return ErrAlreadyExists
+	}
+	r.nextID++
+	t.ID, t.CreatedAt = r.nextID, time.Now()
+	r.m[t.ID] = *t
+	r.hashes[t.TokenHash] = t.ID
+	return nil
+}
+
+func (r *inmemPasswordResetRepository) GetByHash(_ context.Context, hash string) (PasswordResetTokenModel, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	id, ok := r.hashes[hash]
+	if !ok {
+		return PasswordResetTokenModel{}, ErrNotFound
+	}
+	return r.m[id], nil
+}
+
+func (r *inmemPasswordResetRepository) Use(_ context.Context, id uint) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	t, ok := r.m[id]
+	if !ok || t.UsedAt != nil {
+		return ErrInvalidResetToken
+	}
+	now := time.Now()
+	for id, other := range r.m {
+		if other.Username == t.Username && other.UsedAt == nil {
+			other.UsedAt = &now
+			r.m[id] = other
+		}
+	}
+	return nil
+}
+
+func (r *inmemPasswordResetRepository) Purge(_ context.Context, username string) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for id, t := range r.m {
+		if t.Username == username {
+			delete(r.m, id)
+			delete(r.hashes, t.TokenHash)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHTTPPasswordReset(t *testing.T) {
+	const newPassword = "a whole new password 2"
+	mailer := NewInmemMailer()
+	ts := newTestServer(t, withServiceOptions(
+		WithRefreshTokens(NewInmemRefreshTokenRepository(), time.Hour),
+		WithPasswordReset(NewInmemPasswordResetRepository(), mailer, "http://localhost/reset", time.Hour),
+	))
+	ts.seed(User{Username: "alice", Email: "alice@example.com", Password: testPassword, Role: "user"})
+	session := ts.login("alice", testPassword, "").RefreshToken
+
+	resp, body := ts.do("POST", "/auth/password-reset", "", requestPasswordResetRequest{Email: "alice@example.com"})
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("request status = %d: %s", resp.StatusCode, body)
+	}
+	mail := waitForMail(t, mailer, 1)[0]
+	if mail.To != "alice@example.com" {
+		t.Errorf("mailed to %s, want alice@example.com", mail.To)
+	}
+	token := mailedToken(t, mail)
+
+	for _, tc := range []struct {
+		name     string
+		path     string
+		body     interface{}
+		wantCode int
+		wantErr  string
+	}{
+		{"weak password", "/auth/password-reset/confirm", resetPasswordRequest{Token: token, Password: "short"}, http.StatusUnprocessableEntity, "validation_failed"},
+		{"unknown token", "/auth/password-reset/confirm", resetPasswordRequest{Token: "garbage", Password: newPassword}, http.StatusBadRequest, "invalid_reset_token"},
+		{"reset", "/auth/password-reset/confirm", resetPasswordRequest{Token: token, Password: newPassword}, http.StatusOK, ""},
+		{"reused token", "/auth/password-reset/confirm", resetPasswordRequest{Token: token, Password: "yet another password 3"}, http.StatusBadRequest, "invalid_reset_token"},
+		{"old password", "/auth/login", loginRequest{Username: "alice", Password: testPassword}, http.StatusUnauthorized, "invalid_credentials"},
+		{"new password", "/auth/login", loginRequest{Username: "alice", Password: newPassword}, http.StatusOK, ""},
+		{"old session", "/auth/refresh", refreshRequest{RefreshToken: session}, http.StatusUnauthorized, "invalid_refresh_token"},
+	} {
+		resp, body := ts.do("POST", tc.path, "", tc.body)
+		if resp.StatusCode != tc.wantCode {
+			t.Fatalf("%s: status = %d, want %d: %s", tc.name, resp.StatusCode, tc.wantCode, body)
+		}
+		if got := problemCode(body); got != tc.wantErr {
+			t.Errorf("%s: problem = %q, want %q", tc.name, got, tc.wantErr)
+		}
+	}
+}
+
+func TestHTTPPasswordResetAlwaysAccepted(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		email    string
+		mailer   Mailer
+		ttl      time.Duration
+		wantMail bool
+		wantLog  bool
+
+		// status of confirming the mailed token, if any
+		wantConfirm int
+	}{
+		{"known", "alice@example.com", NewInmemMailer(), time.Hour, true, false, http.StatusOK},
+		{"unknown", "bob@example.com", NewInmemMailer(), time.Hour, false, false, 0},
+		{"mailer down", "alice@example.com", failingMailer{}, time.Hour, false, true, 0},
+		{"expired", "alice@example.com", NewInmemMailer(), -time.Second, true, false, http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := newLogRecorder()
+			ts := newTestServer(t, withServiceOptions(
+				WithLogger(logs),
+				WithPasswordReset(NewInmemPasswordResetRepository(), tc.mailer, "http://localhost/reset", tc.ttl),
+			))
+			ts.seed(User{Username: "alice", Email: "alice@example.com", Password: testPassword, Role: "user"})
+
+			resp, body := ts.do("POST", "/auth/password-reset", "", requestPasswordResetRequest{Email: tc.email})
+			if resp.StatusCode != http.StatusAccepted {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusAccepted, body)
+			}
+			if tc.wantLog {
+				if line := fmt.Sprint(logs.next(t)); line != "[op RequestPasswordReset err smtp: connection refused]" {
+					t.Errorf("logged %s", line)
+				}
+			}
+			mailer, ok := tc.mailer.(*InmemMailer)
+			if !ok {
+				return
+			}
+			if !tc.wantMail {
+				time.Sleep(10 * time.Millisecond)
+				if n := len(mailer.Messages()); n != 0 {
+					t.Errorf("%d messages sent, want none", n)
+				}
+				return
+			}
+			token := mailedToken(t, waitForMail(t, mailer, 1)[0])
+			resp, body = ts.do("POST", "/auth/password-reset/confirm", "", resetPasswordRequest{Token: token, Password: "a whole new password 2"})
+			if resp.StatusCode != tc.wantConfirm {
+				t.Errorf("confirm status = %d, want %d: %s", resp.StatusCode, tc.wantConfirm, body)
+			}
+		})
+	}
+}
+
+// stallingMailer sends nothing until the context of Send is done.
+type stallingMailer struct{}
+
+func (stallingMailer) Send(ctx context.Context, _ Message) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestPasswordResetBackgroundLimits(t *testing.T) {
+	logs := newLogRecorder()
+	ts := newTestServer(t, withServiceOptions(
+		WithLogger(logs),
+		WithPasswordReset(NewInmemPasswordResetRepository(), stallingMailer{}, "http://localhost/reset", time.Hour),
+		WithBackgroundLimits(1, 200*time.Millisecond),
+	))
+	ts.seed(User{Username: "alice", Email: "alice@example.com", Password: testPassword, Role: "user"})
+
+	// The first mail holds the only worker until it times out; the second
+	// is dropped, though accepted all the same.
+	for i := 0; i < 2; i++ {
+		resp, body := ts.do("POST", "/auth/password-reset", "", requestPasswordResetRequest{Email: "alice@example.com"})
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusAccepted, body)
+		}
+	}
+	for _, want := range []string{
+		"[op RequestPasswordReset err " + ErrBackgroundBusy.Error() + "]",
+		"[op RequestPasswordReset err " + context.DeadlineExceeded.Error() + "]",
+	} {
+		if line := fmt.Sprint(logs.next(t)); line != want {
+			t.Errorf("logged %s, want %s", line, want)
+		}
+	}
+}
+
+func TestServiceCloseWaitsForMail(t *testing.T) {
+	repo := NewInmemRepository()
+	m := toModel(User{Username: "alice", Email: "alice@example.com", Role: "user"})
+	if err := repo.Create(context.Background(), &m); err != nil {
+		t.Fatal(err)
+	}
+	s := NewService(repo,
+		WithPasswordReset(NewInmemPasswordResetRepository(), stallingMailer{}, "http://localhost/reset", time.Hour),
+		WithBackgroundLimits(1, 100*time.Millisecond),
+	)
+	if err := s.RequestPasswordReset(context.Background(), "alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The mail stalls until its timeout: Close gives up before, and returns
+	// once it's over.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.Close(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Close = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := s.Close(context.Background()); err != nil {
+		t.Errorf("Close = %v, want nil once the mail timed out", err)
+	}
+}
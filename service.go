@@ -3,20 +3,41 @@ package users
 import (
 	"context"
 	"errors"
-	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/go-kit/kit/log"
 	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/postgres"
-
 )
 
 // Service is a simple CRUD interface for users
 type Service interface {
-	PostUser  (ctx context.Context, u User) error
-	GetUser   (ctx context.Context, id string) (User, error)
-	PutUser   (ctx context.Context, id string, u User) error
-	PatchUser (ctx context.Context, id string, u User) error
-	DeleteUser(ctx context.Context, id string) error
+	PostUser(ctx context.Context, u User) error
+	GetUser(ctx context.Context, username string) (User, error)
+	PutUser(ctx context.Context, username string, u User, onCreate func(User) error) error
+	PatchUser(ctx context.Context, username string, patch Patch) error
+	DeleteUser(ctx context.Context, username string) error
+	RestoreUser(ctx context.Context, username string) error
+	PurgeUser(ctx context.Context, username string) error
+	UnlockUser(ctx context.Context, username string) error
+	ListUsers(ctx context.Context, opts ListOptions) (UserPage, error)
+	Authenticate(ctx context.Context, username, password, otp string) (Token, error)
+	Refresh(ctx context.Context, refreshToken string) (Token, error)
+	Logout(ctx context.Context, refreshToken string) error
+	RevokeSessions(ctx context.Context, username string) error
+	EnrollMFA(ctx context.Context, username string) (MFAEnrollment, error)
+	ConfirmMFA(ctx context.Context, username, code string) (recoveryCodes []string, err error)
+	RegenerateRecoveryCodes(ctx context.Context, username, code string) ([]string, error)
+	RequestPasswordReset(ctx context.Context, email string) error
+	ResetPassword(ctx context.Context, token, password string) error
+	VerifyEmail(ctx context.Context, username, token string) error
+
+	// Close waits for the work left running once requests were answered,
+	// such as sending mails, until ctx is done.
+	Close(ctx context.Context) error
 }
 
 // User represents a single user
@@ -24,139 +45,909 @@ type User struct {
 	FirstName string `json:"first_name"`
 	LastName  string `json:"last_name"`
 	Username  string `json:"username"`
-	Password  string `json:"password"`
+	Password  string `json:"password,omitempty"` // write-only, never returned
 	Email     string `json:"email"`
 	Role      string `json:"role"`
+
+	// EmailVerified and PendingEmail are read-only: Email is verified by
+	// following the link mailed to it, and changes to it are pending until
+	// the new address is verified the same way, see VerifyEmail.
+	EmailVerified bool   `json:"email_verified"`
+	PendingEmail  string `json:"pending_email,omitempty"`
+
+	// Version is the version of the user read, sent as its ETag rather than
+	// in the body. When writing, a non-zero Version must match the current
+	// one, as with IfMatch, and takes precedence over the Precondition in
+	// the context.
+	Version uint64 `json:"-"`
 }
 
 // UserModel represents the model of a user
 type UserModel struct {
 	gorm.Model
-	FirstName    string
-	LastName     string
-	Username	 string
-	Email        string  `gorm:"type:varchar(100);unique_index"`
-	Password 	 string
-	Role         string  `gorm:"size:255"`
+	FirstName string
+	LastName  string
+	Username  string `gorm:"type:varchar(100);unique_index"`
+	Email     string `gorm:"type:varchar(100);unique_index"`
+	Password  string // encoded hash, see PasswordHasher
+	Role      string `gorm:"size:255"`
+
+	EmailVerified bool   `gorm:"not null;default:false"`
+	PendingEmail  string `gorm:"type:varchar(100)"`
+
+	// Version counts the writes to the user. Repositories only store an
+	// update if the version is still the one that was read, then increment
+	// it, so concurrent writes can't silently overwrite each other.
+	Version uint64 `gorm:"not null;default:1"`
+
+	MFA MFAState `gorm:"embedded;embedded_prefix:mfa_"`
 }
 
 // errors
 var (
-	ErrInconsistentIDs = errors.New("inconsistent IDs")
-	ErrAlreadyExists   = errors.New("already exists")
-	ErrNotFound        = errors.New("not found")
+	ErrInconsistentIDs = newError("inconsistent_ids", http.StatusBadRequest, "inconsistent IDs")
+	ErrAlreadyExists   = newError("already_exists", http.StatusBadRequest, "already exists")
+	ErrNotFound        = newError("not_found", http.StatusNotFound, "not found")
+
+	ErrInvalidCredentials = newError("invalid_credentials", http.StatusUnauthorized, "invalid username or password")
+	ErrNoTokenIssuer      = errors.New("no token issuer configured")
+	ErrBackgroundBusy     = errors.New("background workers busy, work dropped")
+)
+
+// Defaults of WithBackgroundLimits.
+const (
+	DefaultBackgroundWorkers = 16
+	DefaultBackgroundTimeout = 30 * time.Second
 )
 
 type service struct {
-	db gorm.DB
+	repo      UserRepository
+	hasher    PasswordHasher
+	issuer    TokenIssuer
+	retention time.Duration
+	logger    log.Logger
+
+	workers     chan struct{} // a slot per work running in the background
+	workTimeout time.Duration
+	working     sync.WaitGroup
+
+	refresh    RefreshTokenRepository
+	refreshTTL time.Duration
+
+	secrets   SecretBox
+	mfaIssuer string
+
+	resets   PasswordResetRepository
+	mailer   Mailer
+	resetURL string
+	resetTTL time.Duration
+
+	verifyMailer Mailer
+	verifyKey    []byte
+	verifyURL    string
+	verifyTTL    time.Duration
+
+	decoyOnce sync.Once
+	decoy     string // hash checked for unknown users, see Authenticate
+}
+
+// ServiceOption sets an optional parameter of the service.
+type ServiceOption func(*service)
+
+// WithPasswordHasher overrides the default argon2id PasswordHasher.
+func WithPasswordHasher(h PasswordHasher) ServiceOption {
+	return func(s *service) { s.hasher = h }
+}
+
+// WithTokenIssuer sets the TokenIssuer used by Authenticate. Without one,
+// Authenticate fails with ErrNoTokenIssuer.
+func WithTokenIssuer(i TokenIssuer) ServiceOption {
+	return func(s *service) { s.issuer = i }
 }
 
-func NewService(db gorm.DB) Service {
-	return &service{db}
+// WithLogger sets the logger of the failures the service can't return, such
+// as those of the mails it sends in the background.
+func WithLogger(logger log.Logger) ServiceOption {
+	return func(s *service) { s.logger = logger }
+}
+
+// WithBackgroundLimits bounds the work done once requests are answered, such
+// as sending the mails of password resets and email verifications: at most
+// workers run at once, each for at most timeout. Work past them is dropped,
+// and logged with ErrBackgroundBusy. By default, DefaultBackgroundWorkers run
+// for DefaultBackgroundTimeout.
+func WithBackgroundLimits(workers int, timeout time.Duration) ServiceOption {
+	return func(s *service) { s.workers, s.workTimeout = make(chan struct{}, workers), timeout }
+}
+
+// WithRetention sets how long deleted users can be restored, DefaultRetention
+// by default. Past it, they're left for RunPurgeJob to purge.
+func WithRetention(d time.Duration) ServiceOption {
+	return func(s *service) { s.retention = d }
+}
+
+// WithRefreshTokens makes Authenticate issue refresh tokens, stored in repo
+// and valid for ttl, which Refresh exchanges for new tokens. Without it, there
+// are no sessions: users log in again once their access token expires.
+func WithRefreshTokens(repo RefreshTokenRepository, ttl time.Duration) ServiceOption {
+	return func(s *service) { s.refresh, s.refreshTTL = repo, ttl }
+}
+
+// WithMFA enables two-factor authentication, sealing TOTP secrets with box.
+// Issuer names the service in authenticator apps.
+func WithMFA(box SecretBox, issuer string) ServiceOption {
+	return func(s *service) { s.secrets, s.mfaIssuer = box, issuer }
+}
+
+// WithPasswordReset lets users reset forgotten passwords: RequestPasswordReset
+// stores a token in repo, valid for ttl, and mails a link to resetURL with
+// the token as its token query parameter. The page there should post it
+// back, with the new password, to ResetPassword.
+func WithPasswordReset(repo PasswordResetRepository, mailer Mailer, resetURL string, ttl time.Duration) ServiceOption {
+	return func(s *service) {
+		s.resets, s.mailer, s.resetURL, s.resetTTL = repo, mailer, resetURL, ttl
+	}
+}
+
+// WithEmailVerification mails links to verify the email of new users, and new
+// emails of users, which only replace the current one once verified. Links
+// point to verifyURL, with username and token query parameters the page
+// there should post to VerifyEmail. Tokens are signed with key and valid for
+// ttl. Without it, emails are taken as given, and never verified.
+func WithEmailVerification(mailer Mailer, key []byte, verifyURL string, ttl time.Duration) ServiceOption {
+	return func(s *service) {
+		s.verifyMailer, s.verifyKey, s.verifyURL, s.verifyTTL = mailer, key, verifyURL, ttl
+	}
+}
+
+// NewService returns a Service that stores users in the given repository.
+func NewService(repo UserRepository, options ...ServiceOption) Service {
+	s := &service{
+		repo:      repo,
+		hasher:    NewPasswordHasher(DefaultArgon2Params),
+		retention: DefaultRetention,
+		logger:    log.NewNopLogger(),
+
+		workers:     make(chan struct{}, DefaultBackgroundWorkers),
+		workTimeout: DefaultBackgroundTimeout,
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
 }
 
-/**
- * SETUP STORE
- */
 func (s *service) PostUser(ctx context.Context, u User) error {
 	// POST = create, don't overwrite
-	s.db.Create(&User{u.FirstName, u.LastName, u.Username, u.Password, u.Email, u.Role})
-
+	m := toModel(u)
+	if err := s.setPassword(&m, u.Password); err != nil {
+		return err
+	}
+	if err := s.repo.Create(ctx, &m); err != nil {
+		return err
+	}
+	s.sendVerification(ctx, m.Username, m.Email)
 	return nil
 }
 
-func (s *service) GetUser(ctx context.Context, id string) (User, error) {
+func (s *service) GetUser(ctx context.Context, username string) (User, error) {
 	// GET = if found, return user
-	var user User
-	s.db.First(&user, id)
+	m, err := s.repo.GetByUsername(ctx, username)
+	if err != nil {
+		return User{}, err
+	}
+	return fromModel(m), nil
+}
+
+// PutUser creates or replaces the user. Whether it creates is only known once
+// the user is read, so onCreate, unless nil, vets the user created: its error
+// fails the write.
+func (s *service) PutUser(ctx context.Context, username string, u User, onCreate func(User) error) error {
+	if username != u.Username {
+		return ErrInconsistentIDs
+	}
 
-	return user, nil
+	p := preconditionFor(ctx, u.Version)
+	var verify string // email to verify once written
+	err := retryWrite(p, func() error {
+		// PUT = create or update
+		existing, err := s.repo.GetByUsername(ctx, username)
+		exists := err == nil
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if err := p.check(existing, exists); err != nil {
+			return err
+		}
+		if !exists {
+			if onCreate != nil {
+				if err := onCreate(u); err != nil {
+					return err
+				}
+			}
+			m := toModel(u)
+			if err := s.setPassword(&m, u.Password); err != nil {
+				return err
+			}
+			verify = m.Email
+			return s.repo.Create(ctx, &m)
+		}
+
+		// Replace every field, keeping only the row's identity, timestamps
+		// and version. The password is write-only, so clients can't echo it
+		// back: an empty one keeps the stored hash.
+		m := toModel(u)
+		m.Model, m.Password, m.Version = existing.Model, existing.Password, existing.Version
+		m.MFA = existing.MFA
+		verify = s.setEmail(&m, existing, u.Email)
+		if err := s.setPassword(&m, u.Password); err != nil {
+			return err
+		}
+		return s.repo.Update(ctx, &m)
+	})
+	if err != nil {
+		return err
+	}
+	s.sendVerification(ctx, username, verify)
+	return nil
 }
 
-func (s *service) PutUser(ctx context.Context, id string, u User) error {
-	// PUT = create or update
+func (s *service) PatchUser(ctx context.Context, username string, patch Patch) error {
+	p, _ := PreconditionFromContext(ctx)
+	var verify string
+	err := retryWrite(p, func() (err error) {
+		verify, err = s.patchUser(ctx, username, patch, p)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.sendVerification(ctx, username, verify)
+	return nil
+}
 
-	// find in orm
-	var user User
-	s.db.First(&user, id)
+// patchUser applies the patch, and returns the email to verify, if any.
+func (s *service) patchUser(ctx context.Context, username string, patch Patch, p Precondition) (string, error) {
+	existing, err := s.repo.GetByUsername(ctx, username)
+	if err != nil {
+		return "", err // PATCH = update existing, don't create
+	}
+	if err := p.check(existing, true); err != nil {
+		return "", err
+	}
 
-	fmt.Println("USER IN DB",user)
+	// The patch applies to the user as a whole, or not at all.
+	u, err := patch.Apply(fromModel(existing))
+	if err != nil {
+		return "", err
+	}
 
-	// if exists update
-	// else create
+	// fields that can be modified, see userFields
+	m := existing
+	m.FirstName = u.FirstName
+	m.LastName = u.LastName
+	m.Role = u.Role
+	verify := s.setEmail(&m, existing, u.Email)
+	if err := s.setPassword(&m, u.Password); err != nil {
+		return "", err
+	}
 
-	return nil
+	return verify, s.repo.Update(ctx, &m)
+}
+
+func (s *service) DeleteUser(ctx context.Context, username string) error {
+	// DELETE = if found, delete user, for the retention period, see
+	// RestoreUser
+	p, ok := PreconditionFromContext(ctx)
+	if !ok || p.isZero() {
+		if err := s.repo.Delete(ctx, username, 0); err != nil {
+			return err
+		}
+		return s.RevokeSessions(ctx, username)
+	}
+	err := retryWrite(p, func() error {
+		existing, err := s.repo.GetByUsername(ctx, username)
+		exists := err == nil
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if err := p.check(existing, exists); err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNotFound
+		}
+		return s.repo.Delete(ctx, username, existing.Version)
+	})
+	if err != nil {
+		return err
+	}
+	// Restoring the user doesn't restore its sessions: it logs in again.
+	return s.RevokeSessions(ctx, username)
 }
 
-func (s *service) PatchUser(ctx context.Context, id string, u User) error {
-	// PATCH = update existing, don't create
-	// find in orm
-	var user User
-	s.db.First(&user, id)
+func (s *service) RestoreUser(ctx context.Context, username string) error {
+	err := s.repo.Restore(ctx, username, time.Now().Add(-s.retention))
+	if errors.Is(err, ErrNotFound) {
+		return ErrNotFound.WithDetail("no user " + username + " deleted within the retention period")
+	}
+	return err
+}
+
+func (s *service) PurgeUser(ctx context.Context, username string) error {
+	if err := s.repo.Purge(ctx, username); err != nil {
+		return err
+	}
+	return purgeTokens(ctx, s.refresh, s.resets, username)
+}
+
+// UnlockUser only checks that the user exists: lockouts are kept, and ended,
+// by LockoutMiddleware.
+func (s *service) UnlockUser(ctx context.Context, username string) error {
+	_, err := s.repo.GetByUsername(ctx, username)
+	return err
+}
+
+func (s *service) ListUsers(ctx context.Context, opts ListOptions) (UserPage, error) {
+	q, err := queryFrom(opts)
+	if err != nil {
+		return UserPage{}, err
+	}
+
+	// Ask for one more user than needed to know whether there's a next page.
+	limit := q.Limit
+	q.Limit++
+	ms, err := s.repo.List(ctx, q)
+	if err != nil {
+		return UserPage{}, err
+	}
+
+	var page UserPage
+	if len(ms) > limit {
+		ms = ms[:limit]
+		page.NextCursor = encodeCursor(cursorOf(ms[limit-1], q))
+	}
+	page.Users = make([]User, len(ms))
+	for i, m := range ms {
+		page.Users[i] = fromModel(m)
+	}
+	return page, nil
+}
 
-	fmt.Println("USER IN DB",user)
+func (s *service) Authenticate(ctx context.Context, username, password, otp string) (Token, error) {
+	if s.issuer == nil {
+		return Token{}, ErrNoTokenIssuer
+	}
 
+	m, err := s.repo.GetByUsername(ctx, username)
+	if errors.Is(err, ErrNotFound) {
+		// Spend as long as for a known user, so response times don't reveal
+		// which usernames exist.
+		s.decoyOnce.Do(func() { s.decoy, _ = s.hasher.Hash("decoy") })
+		s.hasher.Verify(password, s.decoy)
+		return Token{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return Token{}, err
+	}
+
+	ok, err := s.checkPassword(ctx, m, password)
+	if err != nil {
+		return Token{}, err
+	}
+	if !ok {
+		return Token{}, ErrInvalidCredentials
+	}
+	if !m.MFA.Enabled {
+		return s.issue(ctx, m, "", []string{AMRPassword})
+	}
+
+	// The second factor is only asked for once the password is known to be
+	// right, so it can't be used to guess passwords.
+	if otp == "" {
+		return Token{}, ErrMFARequired
+	}
+	err = retryWrite(Precondition{}, func() error {
+		m, err = s.repo.GetByUsername(ctx, username)
+		if err != nil {
+			return err
+		}
+		ok, err := s.useSecondFactor(&m, otp)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrInvalidMFACode
+		}
+		// Store the code as used, failing if a concurrent login used it.
+		return s.repo.Update(ctx, &m)
+	})
+	if err != nil {
+		return Token{}, err
+	}
+	return s.issue(ctx, m, "", []string{AMRPassword, AMROTP, AMRMFA})
+}
+
+func (s *service) Refresh(ctx context.Context, refreshToken string) (Token, error) {
+	if s.issuer == nil {
+		return Token{}, ErrNoTokenIssuer
+	}
+	if s.refresh == nil {
+		return Token{}, ErrInvalidRefreshToken
+	}
+
+	rt, err := s.refresh.GetByHash(ctx, hashToken(refreshToken))
+	if errors.Is(err, ErrNotFound) {
+		return Token{}, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return Token{}, err
+	}
+	if rt.RevokedAt != nil || !time.Now().Before(rt.ExpiresAt) {
+		return Token{}, ErrInvalidRefreshToken
+	}
+	if err := s.refresh.Use(ctx, rt.ID); err != nil {
+		if errors.Is(err, ErrRefreshTokenReused) {
+			// The token was rotated already: whoever is replaying it, the
+			// client or a thief, the session can't be trusted anymore.
+			if rerr := s.refresh.RevokeFamily(ctx, rt.Family); rerr != nil {
+				return Token{}, rerr
+			}
+		}
+		return Token{}, err
+	}
+
+	// Look the user up by ID: a user taking the username of a purged one
+	// must not inherit its sessions.
+	m, err := s.repo.GetByID(ctx, rt.UserID)
+	if err == nil && m.Username != rt.Username {
+		err = ErrNotFound
+	}
+	if errors.Is(err, ErrNotFound) {
+		if rerr := s.refresh.RevokeFamily(ctx, rt.Family); rerr != nil {
+			return Token{}, rerr
+		}
+		return Token{}, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return Token{}, err
+	}
+	return s.issue(ctx, m, rt.Family, strings.Fields(rt.AMR))
+}
+
+func (s *service) Logout(ctx context.Context, refreshToken string) error {
+	if s.refresh == nil {
+		return nil
+	}
+	rt, err := s.refresh.GetByHash(ctx, hashToken(refreshToken))
+	if errors.Is(err, ErrNotFound) {
+		return nil // nothing to log out of
+	}
+	if err != nil {
+		return err
+	}
+	return s.refresh.RevokeFamily(ctx, rt.Family)
+}
+
+func (s *service) RevokeSessions(ctx context.Context, username string) error {
+	if s.refresh == nil {
+		return nil
+	}
+	return s.refresh.RevokeUser(ctx, username)
+}
+
+func (s *service) EnrollMFA(ctx context.Context, username string) (MFAEnrollment, error) {
+	if s.secrets == nil {
+		return MFAEnrollment{}, ErrNoSecretBox
+	}
+	var e MFAEnrollment
+	err := retryWrite(Precondition{}, func() error {
+		m, err := s.repo.GetByUsername(ctx, username)
+		if err != nil {
+			return err
+		}
+		if m.MFA.Enabled {
+			return ErrMFAAlreadyEnabled
+		}
+		// Enrolling again before confirming replaces the secret.
+		secret, err := newTOTPSecret()
+		if err != nil {
+			return err
+		}
+		sealed, err := s.secrets.Seal([]byte(secret))
+		if err != nil {
+			return err
+		}
+		m.MFA = MFAState{Secret: sealed}
+		if err := s.repo.Update(ctx, &m); err != nil {
+			return err
+		}
+		e = MFAEnrollment{Secret: secret, URI: totpURI(s.mfaIssuer, username, secret)}
+		return nil
+	})
+	return e, err
+}
+
+func (s *service) ConfirmMFA(ctx context.Context, username, code string) ([]string, error) {
+	return s.newRecoveryCodes(ctx, username, code, false)
+}
+
+func (s *service) RegenerateRecoveryCodes(ctx context.Context, username, code string) ([]string, error) {
+	return s.newRecoveryCodes(ctx, username, code, true)
+}
+
+// newRecoveryCodes replaces the recovery codes of a user once code, a TOTP
+// code, is verified. Confirming the enrollment, with enabled false, also
+// enables two-factor authentication.
+func (s *service) newRecoveryCodes(ctx context.Context, username, code string, enabled bool) ([]string, error) {
+	if s.secrets == nil {
+		return nil, ErrNoSecretBox
+	}
+	var codes []string
+	err := retryWrite(Precondition{}, func() error {
+		m, err := s.repo.GetByUsername(ctx, username)
+		if err != nil {
+			return err
+		}
+		switch {
+		case m.MFA.Secret == "" || (enabled && !m.MFA.Enabled):
+			return ErrMFANotEnrolled
+		case !enabled && m.MFA.Enabled:
+			return ErrMFAAlreadyEnabled
+		}
+		ok, err := s.checkTOTP(&m, code)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrInvalidMFACode
+		}
+		var hashes string
+		if codes, hashes, err = newRecoveryCodes(); err != nil {
+			return err
+		}
+		m.MFA.Enabled, m.MFA.RecoveryCodes = true, hashes
+		return s.repo.Update(ctx, &m)
+	})
+	return codes, err
+}
+
+// RequestPasswordReset always succeeds, whether the email is known or not,
+// and as fast: the reset is handled in the background, failures logged.
+func (s *service) RequestPasswordReset(ctx context.Context, email string) error {
+	if s.resets == nil {
+		return nil
+	}
+	s.background(ctx, "RequestPasswordReset", func(ctx context.Context) error {
+		return s.requestPasswordReset(ctx, email)
+	})
 	return nil
 }
 
-func (s *service) DeleteUser(ctx context.Context, id string) error {
-	// DELETE = if found, delete user
-	var user User
-	s.db.Delete(&user)
+// requestPasswordReset mails a reset link to email, if it is a user's.
+func (s *service) requestPasswordReset(ctx context.Context, email string) error {
+	m, err := s.repo.GetByEmail(ctx, email)
+	if errors.Is(err, ErrNotFound) {
+		return nil // don't reveal which emails are known
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+	t := PasswordResetTokenModel{
+		TokenHash: hashToken(token),
+		Username:  m.Username,
+		ExpiresAt: time.Now().Add(s.resetTTL),
+	}
+	if err := s.resets.Create(ctx, &t); err != nil {
+		return err
+	}
+	link, err := url.Parse(s.resetURL)
+	if err != nil {
+		return err
+	}
+	q := link.Query()
+	q.Set("token", token)
+	link.RawQuery = q.Encode()
+	return s.mailer.Send(ctx, passwordResetMessage(m.Email, link.String(), s.resetTTL))
+}
+
+func (s *service) ResetPassword(ctx context.Context, token, password string) error {
+	if s.resets == nil {
+		return ErrInvalidResetToken
+	}
+	t, err := s.resets.GetByHash(ctx, hashToken(token))
+	if errors.Is(err, ErrNotFound) {
+		return ErrInvalidResetToken
+	}
+	if err != nil {
+		return err
+	}
+	if t.UsedAt != nil || !time.Now().Before(t.ExpiresAt) {
+		return ErrInvalidResetToken
+	}
+	if err := s.resets.Use(ctx, t.ID); err != nil {
+		return err
+	}
+
+	err = retryWrite(Precondition{}, func() error {
+		m, err := s.repo.GetByUsername(ctx, t.Username)
+		if err != nil {
+			return err
+		}
+		if err := s.setPassword(&m, password); err != nil {
+			return err
+		}
+		return s.repo.Update(ctx, &m)
+	})
+	if errors.Is(err, ErrNotFound) {
+		return ErrInvalidResetToken // deleted since
+	}
+	if err != nil {
+		return err
+	}
+	// Whoever knew the old password must not stay logged in.
+	return s.RevokeSessions(ctx, t.Username)
+}
+
+func (s *service) VerifyEmail(ctx context.Context, username, token string) error {
+	if s.verifyKey == nil {
+		return ErrInvalidVerificationToken
+	}
+	c, err := parseVerificationToken(s.verifyKey, token, time.Now())
+	if err != nil {
+		return err
+	}
+	if c.Username != username {
+		return ErrInvalidVerificationToken
+	}
+	err = retryWrite(Precondition{}, func() error {
+		m, err := s.repo.GetByUsername(ctx, username)
+		if err != nil {
+			return err
+		}
+		switch {
+		case m.PendingEmail != "" && c.Email == m.PendingEmail:
+			m.Email, m.PendingEmail, m.EmailVerified = m.PendingEmail, "", true
+		case c.Email == m.Email && !m.EmailVerified:
+			m.EmailVerified = true
+		default:
+			// Already verified, or superseded by another change.
+			return ErrInvalidVerificationToken
+		}
+		return s.repo.Update(ctx, &m)
+	})
+	if errors.Is(err, ErrNotFound) {
+		return ErrInvalidVerificationToken
+	}
+	return err
+}
+
+// setEmail sets the email of m, updating existing, and returns the email to
+// verify, if any. With verification, a new email is only pending until
+// verified; without, it replaces the current one, unverified.
+func (s *service) setEmail(m *UserModel, existing UserModel, email string) (verify string) {
+	m.Email, m.EmailVerified, m.PendingEmail = existing.Email, existing.EmailVerified, existing.PendingEmail
+	switch {
+	case email == existing.Email:
+		return ""
+	case s.verifyKey == nil:
+		m.Email, m.EmailVerified = email, false
+		return ""
+	default:
+		m.PendingEmail = email
+		return email // sent again when already pending
+	}
+}
+
+// sendVerification mails a link to verify the email of username in the
+// background, unless email is empty or verification disabled. The user is
+// written already, so failures are only logged rather than failing the write.
+func (s *service) sendVerification(ctx context.Context, username, email string) {
+	if s.verifyKey == nil || email == "" {
+		return
+	}
+	s.background(ctx, "sendVerification", func(ctx context.Context) error {
+		return s.mailVerification(ctx, username, email)
+	})
+}
+
+// mailVerification mails a link to verify the email of username.
+func (s *service) mailVerification(ctx context.Context, username, email string) error {
+	token, err := signVerificationToken(s.verifyKey, verificationClaims{
+		Username:  username,
+		Email:     email,
+		ExpiresAt: time.Now().Add(s.verifyTTL).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	link, err := url.Parse(s.verifyURL)
+	if err != nil {
+		return err
+	}
+	q := link.Query()
+	q.Set("username", username)
+	q.Set("token", token)
+	link.RawQuery = q.Encode()
+	return s.verifyMailer.Send(ctx, verificationMessage(email, link.String(), s.verifyTTL))
+}
+
+// background runs f once the request is answered, logging its error. The
+// context keeps the values of ctx, such as the span, but not its deadline:
+// f gets the timeout of WithBackgroundLimits instead. Unless a worker is
+// free, f is dropped rather than left to pile up.
+func (s *service) background(ctx context.Context, op string, f func(context.Context) error) {
+	select {
+	case s.workers <- struct{}{}:
+	default:
+		s.logger.Log("op", op, "err", ErrBackgroundBusy)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.workTimeout)
+	s.working.Add(1)
+	go func() {
+		defer func() {
+			cancel()
+			<-s.workers
+			s.working.Done()
+		}()
+		if err := f(ctx); err != nil {
+			s.logger.Log("op", op, "err", err)
+		}
+	}()
+}
+
+func (s *service) Close(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.working.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// useSecondFactor checks otp, a TOTP or recovery code, against the MFA state
+// of m, and marks it used in m.
+func (s *service) useSecondFactor(m *UserModel, otp string) (bool, error) {
+	if s.secrets == nil {
+		return false, ErrNoSecretBox
+	}
+	if ok, err := s.checkTOTP(m, otp); ok || err != nil {
+		return ok, err
+	}
+	var ok bool
+	m.MFA.RecoveryCodes, ok = useRecoveryCode(m.MFA.RecoveryCodes, otp)
+	return ok, nil
+}
+
+// checkTOTP checks code against the TOTP secret of m, and marks it used in m.
+func (s *service) checkTOTP(m *UserModel, code string) (bool, error) {
+	secret, err := s.secrets.Open(m.MFA.Secret)
+	if err != nil {
+		return false, err
+	}
+	step, err := verifyTOTP(string(secret), code, time.Now(), m.MFA.LastStep)
+	if err != nil || step == 0 {
+		return false, err
+	}
+	m.MFA.LastStep = step
+	return true, nil
+}
 
+// issue returns an access token for m, authenticated with the amr methods,
+// and a refresh token of the given family, or of a new one if empty.
+func (s *service) issue(ctx context.Context, m UserModel, family string, amr []string) (Token, error) {
+	t, err := s.issuer.Issue(fromModel(m), amr...)
+	if err != nil || s.refresh == nil {
+		return t, err
+	}
+	refreshToken, family, err := newRefreshToken(family)
+	if err != nil {
+		return Token{}, err
+	}
+	rt := RefreshTokenModel{
+		TokenHash: hashToken(refreshToken),
+		Family:    family,
+		UserID:    m.ID,
+		Username:  m.Username,
+		AMR:       strings.Join(amr, " "),
+		ExpiresAt: time.Now().Add(s.refreshTTL),
+	}
+	if err := s.refresh.Create(ctx, &rt); err != nil {
+		return Token{}, err
+	}
+	t.RefreshToken = refreshToken
+	return t, nil
+}
+
+// maxWriteAttempts bounds the attempts of writes losing races, see retryWrite.
+const maxWriteAttempts = 3
+
+// retryWrite runs write, a read-modify-write of a user, again when it fails
+// with ErrPreconditionFailed because another write got in between. Writes
+// expecting versions aren't retried: they would fail the same way.
+func retryWrite(p Precondition, write func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := write()
+		if !errors.Is(err, ErrPreconditionFailed) || len(p.Versions) > 0 || attempt == maxWriteAttempts {
+			return err
+		}
+	}
+}
+
+// preconditionFor returns the Precondition of a write from ctx. The version
+// set on the user written, if any, takes precedence over its versions.
+func preconditionFor(ctx context.Context, version uint64) Precondition {
+	p, _ := PreconditionFromContext(ctx)
+	if version != 0 {
+		p.Versions = []uint64{version}
+	}
+	return p
+}
+
+// setPassword stores the hash of password in m, unless password is empty.
+func (s *service) setPassword(m *UserModel, password string) error {
+	if password == "" {
+		return nil
+	}
+	hash, err := s.hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	m.Password = hash
 	return nil
 }
 
-//func (s *inmemService) PutUser(ctx context.Context, username string, u User) error {
-//	if username != u.Username {
-//		return ErrInconsistentIDs
-//	}
-//	s.mtx.Lock()
-//	defer s.mtx.Unlock()
-//	s.m[username] = u // PUT = create or update
-//	return nil
-//}
-
-//func (s *inmemService) PatchUser(ctx context.Context, username string, u User) error {
-//	if u.Username != "" && username != u.Username {
-//		return ErrInconsistentIDs
-//	}
-//
-//	s.mtx.Lock()
-//	defer s.mtx.Unlock()
-//
-//	existing, ok := s.m[username]
-//	if !ok {
-//		return ErrNotFound // PATCH = update existing, don't create
-//	}
-//
-//	// fields that can be modified
-//	if u.FirstName != "" {
-//		existing.FirstName = u.FirstName
-//	}
-//
-//	if u.LastName != "" {
-//		existing.LastName = u.LastName
-//	}
-//
-//	if u.Email != "" {
-//		existing.Email= u.Email
-//	}
-//
-//	if u.Role!= "" {
-//		existing.Role= u.Role
-//	}
-//
-//	s.m[username] = existing
-//	return nil
-//}
-
-//func (s *inmemService) DeleteUser(ctx context.Context, username string) error {
-//	s.mtx.Lock()
-//	defer s.mtx.Unlock()
-//	if _, ok := s.m[username]; !ok {
-//		return ErrNotFound
-//	}
-//	delete(s.m, username)
-//	return nil
-//}
\ No newline at end of file
+// checkPassword reports whether password matches the one stored for m. On a
+// match with an outdated hash, the password is transparently rehashed with the
+// current parameters; failing to store the new hash doesn't fail the check.
+func (s *service) checkPassword(ctx context.Context, m UserModel, password string) (bool, error) {
+	if m.Password == "" {
+		return false, nil // no password set, can't log in
+	}
+	match, rehash, err := s.hasher.Verify(password, m.Password)
+	if err != nil || !match {
+		return false, err
+	}
+	if rehash && s.setPassword(&m, password) == nil {
+		s.repo.Update(ctx, &m)
+	}
+	return true, nil
+}
+
+// toModel copies u into a UserModel. The password is left out: it must go
+// through setPassword to be hashed.
+func toModel(u User) UserModel {
+	return UserModel{
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		Username:  u.Username,
+		Email:     u.Email,
+		Role:      u.Role,
+	}
+}
+
+// fromModel copies m into a User, leaving out the password hash.
+func fromModel(m UserModel) User {
+	return User{
+		FirstName: m.FirstName,
+		LastName:  m.LastName,
+		Username:  m.Username,
+		Email:     m.Email,
+		Role:      m.Role,
+		Version:   m.Version,
+
+		EmailVerified: m.EmailVerified,
+		PendingEmail:  m.PendingEmail,
+	}
+}
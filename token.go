@@ -0,0 +1,161 @@
+package users
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Token is an access token issued to an authenticated user, along with a
+// refresh token when the service keeps sessions, see WithRefreshTokens.
+type Token struct {
+	AccessToken  string    `json:"access_token"`
+	TokenType    string    `json:"token_type"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+}
+
+// Claims are the JWT claims of an access token. Other services only need the
+// verification key to trust them, without calling back into this service.
+type Claims struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+
+	// AMR lists the methods the user authenticated with, see RFC 8176.
+	AMR []string `json:"amr,omitempty"`
+
+	jwt.StandardClaims
+}
+
+// MultiFactor reports whether the user authenticated with a second factor.
+func (c Claims) MultiFactor() bool {
+	for _, m := range c.AMR {
+		if m == AMRMFA {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenKeys pairs a JWT signing method with the keys used to sign and verify
+// tokens. For HS256 both keys are the shared secret; for RS256 and EdDSA the
+// verification key is the public half of the signing key.
+type TokenKeys struct {
+	Method    jwt.SigningMethod
+	SignKey   interface{}
+	VerifyKey interface{}
+}
+
+// supported signing algorithms
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// ErrUnsupportedAlg is returned when loading keys for an unknown algorithm.
+var ErrUnsupportedAlg = errors.New("unsupported signing algorithm")
+
+// NewHS256Keys returns TokenKeys signing with HMAC SHA-256 and the shared
+// secret.
+func NewHS256Keys(secret []byte) TokenKeys {
+	return TokenKeys{Method: jwt.SigningMethodHS256, SignKey: secret, VerifyKey: secret}
+}
+
+// LoadTokenKeys reads the PEM encoded private key at path and returns the
+// TokenKeys for alg, which must be RS256 or EdDSA.
+func LoadTokenKeys(alg, path string) (TokenKeys, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return TokenKeys{}, err
+	}
+	switch alg {
+	case AlgRS256:
+		key, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+		if err != nil {
+			return TokenKeys{}, err
+		}
+		return TokenKeys{Method: jwt.SigningMethodRS256, SignKey: key, VerifyKey: &key.PublicKey}, nil
+	case AlgEdDSA:
+		key, err := jwt.ParseEdPrivateKeyFromPEM(pem)
+		if err != nil {
+			return TokenKeys{}, err
+		}
+		priv := key.(ed25519.PrivateKey)
+		return TokenKeys{Method: jwt.SigningMethodEdDSA, SignKey: priv, VerifyKey: priv.Public()}, nil
+	default:
+		return TokenKeys{}, fmt.Errorf("%v: %q", ErrUnsupportedAlg, alg)
+	}
+}
+
+// LoadVerifyKeys reads the PEM encoded public key at path and returns
+// TokenKeys able to verify, but not sign, tokens for alg. Useful in services
+// that consume the tokens.
+func LoadVerifyKeys(alg, path string) (TokenKeys, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return TokenKeys{}, err
+	}
+	var (
+		method jwt.SigningMethod
+		key    interface{}
+	)
+	switch alg {
+	case AlgRS256:
+		method = jwt.SigningMethodRS256
+		key, err = jwt.ParseRSAPublicKeyFromPEM(pem)
+	case AlgEdDSA:
+		method = jwt.SigningMethodEdDSA
+		key, err = jwt.ParseEdPublicKeyFromPEM(pem)
+	default:
+		return TokenKeys{}, fmt.Errorf("%v: %q", ErrUnsupportedAlg, alg)
+	}
+	if err != nil {
+		return TokenKeys{}, err
+	}
+	return TokenKeys{Method: method, VerifyKey: key}, nil
+}
+
+// TokenIssuer issues signed access tokens for authenticated users.
+type TokenIssuer interface {
+	// Issue returns a token for u, authenticated with the amr methods.
+	Issue(u User, amr ...string) (Token, error)
+}
+
+type tokenIssuer struct {
+	keys   TokenKeys
+	issuer string
+	ttl    time.Duration
+	now    func() time.Time
+}
+
+// NewTokenIssuer returns a TokenIssuer signing JWTs with keys, valid for ttl.
+func NewTokenIssuer(keys TokenKeys, issuer string, ttl time.Duration) TokenIssuer {
+	return tokenIssuer{keys: keys, issuer: issuer, ttl: ttl, now: time.Now}
+}
+
+func (i tokenIssuer) Issue(u User, amr ...string) (Token, error) {
+	now := i.now()
+	expiresAt := now.Add(i.ttl)
+	claims := Claims{
+		Username: u.Username,
+		Role:     u.Role,
+		AMR:      amr,
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    i.issuer,
+			Subject:   u.Username,
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: expiresAt.Unix(),
+		},
+	}
+	signed, err := jwt.NewWithClaims(i.keys.Method, claims).SignedString(i.keys.SignKey)
+	if err != nil {
+		return Token{}, err
+	}
+	return Token{AccessToken: signed, TokenType: "Bearer", ExpiresAt: expiresAt}, nil
+}
@@ -0,0 +1,113 @@
+package users
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func TestParseToken(t *testing.T) {
+	keys := NewHS256Keys([]byte("test secret"))
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKeys := TokenKeys{Method: jwt.SigningMethodEdDSA, SignKey: priv, VerifyKey: priv.Public()}
+
+	issue := func(keys TokenKeys, now time.Time) string {
+		t.Helper()
+		token, err := tokenIssuer{keys: keys, issuer: "test", ttl: time.Minute, now: func() time.Time { return now }}.
+			Issue(User{Username: "alice", Role: "admin"}, AMRPassword)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token.AccessToken
+	}
+
+	for _, tc := range []struct {
+		name    string
+		keys    TokenKeys
+		token   string
+		wantErr error
+	}{
+		{"hs256", keys, issue(keys, time.Now()), nil},
+		{"eddsa", edKeys, issue(edKeys, time.Now()), nil},
+		{"expired", keys, issue(keys, time.Now().Add(-time.Hour)), ErrTokenExpired},
+		{"other secret", NewHS256Keys([]byte("other secret")), issue(keys, time.Now()), ErrInvalidToken},
+		{"other alg", keys, issue(edKeys, time.Now()), ErrInvalidToken},
+		{"unsigned", keys, unsignedToken(t), ErrInvalidToken},
+		{"garbage", keys, "not.a.token", ErrInvalidToken},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			claims, err := ParseToken(tc.keys, tc.token)
+			if err != tc.wantErr {
+				t.Fatalf("err = %v, want %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if claims.Username != "alice" || claims.Role != "admin" || claims.Issuer != "test" {
+				t.Errorf("claims = %+v, want alice, admin, issued by test", claims)
+			}
+			if len(claims.AMR) != 1 || claims.AMR[0] != AMRPassword || claims.MultiFactor() {
+				t.Errorf("amr = %v, want [%s]", claims.AMR, AMRPassword)
+			}
+		})
+	}
+}
+
+// unsignedToken returns a token with the none algorithm, which must never be
+// accepted.
+func unsignedToken(t *testing.T) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodNone, Claims{Username: "alice", Role: "admin"}).
+		SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestHTTPLogin(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		request  loginRequest
+		wantCode int
+		wantErr  string
+	}{
+		{"ok", loginRequest{Username: "alice", Password: testPassword}, http.StatusOK, ""},
+		{"wrong password", loginRequest{Username: "alice", Password: "wrong"}, http.StatusUnauthorized, "invalid_credentials"},
+		{"unknown user", loginRequest{Username: "bob", Password: testPassword}, http.StatusUnauthorized, "invalid_credentials"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.seed(User{Username: "alice", Email: "alice@example.com", Password: testPassword, Role: "user"})
+			resp, body := ts.do("POST", "/auth/login", "", tc.request)
+			if resp.StatusCode != tc.wantCode {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tc.wantCode, body)
+			}
+			if got := problemCode(body); got != tc.wantErr {
+				t.Fatalf("problem = %q, want %q", got, tc.wantErr)
+			}
+			if tc.wantErr != "" {
+				return
+			}
+			var token Token
+			if err := json.Unmarshal(body, &token); err != nil {
+				t.Fatal(err)
+			}
+			claims, err := ParseToken(ts.keys, token.AccessToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.Username != "alice" || claims.Role != "user" || token.TokenType != "Bearer" {
+				t.Errorf("token %+v with claims %+v, want a bearer token for alice as user", token, claims)
+			}
+		})
+	}
+}
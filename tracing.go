@@ -0,0 +1,182 @@
+package users
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-kit/kit/endpoint"
+	grpctransport "github.com/go-kit/kit/transport/grpc"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+// instrumentationName identifies the spans of this package. Spans go to the
+// global TracerProvider and traces are propagated with the global
+// TextMapPropagator, both set up by the program.
+const instrumentationName = "github.com/AndrewSC208/user-service-go-kit"
+
+func tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// HTTPServerTrace returns the hooks tracing the requests of an HTTP server.
+// The request hook, to be used with httptransport.ServerBefore, continues the
+// trace of the caller, if any, and starts the server span; the finalizer, to
+// be used with httptransport.ServerFinalizer, ends it.
+func HTTPServerTrace() (httptransport.RequestFunc, httptransport.ServerFinalizerFunc) {
+	before := func(ctx context.Context, r *http.Request) context.Context {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(r.Header))
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		ctx, _ = tracer().Start(ctx, "HTTP "+r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("http.target", r.URL.RequestURI()),
+			),
+		)
+		return ctx
+	}
+	finalizer := func(ctx context.Context, code int, _ *http.Request) {
+		span := trace.SpanFromContext(ctx)
+		span.SetAttributes(attribute.Int("http.status_code", code))
+		if code >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(code))
+		}
+		span.End()
+	}
+	return before, finalizer
+}
+
+// HTTPClientTrace injects the trace context, e.g. a W3C traceparent header, in
+// outgoing requests. Use it as an httptransport.ClientBefore hook.
+func HTTPClientTrace() httptransport.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(r.Header))
+		return ctx
+	}
+}
+
+// GRPCServerTrace continues the trace of the caller found in the metadata of
+// incoming requests. Use it as a grpctransport.ServerBefore hook.
+func GRPCServerTrace() grpctransport.ServerRequestFunc {
+	return func(ctx context.Context, md metadata.MD) context.Context {
+		return otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+	}
+}
+
+// GRPCClientTrace injects the trace context in the metadata of outgoing
+// requests. Use it as a grpctransport.ClientBefore hook.
+func GRPCClientTrace() grpctransport.ClientRequestFunc {
+	return func(ctx context.Context, md *metadata.MD) context.Context {
+		otel.GetTextMapPropagator().Inject(ctx, metadataCarrier(*md))
+		return ctx
+	}
+}
+
+// metadataCarrier adapts gRPC metadata to propagation.TextMapCarrier.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if values := metadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) { metadata.MD(c).Set(key, value) }
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// TraceEndpoint returns an endpoint middleware wrapping each call in a span
+// of the given kind. Transport errors as well as business errors carried by
+// the response are recorded on the span.
+func TraceEndpoint(name string, kind trace.SpanKind) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			ctx, span := tracer().Start(ctx, name, trace.WithSpanKind(kind))
+			defer span.End()
+
+			response, err := next(ctx, request)
+			failure := err
+			if e, ok := response.(errorer); ok && failure == nil {
+				failure = e.error()
+			}
+			if failure != nil {
+				span.RecordError(failure)
+				span.SetStatus(codes.Error, failure.Error())
+			}
+			return response, err
+		}
+	}
+}
+
+// gorm scope keys used by TraceGorm.
+const (
+	gormContextKey = "otel:context"
+	gormSpanKey    = "otel:span"
+)
+
+// TraceGorm registers GORM callbacks wrapping every query in a span. The
+// parent span is taken from the context repositories set with their with method.
+func TraceGorm(db *gorm.DB) {
+	before := func(operation string) func(*gorm.Scope) {
+		return func(scope *gorm.Scope) {
+			ctx, ok := scope.Get(gormContextKey)
+			if !ok {
+				return
+			}
+			_, span := tracer().Start(ctx.(context.Context), "gorm."+operation,
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(
+					attribute.String("db.system", scope.Dialect().GetName()),
+					attribute.String("db.sql.table", scope.TableName()),
+				),
+			)
+			scope.Set(gormSpanKey, span)
+		}
+	}
+	after := func(scope *gorm.Scope) {
+		v, ok := scope.Get(gormSpanKey)
+		if !ok {
+			return
+		}
+		span := v.(trace.Span)
+		span.SetAttributes(attribute.String("db.statement", scope.SQL))
+		if err := scope.DB().Error; err != nil && err != gorm.ErrRecordNotFound {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+
+	cb := db.Callback()
+	cb.Create().Before("gorm:create").Register("otel:before_create", before("create"))
+	cb.Create().After("gorm:create").Register("otel:after_create", after)
+	cb.Query().Before("gorm:query").Register("otel:before_query", before("query"))
+	cb.Query().After("gorm:query").Register("otel:after_query", after)
+	cb.Update().Before("gorm:update").Register("otel:before_update", before("update"))
+	cb.Update().After("gorm:update").Register("otel:after_update", after)
+	cb.Delete().Before("gorm:delete").Register("otel:before_delete", before("delete"))
+	cb.Delete().After("gorm:delete").Register("otel:after_delete", after)
+	cb.RowQuery().Before("gorm:row_query").Register("otel:before_row_query", before("row_query"))
+	cb.RowQuery().After("gorm:row_query").Register("otel:after_row_query", after)
+}
@@ -0,0 +1,163 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jinzhu/gorm"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans records the spans of the test, ended or not, through the global
+// TracerProvider.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	global := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(global)
+		tp.Shutdown(context.Background())
+	})
+	return sr
+}
+
+// endedSpan returns the span named name among those ended.
+func endedSpan(t *testing.T, sr *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	t.Helper()
+	var names []string
+	for _, s := range sr.Ended() {
+		if s.Name() == name {
+			return s
+		}
+		names = append(names, s.Name())
+	}
+	t.Fatalf("no span %q ended, got %q", name, names)
+	return nil
+}
+
+// checkAttributes checks that span has the attributes of want, among others.
+func checkAttributes(t *testing.T, span sdktrace.ReadOnlySpan, want ...attribute.KeyValue) {
+	t.Helper()
+	got := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes() {
+		got[kv.Key] = kv.Value
+	}
+	for _, kv := range want {
+		if v, ok := got[kv.Key]; !ok || v != kv.Value {
+			t.Errorf("%s: %s = %v, want %v", span.Name(), kv.Key, v.Emit(), kv.Value.Emit())
+		}
+	}
+}
+
+func TestTraceHTTPRequest(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		err         error // of the service, on top of the users stored
+		wantCode    int
+		wantStatus  codes.Code // of the server span
+		wantFailure string     // of the endpoint span
+	}{
+		{"not found", nil, http.StatusNotFound, codes.Unset, ErrNotFound.Error()},
+		{"internal", errors.New("pq: connection refused"), http.StatusInternalServerError, codes.Error, "pq: connection refused"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sr := recordSpans(t)
+			var options []testOption
+			if tc.err != nil {
+				options = append(options, withMiddlewares(func(Service) Service { return erringService{err: tc.err} }))
+			}
+			ts := newTestServer(t, options...)
+
+			// Served in the test goroutine, so that the server span is ended
+			// once the response is.
+			req := httptest.NewRequest("GET", "/users/bob", nil)
+			req.Header.Set("Authorization", "Bearer "+ts.token("admin", "admin"))
+			rec := httptest.NewRecorder()
+			ts.Config.Handler.ServeHTTP(rec, req)
+			if rec.Code != tc.wantCode {
+				t.Fatalf("status = %d, want %d", rec.Code, tc.wantCode)
+			}
+
+			server := endedSpan(t, sr, "HTTP GET /users/{username}")
+			checkAttributes(t, server,
+				attribute.String("http.method", "GET"),
+				attribute.String("http.route", "/users/{username}"),
+				attribute.String("http.target", "/users/bob"),
+				attribute.Int("http.status_code", tc.wantCode),
+			)
+			if got := server.Status().Code; got != tc.wantStatus {
+				t.Errorf("server span status = %v, want %v", got, tc.wantStatus)
+			}
+
+			// The endpoint span is a child of the server span, failed by the
+			// error of the response.
+			ep := endedSpan(t, sr, "GetUser")
+			if ep.Parent().SpanID() != server.SpanContext().SpanID() {
+				t.Error("endpoint span isn't a child of the server span")
+			}
+			if got := ep.Status(); got.Code != codes.Error || got.Description != tc.wantFailure {
+				t.Errorf("endpoint span status = %+v, want an error %q", got, tc.wantFailure)
+			}
+		})
+	}
+}
+
+func TestTraceGorm(t *testing.T) {
+	sr := recordSpans(t)
+	sqlDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := gorm.Open("postgres", sqlDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetLogger(gorm.Logger{LogWriter: log.New(io.Discard, "", 0)})
+	TraceGorm(db)
+	repo := NewGormRepository(db)
+
+	mock.ExpectQuery(`SELECT \* FROM "user_models"`).WillReturnError(errors.New("pq: connection refused"))
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "parent")
+	if _, err := repo.GetByUsername(ctx, "alice"); err == nil {
+		t.Fatal("GetByUsername succeeded, want the error of the database")
+	}
+	parent.End()
+
+	span := endedSpan(t, sr, "gorm.query")
+	if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Error("query span isn't a child of the span of the context")
+	}
+	checkAttributes(t, span,
+		attribute.String("db.system", "postgres"),
+		attribute.String("db.sql.table", "user_models"),
+	)
+	var statement string
+	for _, kv := range span.Attributes() {
+		if kv.Key == "db.statement" {
+			statement = kv.Value.AsString()
+		}
+	}
+	if !strings.HasPrefix(statement, `SELECT * FROM "user_models"`) {
+		t.Errorf("db.statement = %q, want the query", statement)
+	}
+	if got := span.Status(); got.Code != codes.Error || got.Description != "pq: connection refused" {
+		t.Errorf("query span status = %+v, want an error", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -5,13 +5,18 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/gorilla/mux"
 	"github.com/go-kit/kit/log"
 	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
 )
 
 var (
@@ -21,20 +26,48 @@ var (
 )
 
 // MakeHTTPHandler mounts all of the service endpoints into an http.Handler.
-// Useful in a users server
-func MakeHTTPHandler(s Service, logger log.Logger) http.Handler {
+// Bearer tokens are verified with keys. Useful in a users server
+func MakeHTTPHandler(s Service, keys TokenKeys, logger log.Logger, opts ...EndpointOption) http.Handler {
 	r := mux.NewRouter()
-	e := MakeServerEndpoints(s)
+	e := MakeServerEndpoints(s, keys, opts...)
+	o := newEndpointOptions(opts)
+	traceBefore, traceFinalizer := HTTPServerTrace()
 	options := []httptransport.ServerOption{
+		httptransport.ServerBefore(traceBefore, httptransport.PopulateRequestContext, HTTPToContext(), HTTPPreconditionToContext(),
+			HTTPClientIPToContext(o.proxies), HTTPAPIKeyToContext(), HTTPRateLimitToContext()),
+		httptransport.ServerAfter(HTTPRateLimitToHeaders()),
+		httptransport.ServerFinalizer(traceFinalizer),
 		httptransport.ServerErrorLogger(logger),
 		httptransport.ServerErrorEncoder(encodeError),
 	}
 
+	// All routes but signup and login require an Authorization: Bearer header.
+	// GET /users/:id returns the ETag of the user, which PUT, PATCH and DELETE
+	// accept as If-Match to fail with 412 if someone else modified it since.
+	// PUT also accepts If-None-Match: * to only create. With
+	// WithRequiredPreconditions, writes without either fail with 428. Rate
+	// limited routes send RateLimit-* headers, and fail with 429 and
+	// Retry-After over limit.
+	//
 	// POST    /users                          adds another user
+	// GET     /users                          lists users, see decodeListUsersRequest
 	// GET     /users/:id                      retrieves the given user by username
 	// PUT     /users/:id                      post updated user information about the user
-	// PATCH   /users/:id                      partial updated user information
-	// DELETE  /users/:id                      remove the given user
+	// PATCH   /users/:id                      applies a merge patch or JSON patch to the user
+	// DELETE  /users/:id                      remove the given user, for the retention period
+	// POST    /users/:id:restore              undo the deletion of the user
+	// POST    /users/:id:purge                permanently remove the user
+	// POST    /users/:id:unlock               ends a lockout after failed logins
+	// DELETE  /users/:id/sessions             revokes every refresh token of the user
+	// POST    /users/:id/email/verify         verifies the email, or pending email, with the mailed token
+	// POST    /users/:id/mfa                  starts enrolling a TOTP second factor
+	// POST    /users/:id/mfa:confirm          enables it with a code, returns recovery codes
+	// POST    /users/:id/mfa/recovery-codes   replaces the recovery codes
+	// POST    /auth/login                     exchanges credentials for an access token
+	// POST    /auth/refresh                   exchanges a refresh token for new tokens
+	// POST    /auth/logout                    revokes the session of a refresh token
+	// POST    /auth/password-reset            mails a password reset link, always 202
+	// POST    /auth/password-reset/confirm    sets a new password with the link's token
 
 	r.Methods("POST").Path("/users").Handler(httptransport.NewServer(
 		e.PostUserEndpoint,
@@ -42,10 +75,16 @@ func MakeHTTPHandler(s Service, logger log.Logger) http.Handler {
 		encodeResponse,
 		options...,
 	))
+	r.Methods("GET").Path("/users").Handler(httptransport.NewServer(
+		e.ListUsersEndpoint,
+		decodeListUsersRequest,
+		encodeResponse,
+		options...,
+	))
 	r.Methods("GET").Path("/users/{username}").Handler(httptransport.NewServer(
 		e.GetUserEndpoint,
 		decodeGetUserRequest,
-		encodeResponse,
+		encodeGetUserResponse,
 		options...,
 	))
 	r.Methods("PUT").Path("/users/{username}").Handler(httptransport.NewServer(
@@ -66,6 +105,84 @@ func MakeHTTPHandler(s Service, logger log.Logger) http.Handler {
 		encodeResponse,
 		options...,
 	))
+	r.Methods("POST").Path("/users/{username}:restore").Handler(httptransport.NewServer(
+		e.RestoreUserEndpoint,
+		decodeRestoreUserRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/users/{username}:purge").Handler(httptransport.NewServer(
+		e.PurgeUserEndpoint,
+		decodePurgeUserRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/users/{username}:unlock").Handler(httptransport.NewServer(
+		e.UnlockUserEndpoint,
+		decodeUnlockUserRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("DELETE").Path("/users/{username}/sessions").Handler(httptransport.NewServer(
+		e.RevokeSessionsEndpoint,
+		decodeRevokeSessionsRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/users/{username}/email/verify").Handler(httptransport.NewServer(
+		e.VerifyEmailEndpoint,
+		decodeVerifyEmailRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/users/{username}/mfa").Handler(httptransport.NewServer(
+		e.EnrollMFAEndpoint,
+		decodeEnrollMFARequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/users/{username}/mfa:confirm").Handler(httptransport.NewServer(
+		e.ConfirmMFAEndpoint,
+		decodeConfirmMFARequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/users/{username}/mfa/recovery-codes").Handler(httptransport.NewServer(
+		e.RegenerateRecoveryCodesEndpoint,
+		decodeRegenerateRecoveryCodesRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/auth/login").Handler(httptransport.NewServer(
+		e.LoginEndpoint,
+		decodeLoginRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/auth/refresh").Handler(httptransport.NewServer(
+		e.RefreshEndpoint,
+		decodeRefreshRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/auth/logout").Handler(httptransport.NewServer(
+		e.LogoutEndpoint,
+		decodeLogoutRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/auth/password-reset").Handler(httptransport.NewServer(
+		e.RequestPasswordResetEndpoint,
+		decodeRequestPasswordResetRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/auth/password-reset/confirm").Handler(httptransport.NewServer(
+		e.ResetPasswordEndpoint,
+		decodeResetPasswordRequest,
+		encodeResponse,
+		options...,
+	))
 
 	return r
 }
@@ -73,7 +190,7 @@ func MakeHTTPHandler(s Service, logger log.Logger) http.Handler {
 func decodePostUserRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
 	var req postUserRequest
 	if e := json.NewDecoder(r.Body).Decode(&req.User); e != nil {
-		return nil, e
+		return nil, badRequest(e)
 	}
 	return req, nil
 }
@@ -95,27 +212,49 @@ func decodePutUserRequest(_ context.Context, r *http.Request) (request interface
 	}
 	var user User
 	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		return nil, err
+		return nil, badRequest(err)
 	}
 	return putUserRequest{
-		Username:   username,
-		User: 		user,
+		Username: username,
+		User:     user,
 	}, nil
 }
 
+// decodePatchUserRequest reads a MergePatch or a JSONPatch, depending on the
+// Content-Type. Plain JSON is taken as a merge patch.
 func decodePatchUserRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
 	vars := mux.Vars(r)
 	username, ok := vars["username"]
 	if !ok {
 		return nil, ErrBadRouting
 	}
-	var user User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		return nil, err
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var patch Patch
+	switch mediaType {
+	case MergePatchType, "application/json":
+		var p MergePatch
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			return nil, badRequest(err)
+		}
+		if err := p.check(); err != nil {
+			return nil, err
+		}
+		patch = p
+	case JSONPatchType:
+		var p JSONPatch
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			return nil, badRequest(err)
+		}
+		if err := p.check(); err != nil {
+			return nil, err
+		}
+		patch = p
+	default:
+		return nil, ErrUnsupportedMediaType.WithDetail("patches must be " + MergePatchType + " or " + JSONPatchType)
 	}
 	return patchUserRequest{
-		Username:      username,
-		User: user,
+		Username: username,
+		Patch:    patch,
 	}, nil
 }
 
@@ -128,10 +267,163 @@ func decodeDeleteUserRequest(_ context.Context, r *http.Request) (request interf
 	return deleteUserRequest{Username: username}, nil
 }
 
+func decodeRestoreUserRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	username, ok := vars["username"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return restoreUserRequest{Username: username}, nil
+}
+
+func decodePurgeUserRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	username, ok := vars["username"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return purgeUserRequest{Username: username}, nil
+}
+
+func decodeUnlockUserRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	username, ok := vars["username"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return unlockUserRequest{Username: username}, nil
+}
+
+// decodeListUsersRequest reads ListOptions from the query string:
+//
+//	role=admin             only users with the role
+//	email_domain=acme.com  only users with an email address at the domain
+//	name_prefix=jo         only users whose username, first or last name starts so
+//	sort=-created          created, updated or username, prefixed by - for descending order
+//	limit=50               page size, up to MaxListLimit
+//	cursor=...             next_cursor of the previous page
+func decodeListUsersRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	q := r.URL.Query()
+	opts := ListOptions{
+		Role:        q.Get("role"),
+		EmailDomain: q.Get("email_domain"),
+		NamePrefix:  q.Get("name_prefix"),
+		Cursor:      q.Get("cursor"),
+	}
+	sort := q.Get("sort")
+	if strings.HasPrefix(sort, "-") {
+		sort, opts.Descending = sort[1:], true
+	}
+	opts.SortBy = SortField(sort)
+	if limit := q.Get("limit"); limit != "" {
+		if opts.Limit, err = strconv.Atoi(limit); err != nil {
+			return nil, ErrInvalidListOptions.WithDetail("limit must be a number")
+		}
+	}
+	return listUsersRequest{Options: opts}, nil
+}
+
+func decodeLoginRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req loginRequest
+	if e := json.NewDecoder(r.Body).Decode(&req); e != nil {
+		return nil, badRequest(e)
+	}
+	return req, nil
+}
+
+func decodeRefreshRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req refreshRequest
+	if e := json.NewDecoder(r.Body).Decode(&req); e != nil {
+		return nil, badRequest(e)
+	}
+	return req, nil
+}
+
+func decodeLogoutRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req logoutRequest
+	if e := json.NewDecoder(r.Body).Decode(&req); e != nil {
+		return nil, badRequest(e)
+	}
+	return req, nil
+}
+
+func decodeRequestPasswordResetRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req requestPasswordResetRequest
+	if e := json.NewDecoder(r.Body).Decode(&req); e != nil {
+		return nil, badRequest(e)
+	}
+	return req, nil
+}
+
+func decodeResetPasswordRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req resetPasswordRequest
+	if e := json.NewDecoder(r.Body).Decode(&req); e != nil {
+		return nil, badRequest(e)
+	}
+	return req, nil
+}
+
+func decodeRevokeSessionsRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	username, ok := vars["username"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return revokeSessionsRequest{Username: username}, nil
+}
+
+func decodeVerifyEmailRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	username, ok := vars["username"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	req := verifyEmailRequest{Username: username}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, badRequest(err)
+	}
+	return req, nil
+}
+
+func decodeEnrollMFARequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	username, ok := vars["username"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return enrollMFARequest{Username: username}, nil
+}
+
+func decodeConfirmMFARequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	username, ok := vars["username"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	req := confirmMFARequest{Username: username}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, badRequest(err)
+	}
+	return req, nil
+}
+
+func decodeRegenerateRecoveryCodesRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	username, ok := vars["username"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	req := regenerateRecoveryCodesRequest{Username: username}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, badRequest(err)
+	}
+	return req, nil
+}
+
 func encodePostUserRequest(ctx context.Context, req *http.Request, request interface{}) error {
 	// r.Methods("POST").Path("/users")
 	req.Method, req.URL.Path = "POST", "/users"
-	return encodeRequest(ctx, req, request)
+	return encodeRequest(ctx, req, request.(postUserRequest).User)
 }
 
 func encodeGetUserRequest(ctx context.Context, req *http.Request, request interface{}) error {
@@ -146,8 +438,9 @@ func encodePutUserRequest(ctx context.Context, req *http.Request, request interf
 	// r.Methods("PUT").Path("/users/{username}")
 	r := request.(putUserRequest)
 	username := url.QueryEscape(r.Username)
-	req.Method, req.URL.Path = "PUT", "/profiles/"+username
-	return encodeRequest(ctx, req, request)
+	req.Method, req.URL.Path = "PUT", "/users/"+username
+	setIfMatch(req, r.User.Version)
+	return encodeRequest(ctx, req, r.User)
 }
 
 func encodePatchUserRequest(ctx context.Context, req *http.Request, request interface{}) error {
@@ -155,7 +448,15 @@ func encodePatchUserRequest(ctx context.Context, req *http.Request, request inte
 	r := request.(patchUserRequest)
 	username := url.QueryEscape(r.Username)
 	req.Method, req.URL.Path = "PATCH", "/users/"+username
-	return encodeRequest(ctx, req, request)
+	switch r.Patch.(type) {
+	case MergePatch:
+		req.Header.Set("Content-Type", MergePatchType)
+	case JSONPatch:
+		req.Header.Set("Content-Type", JSONPatchType)
+	default:
+		return fmt.Errorf("can't send patches of type %T", r.Patch)
+	}
+	return encodeRequest(ctx, req, r.Patch)
 }
 
 func encodeDeleteUserRequest(ctx context.Context, req *http.Request, request interface{}) error {
@@ -166,32 +467,287 @@ func encodeDeleteUserRequest(ctx context.Context, req *http.Request, request int
 	return encodeRequest(ctx, req, request)
 }
 
+func encodeRestoreUserRequest(_ context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("POST").Path("/users/{username}:restore")
+	r := request.(restoreUserRequest)
+	username := url.QueryEscape(r.Username)
+	req.Method, req.URL.Path = "POST", "/users/"+username+":restore"
+	return nil
+}
+
+func encodePurgeUserRequest(_ context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("POST").Path("/users/{username}:purge")
+	r := request.(purgeUserRequest)
+	username := url.QueryEscape(r.Username)
+	req.Method, req.URL.Path = "POST", "/users/"+username+":purge"
+	return nil
+}
+
+func encodeUnlockUserRequest(_ context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("POST").Path("/users/{username}:unlock")
+	r := request.(unlockUserRequest)
+	username := url.QueryEscape(r.Username)
+	req.Method, req.URL.Path = "POST", "/users/"+username+":unlock"
+	return nil
+}
+
+func encodeListUsersRequest(_ context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("GET").Path("/users")
+	opts := request.(listUsersRequest).Options
+	q := url.Values{}
+	for k, v := range map[string]string{
+		"role":         opts.Role,
+		"email_domain": opts.EmailDomain,
+		"name_prefix":  opts.NamePrefix,
+		"cursor":       opts.Cursor,
+	} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	if opts.SortBy != "" {
+		sort := string(opts.SortBy)
+		if opts.Descending {
+			sort = "-" + sort
+		}
+		q.Set("sort", sort)
+	}
+	if opts.Limit != 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	req.Method, req.URL.Path, req.URL.RawQuery = "GET", "/users", q.Encode()
+	return nil
+}
+
+func encodeLoginRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("POST").Path("/auth/login")
+	req.Method, req.URL.Path = "POST", "/auth/login"
+	return encodeRequest(ctx, req, request)
+}
+
+func encodeRefreshRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("POST").Path("/auth/refresh")
+	req.Method, req.URL.Path = "POST", "/auth/refresh"
+	return encodeRequest(ctx, req, request)
+}
+
+func encodeLogoutRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("POST").Path("/auth/logout")
+	req.Method, req.URL.Path = "POST", "/auth/logout"
+	return encodeRequest(ctx, req, request)
+}
+
+func encodeRequestPasswordResetRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("POST").Path("/auth/password-reset")
+	req.Method, req.URL.Path = "POST", "/auth/password-reset"
+	return encodeRequest(ctx, req, request)
+}
+
+func encodeResetPasswordRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("POST").Path("/auth/password-reset/confirm")
+	req.Method, req.URL.Path = "POST", "/auth/password-reset/confirm"
+	return encodeRequest(ctx, req, request)
+}
+
+func encodeRevokeSessionsRequest(_ context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("DELETE").Path("/users/{username}/sessions")
+	r := request.(revokeSessionsRequest)
+	username := url.QueryEscape(r.Username)
+	req.Method, req.URL.Path = "DELETE", "/users/"+username+"/sessions"
+	return nil
+}
+
+func encodeVerifyEmailRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("POST").Path("/users/{username}/email/verify")
+	r := request.(verifyEmailRequest)
+	username := url.QueryEscape(r.Username)
+	req.Method, req.URL.Path = "POST", "/users/"+username+"/email/verify"
+	return encodeRequest(ctx, req, request)
+}
+
+func encodeEnrollMFARequest(_ context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("POST").Path("/users/{username}/mfa")
+	r := request.(enrollMFARequest)
+	username := url.QueryEscape(r.Username)
+	req.Method, req.URL.Path = "POST", "/users/"+username+"/mfa"
+	return nil
+}
+
+func encodeConfirmMFARequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("POST").Path("/users/{username}/mfa:confirm")
+	r := request.(confirmMFARequest)
+	username := url.QueryEscape(r.Username)
+	req.Method, req.URL.Path = "POST", "/users/"+username+"/mfa:confirm"
+	return encodeRequest(ctx, req, request)
+}
+
+func encodeRegenerateRecoveryCodesRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("POST").Path("/users/{username}/mfa/recovery-codes")
+	r := request.(regenerateRecoveryCodesRequest)
+	username := url.QueryEscape(r.Username)
+	req.Method, req.URL.Path = "POST", "/users/"+username+"/mfa/recovery-codes"
+	return encodeRequest(ctx, req, request)
+}
+
 func decodePostUserResponse(_ context.Context, resp *http.Response) (interface{}, error) {
 	var response postUserResponse
+	if response.Err = decodeProblem(resp); response.Err != nil {
+		return response, nil
+	}
 	err := json.NewDecoder(resp.Body).Decode(&response)
 	return response, err
 }
 
 func decodeGetUserResponse(_ context.Context, resp *http.Response) (interface{}, error) {
 	var response getUserResponse
+	if response.Err = decodeProblem(resp); response.Err != nil {
+		return response, nil
+	}
 	err := json.NewDecoder(resp.Body).Decode(&response)
+	response.User.Version, _ = parseETag(resp.Header.Get("ETag"))
 	return response, err
 }
 
 func decodePutUserResponse(_ context.Context, resp *http.Response) (interface{}, error) {
 	var response putUserResponse
+	if response.Err = decodeProblem(resp); response.Err != nil {
+		return response, nil
+	}
 	err := json.NewDecoder(resp.Body).Decode(&response)
 	return response, err
 }
 
 func decodePatchUserResponse(_ context.Context, resp *http.Response) (interface{}, error) {
 	var response patchUserResponse
+	if response.Err = decodeProblem(resp); response.Err != nil {
+		return response, nil
+	}
 	err := json.NewDecoder(resp.Body).Decode(&response)
 	return response, err
 }
 
 func decodeDeleteUserResponse(_ context.Context, resp *http.Response) (interface{}, error) {
 	var response deleteUserResponse
+	if response.Err = decodeProblem(resp); response.Err != nil {
+		return response, nil
+	}
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeRestoreUserResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response restoreUserResponse
+	if response.Err = decodeProblem(resp); response.Err != nil {
+		return response, nil
+	}
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodePurgeUserResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response purgeUserResponse
+	if response.Err = decodeProblem(resp); response.Err != nil {
+		return response, nil
+	}
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeUnlockUserResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response unlockUserResponse
+	if response.Err = decodeProblem(resp); response.Err != nil {
+		return response, nil
+	}
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeListUsersResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response listUsersResponse
+	if response.Err = decodeProblem(resp); response.Err != nil {
+		return response, nil
+	}
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeLoginResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response loginResponse
+	if response.Err = decodeProblem(resp); response.Err != nil {
+		return response, nil
+	}
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeRefreshResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response refreshResponse
+	if response.Err = decodeProblem(resp); response.Err != nil {
+		return response, nil
+	}
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeLogoutResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response logoutResponse
+	if response.Err = decodeProblem(resp); response.Err != nil {
+		return response, nil
+	}
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeRequestPasswordResetResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response requestPasswordResetResponse
+	if response.Err = decodeProblem(resp); response.Err != nil {
+		return response, nil
+	}
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeResetPasswordResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response resetPasswordResponse
+	if response.Err = decodeProblem(resp); response.Err != nil {
+		return response, nil
+	}
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeVerifyEmailResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response verifyEmailResponse
+	if response.Err = decodeProblem(resp); response.Err != nil {
+		return response, nil
+	}
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeRevokeSessionsResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response revokeSessionsResponse
+	if response.Err = decodeProblem(resp); response.Err != nil {
+		return response, nil
+	}
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeEnrollMFAResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response enrollMFAResponse
+	if response.Err = decodeProblem(resp); response.Err != nil {
+		return response, nil
+	}
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeRecoveryCodesResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response recoveryCodesResponse
+	if response.Err = decodeProblem(resp); response.Err != nil {
+		return response, nil
+	}
 	err := json.NewDecoder(resp.Body).Decode(&response)
 	return response, err
 }
@@ -216,9 +772,28 @@ func encodeResponse(ctx context.Context, w http.ResponseWriter, response interfa
 		return nil
 	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if sc, ok := response.(httptransport.StatusCoder); ok {
+		w.WriteHeader(sc.StatusCode())
+	}
 	return json.NewEncoder(w).Encode(response)
 }
 
+// encodeGetUserResponse is encodeResponse, adding the ETag of the user.
+func encodeGetUserResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if r, ok := response.(getUserResponse); ok && r.Err == nil {
+		w.Header().Set("ETag", ETag(r.User.Version))
+	}
+	return encodeResponse(ctx, w, response)
+}
+
+// setIfMatch sends the version of a user being written as If-Match, see
+// PreconditionToHTTP.
+func setIfMatch(req *http.Request, version uint64) {
+	if version != 0 {
+		req.Header.Set("If-Match", ETag(version))
+	}
+}
+
 // encodeRequest likewise JSON-encodes the request to the HTTP request body.
 // Don't use it directly as a transport/http.Client EncodeRequestFunc:
 // profilesvc endpoints require mutating the HTTP method and request path.
@@ -232,24 +807,32 @@ func encodeRequest(_ context.Context, req *http.Request, request interface{}) er
 	return nil
 }
 
-func encodeError(_ context.Context, err error, w http.ResponseWriter) {
+// encodeError renders err as an RFC 7807 application/problem+json document.
+// Errors that aren't an *Error are reported as internal errors, without
+// details.
+func encodeError(ctx context.Context, err error, w http.ResponseWriter) {
 	if err == nil {
 		panic("encodeError with nil error")
 	}
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(codeFrom(err))
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"error": err.Error(),
-	})
+	e := *errorFrom(err)
+	if uri, ok := ctx.Value(httptransport.ContextKeyRequestURI).(string); ok {
+		e.Instance = uri
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	if errors.Is(err, ErrUnsupportedMediaType) {
+		w.Header().Set("Accept-Patch", MergePatchType+", "+JSONPatchType)
+	}
+	if e.Status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="users"`)
+	}
+	if d, ok := e.RetryAfter(); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(d/time.Second)))
+	}
+	setRateLimitHeaders(ctx, w.Header())
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(&e)
 }
 
 func codeFrom(err error) int {
-	switch err {
-	case ErrNotFound:
-		return http.StatusNotFound
-	case ErrAlreadyExists, ErrInconsistentIDs:
-		return http.StatusBadRequest
-	default:
-		return http.StatusInternalServerError
-	}
-}
\ No newline at end of file
+	return errorFrom(err).Status
+}
@@ -0,0 +1,919 @@
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	grpctransport "github.com/go-kit/kit/transport/grpc"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/AndrewSC208/user-service-go-kit/pb"
+)
+
+type grpcServer struct {
+	pb.UnimplementedUsersServer
+
+	postUser                grpctransport.Handler
+	getUser                 grpctransport.Handler
+	putUser                 grpctransport.Handler
+	patchUser               grpctransport.Handler
+	deleteUser              grpctransport.Handler
+	restoreUser             grpctransport.Handler
+	purgeUser               grpctransport.Handler
+	unlockUser              grpctransport.Handler
+	listUsers               grpctransport.Handler
+	login                   grpctransport.Handler
+	refresh                 grpctransport.Handler
+	logout                  grpctransport.Handler
+	revokeSessions          grpctransport.Handler
+	enrollMFA               grpctransport.Handler
+	confirmMFA              grpctransport.Handler
+	regenerateRecoveryCodes grpctransport.Handler
+	requestPasswordReset    grpctransport.Handler
+	resetPassword           grpctransport.Handler
+	verifyEmail             grpctransport.Handler
+}
+
+// MakeGRPCServer makes the service endpoints available as a gRPC UsersServer.
+// Bearer tokens are read from the authorization metadata and verified with
+// keys, as in MakeHTTPHandler. Useful in a users server.
+func MakeGRPCServer(s Service, keys TokenKeys, logger log.Logger, opts ...EndpointOption) pb.UsersServer {
+	e := MakeServerEndpoints(s, keys, opts...)
+	o := newEndpointOptions(opts)
+	options := []grpctransport.ServerOption{
+		grpctransport.ServerBefore(GRPCServerTrace(), GRPCToContext(), GRPCPreconditionToContext(), GRPCClientIPToContext(o.proxies), GRPCAPIKeyToContext()),
+		grpctransport.ServerErrorLogger(logger),
+	}
+
+	return &grpcServer{
+		postUser:                grpctransport.NewServer(e.PostUserEndpoint, decodeGRPCPostUserRequest, encodeGRPCPostUserResponse, options...),
+		getUser:                 grpctransport.NewServer(e.GetUserEndpoint, decodeGRPCGetUserRequest, encodeGRPCGetUserResponse, options...),
+		putUser:                 grpctransport.NewServer(e.PutUserEndpoint, decodeGRPCPutUserRequest, encodeGRPCPutUserResponse, options...),
+		patchUser:               grpctransport.NewServer(e.PatchUserEndpoint, decodeGRPCPatchUserRequest, encodeGRPCPatchUserResponse, options...),
+		deleteUser:              grpctransport.NewServer(e.DeleteUserEndpoint, decodeGRPCDeleteUserRequest, encodeGRPCDeleteUserResponse, options...),
+		restoreUser:             grpctransport.NewServer(e.RestoreUserEndpoint, decodeGRPCRestoreUserRequest, encodeGRPCRestoreUserResponse, options...),
+		purgeUser:               grpctransport.NewServer(e.PurgeUserEndpoint, decodeGRPCPurgeUserRequest, encodeGRPCPurgeUserResponse, options...),
+		unlockUser:              grpctransport.NewServer(e.UnlockUserEndpoint, decodeGRPCUnlockUserRequest, encodeGRPCUnlockUserResponse, options...),
+		listUsers:               grpctransport.NewServer(e.ListUsersEndpoint, decodeGRPCListUsersRequest, encodeGRPCListUsersResponse, options...),
+		login:                   grpctransport.NewServer(e.LoginEndpoint, decodeGRPCLoginRequest, encodeGRPCLoginResponse, options...),
+		refresh:                 grpctransport.NewServer(e.RefreshEndpoint, decodeGRPCRefreshRequest, encodeGRPCRefreshResponse, options...),
+		logout:                  grpctransport.NewServer(e.LogoutEndpoint, decodeGRPCLogoutRequest, encodeGRPCLogoutResponse, options...),
+		revokeSessions:          grpctransport.NewServer(e.RevokeSessionsEndpoint, decodeGRPCRevokeSessionsRequest, encodeGRPCRevokeSessionsResponse, options...),
+		enrollMFA:               grpctransport.NewServer(e.EnrollMFAEndpoint, decodeGRPCEnrollMFARequest, encodeGRPCEnrollMFAResponse, options...),
+		confirmMFA:              grpctransport.NewServer(e.ConfirmMFAEndpoint, decodeGRPCConfirmMFARequest, encodeGRPCRecoveryCodesResponse, options...),
+		regenerateRecoveryCodes: grpctransport.NewServer(e.RegenerateRecoveryCodesEndpoint, decodeGRPCRegenerateRecoveryCodesRequest, encodeGRPCRecoveryCodesResponse, options...),
+		requestPasswordReset:    grpctransport.NewServer(e.RequestPasswordResetEndpoint, decodeGRPCRequestPasswordResetRequest, encodeGRPCRequestPasswordResetResponse, options...),
+		resetPassword:           grpctransport.NewServer(e.ResetPasswordEndpoint, decodeGRPCResetPasswordRequest, encodeGRPCResetPasswordResponse, options...),
+		verifyEmail:             grpctransport.NewServer(e.VerifyEmailEndpoint, decodeGRPCVerifyEmailRequest, encodeGRPCVerifyEmailResponse, options...),
+	}
+}
+
+func (s *grpcServer) PostUser(ctx context.Context, req *pb.PostUserRequest) (*pb.PostUserReply, error) {
+	_, rep, err := s.postUser.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.PostUserReply), nil
+}
+
+func (s *grpcServer) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.GetUserReply, error) {
+	_, rep, err := s.getUser.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.GetUserReply), nil
+}
+
+func (s *grpcServer) PutUser(ctx context.Context, req *pb.PutUserRequest) (*pb.PutUserReply, error) {
+	_, rep, err := s.putUser.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.PutUserReply), nil
+}
+
+func (s *grpcServer) PatchUser(ctx context.Context, req *pb.PatchUserRequest) (*pb.PatchUserReply, error) {
+	_, rep, err := s.patchUser.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.PatchUserReply), nil
+}
+
+func (s *grpcServer) DeleteUser(ctx context.Context, req *pb.DeleteUserRequest) (*pb.DeleteUserReply, error) {
+	_, rep, err := s.deleteUser.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.DeleteUserReply), nil
+}
+
+func (s *grpcServer) RestoreUser(ctx context.Context, req *pb.RestoreUserRequest) (*pb.RestoreUserReply, error) {
+	_, rep, err := s.restoreUser.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.RestoreUserReply), nil
+}
+
+func (s *grpcServer) PurgeUser(ctx context.Context, req *pb.PurgeUserRequest) (*pb.PurgeUserReply, error) {
+	_, rep, err := s.purgeUser.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.PurgeUserReply), nil
+}
+
+func (s *grpcServer) UnlockUser(ctx context.Context, req *pb.UnlockUserRequest) (*pb.UnlockUserReply, error) {
+	_, rep, err := s.unlockUser.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.UnlockUserReply), nil
+}
+
+func (s *grpcServer) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersReply, error) {
+	_, rep, err := s.listUsers.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.ListUsersReply), nil
+}
+
+func (s *grpcServer) Login(ctx context.Context, req *pb.LoginRequest) (*pb.LoginReply, error) {
+	_, rep, err := s.login.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.LoginReply), nil
+}
+
+func (s *grpcServer) Refresh(ctx context.Context, req *pb.RefreshRequest) (*pb.LoginReply, error) {
+	_, rep, err := s.refresh.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.LoginReply), nil
+}
+
+func (s *grpcServer) Logout(ctx context.Context, req *pb.LogoutRequest) (*pb.LogoutReply, error) {
+	_, rep, err := s.logout.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.LogoutReply), nil
+}
+
+func (s *grpcServer) RevokeSessions(ctx context.Context, req *pb.RevokeSessionsRequest) (*pb.RevokeSessionsReply, error) {
+	_, rep, err := s.revokeSessions.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.RevokeSessionsReply), nil
+}
+
+func (s *grpcServer) EnrollMFA(ctx context.Context, req *pb.EnrollMFARequest) (*pb.EnrollMFAReply, error) {
+	_, rep, err := s.enrollMFA.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.EnrollMFAReply), nil
+}
+
+func (s *grpcServer) ConfirmMFA(ctx context.Context, req *pb.ConfirmMFARequest) (*pb.RecoveryCodesReply, error) {
+	_, rep, err := s.confirmMFA.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.RecoveryCodesReply), nil
+}
+
+func (s *grpcServer) RegenerateRecoveryCodes(ctx context.Context, req *pb.RegenerateRecoveryCodesRequest) (*pb.RecoveryCodesReply, error) {
+	_, rep, err := s.regenerateRecoveryCodes.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.RecoveryCodesReply), nil
+}
+
+func (s *grpcServer) RequestPasswordReset(ctx context.Context, req *pb.RequestPasswordResetRequest) (*pb.RequestPasswordResetReply, error) {
+	_, rep, err := s.requestPasswordReset.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.RequestPasswordResetReply), nil
+}
+
+func (s *grpcServer) ResetPassword(ctx context.Context, req *pb.ResetPasswordRequest) (*pb.ResetPasswordReply, error) {
+	_, rep, err := s.resetPassword.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.ResetPasswordReply), nil
+}
+
+func (s *grpcServer) VerifyEmail(ctx context.Context, req *pb.VerifyEmailRequest) (*pb.VerifyEmailReply, error) {
+	_, rep, err := s.verifyEmail.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.VerifyEmailReply), nil
+}
+
+// MakeGRPCClientEndpoints returns an Endpoints struct where each endpoint
+// invokes the corresponding method on the remote instance, via a gRPC
+// connection. Errors are turned back into the service's errors, so the
+// Endpoints behave like the HTTP ones of MakeClientEndpoints.
+func MakeGRPCClientEndpoints(conn *grpc.ClientConn) Endpoints {
+	const service = "users.Users"
+	options := []grpctransport.ClientOption{
+		grpctransport.ClientBefore(ContextToGRPC(), PreconditionToGRPC(), GRPCClientTrace()),
+	}
+	newClient := func(method string, enc grpctransport.EncodeRequestFunc, dec grpctransport.DecodeResponseFunc, reply interface{}) endpoint.Endpoint {
+		e := grpctransport.NewClient(conn, service, method, enc, dec, reply, options...).Endpoint()
+		return TraceEndpoint(method, trace.SpanKindClient)(fromGRPCErrors(e))
+	}
+
+	return Endpoints{
+		PostUserEndpoint:                newClient("PostUser", encodeGRPCPostUserRequest, decodeGRPCPostUserResponse, &pb.PostUserReply{}),
+		GetUserEndpoint:                 newClient("GetUser", encodeGRPCGetUserRequest, decodeGRPCGetUserResponse, &pb.GetUserReply{}),
+		PutUserEndpoint:                 newClient("PutUser", encodeGRPCPutUserRequest, decodeGRPCPutUserResponse, &pb.PutUserReply{}),
+		PatchUserEndpoint:               newClient("PatchUser", encodeGRPCPatchUserRequest, decodeGRPCPatchUserResponse, &pb.PatchUserReply{}),
+		DeleteUserEndpoint:              newClient("DeleteUser", encodeGRPCDeleteUserRequest, decodeGRPCDeleteUserResponse, &pb.DeleteUserReply{}),
+		RestoreUserEndpoint:             newClient("RestoreUser", encodeGRPCRestoreUserRequest, decodeGRPCRestoreUserResponse, &pb.RestoreUserReply{}),
+		PurgeUserEndpoint:               newClient("PurgeUser", encodeGRPCPurgeUserRequest, decodeGRPCPurgeUserResponse, &pb.PurgeUserReply{}),
+		UnlockUserEndpoint:              newClient("UnlockUser", encodeGRPCUnlockUserRequest, decodeGRPCUnlockUserResponse, &pb.UnlockUserReply{}),
+		ListUsersEndpoint:               newClient("ListUsers", encodeGRPCListUsersRequest, decodeGRPCListUsersResponse, &pb.ListUsersReply{}),
+		LoginEndpoint:                   newClient("Login", encodeGRPCLoginRequest, decodeGRPCLoginResponse, &pb.LoginReply{}),
+		RefreshEndpoint:                 newClient("Refresh", encodeGRPCRefreshRequest, decodeGRPCRefreshResponse, &pb.LoginReply{}),
+		LogoutEndpoint:                  newClient("Logout", encodeGRPCLogoutRequest, decodeGRPCLogoutResponse, &pb.LogoutReply{}),
+		RevokeSessionsEndpoint:          newClient("RevokeSessions", encodeGRPCRevokeSessionsRequest, decodeGRPCRevokeSessionsResponse, &pb.RevokeSessionsReply{}),
+		EnrollMFAEndpoint:               newClient("EnrollMFA", encodeGRPCEnrollMFARequest, decodeGRPCEnrollMFAResponse, &pb.EnrollMFAReply{}),
+		ConfirmMFAEndpoint:              newClient("ConfirmMFA", encodeGRPCConfirmMFARequest, decodeGRPCRecoveryCodesResponse, &pb.RecoveryCodesReply{}),
+		RegenerateRecoveryCodesEndpoint: newClient("RegenerateRecoveryCodes", encodeGRPCRegenerateRecoveryCodesRequest, decodeGRPCRecoveryCodesResponse, &pb.RecoveryCodesReply{}),
+		RequestPasswordResetEndpoint:    newClient("RequestPasswordReset", encodeGRPCRequestPasswordResetRequest, decodeGRPCRequestPasswordResetResponse, &pb.RequestPasswordResetReply{}),
+		ResetPasswordEndpoint:           newClient("ResetPassword", encodeGRPCResetPasswordRequest, decodeGRPCResetPasswordResponse, &pb.ResetPasswordReply{}),
+		VerifyEmailEndpoint:             newClient("VerifyEmail", encodeGRPCVerifyEmailRequest, decodeGRPCVerifyEmailResponse, &pb.VerifyEmailReply{}),
+	}
+}
+
+// GRPCToContext moves a bearer token from the authorization metadata to the
+// context. Use it as a grpctransport.ServerBefore hook.
+func GRPCToContext() grpctransport.ServerRequestFunc {
+	return func(ctx context.Context, md metadata.MD) context.Context {
+		values := md.Get("authorization")
+		if len(values) == 0 || len(values[0]) < 7 || !strings.EqualFold(values[0][:7], "Bearer ") {
+			return ctx
+		}
+		return ContextWithToken(ctx, values[0][7:])
+	}
+}
+
+// ContextToGRPC moves a bearer token from the context to the authorization
+// metadata. Use it as a grpctransport.ClientBefore hook.
+func ContextToGRPC() grpctransport.ClientRequestFunc {
+	return func(ctx context.Context, md *metadata.MD) context.Context {
+		if token, ok := ctx.Value(bearerTokenContextKey).(string); ok {
+			(*md)["authorization"] = []string{"Bearer " + token}
+		}
+		return ctx
+	}
+}
+
+// grpcCodes maps the HTTP statuses of the service's errors to gRPC status
+// codes.
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:           codes.InvalidArgument,
+	http.StatusUnprocessableEntity:  codes.InvalidArgument,
+	http.StatusUnauthorized:         codes.Unauthenticated,
+	http.StatusForbidden:            codes.PermissionDenied,
+	http.StatusNotFound:             codes.NotFound,
+	http.StatusConflict:             codes.FailedPrecondition,
+	http.StatusPreconditionFailed:   codes.FailedPrecondition,
+	http.StatusPreconditionRequired: codes.FailedPrecondition,
+	http.StatusUnsupportedMediaType: codes.InvalidArgument,
+	http.StatusTooManyRequests:      codes.ResourceExhausted,
+}
+
+// errorDomain is the domain of the ErrorInfo details of gRPC errors.
+const errorDomain = "users"
+
+// grpcError turns err into a gRPC status error. The code of the *Error travels
+// as the reason of an ErrorInfo detail, and the fields of a ValidationError as
+// a BadRequest one, and when to retry as a RetryInfo one, so clients can decode
+// them back.
+func grpcError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	e := errorFrom(err)
+	code, ok := grpcCodes[e.Status]
+	if !ok {
+		code = codes.Internal
+	}
+	if errors.Is(e, ErrAlreadyExists) {
+		code = codes.AlreadyExists
+	}
+	st := status.New(code, e.Error())
+	if d, derr := st.WithDetails(&errdetails.ErrorInfo{Reason: e.Code, Domain: errorDomain}); derr == nil {
+		st = d
+	}
+	if after, ok := e.RetryAfter(); ok {
+		if d, derr := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(after)}); derr == nil {
+			st = d
+		}
+	}
+	var ve ValidationError
+	if errors.As(err, &ve) {
+		br := &errdetails.BadRequest{}
+		for _, f := range ve.Fields {
+			br.FieldViolations = append(br.FieldViolations, &errdetails.BadRequest_FieldViolation{
+				Field:       f.Field,
+				Description: f.Message,
+			})
+		}
+		if d, derr := st.WithDetails(br); derr == nil {
+			st = d
+		}
+	}
+	return st.Err()
+}
+
+// fromGRPCErrors is a client endpoint middleware turning gRPC status errors
+// back into the service's errors, like decodeProblem does for HTTP.
+func fromGRPCErrors(next endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		response, err := next(ctx, request)
+		if err == nil {
+			return response, nil
+		}
+		st, ok := status.FromError(err)
+		if !ok {
+			return nil, err
+		}
+		var (
+			reason     string
+			ve         ValidationError
+			retryAfter *durationpb.Duration
+		)
+		for _, d := range st.Details() {
+			switch d := d.(type) {
+			case *errdetails.ErrorInfo:
+				if d.Domain == errorDomain {
+					reason = d.Reason
+				}
+			case *errdetails.BadRequest:
+				for _, v := range d.FieldViolations {
+					ve.Fields = append(ve.Fields, FieldError{Field: v.Field, Message: v.Description})
+				}
+			case *errdetails.RetryInfo:
+				retryAfter = d.RetryDelay
+			}
+		}
+		if reason == ErrValidation.Code {
+			return nil, ve
+		}
+		if e, ok := errorsByCode[reason]; ok {
+			e = e.WithDetail(st.Message())
+			if retryAfter != nil {
+				e = e.WithRetryAfter(retryAfter.AsDuration())
+			}
+			return nil, e
+		}
+		return nil, err
+	}
+}
+
+func toPBUser(u User) *pb.User {
+	return &pb.User{
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		Username:  u.Username,
+		Password:  u.Password,
+		Email:     u.Email,
+		Role:      u.Role,
+		Version:   u.Version,
+
+		EmailVerified: u.EmailVerified,
+		PendingEmail:  u.PendingEmail,
+	}
+}
+
+func fromPBUser(u *pb.User) User {
+	if u == nil {
+		return User{}
+	}
+	return User{
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		Username:  u.Username,
+		Password:  u.Password,
+		Email:     u.Email,
+		Role:      u.Role,
+		Version:   u.Version,
+
+		EmailVerified: u.EmailVerified,
+		PendingEmail:  u.PendingEmail,
+	}
+}
+
+func toPBToken(t Token) *pb.LoginReply {
+	return &pb.LoginReply{
+		AccessToken:  t.AccessToken,
+		TokenType:    t.TokenType,
+		ExpiresAt:    t.ExpiresAt.Unix(),
+		RefreshToken: t.RefreshToken,
+	}
+}
+
+func fromPBToken(reply *pb.LoginReply) Token {
+	return Token{
+		AccessToken:  reply.AccessToken,
+		TokenType:    reply.TokenType,
+		ExpiresAt:    time.Unix(reply.ExpiresAt, 0),
+		RefreshToken: reply.RefreshToken,
+	}
+}
+
+// Business errors travel in the responses of the endpoints. The encoders
+// below return them as errors, which grpcError turns into status codes.
+
+func decodeGRPCPostUserRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.PostUserRequest)
+	return postUserRequest{User: fromPBUser(req.User)}, nil
+}
+
+func encodeGRPCPostUserResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(postUserResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return &pb.PostUserReply{}, nil
+}
+
+func decodeGRPCGetUserRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.GetUserRequest)
+	return getUserRequest{Username: req.Username}, nil
+}
+
+func encodeGRPCGetUserResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(getUserResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return &pb.GetUserReply{User: toPBUser(resp.User)}, nil
+}
+
+func decodeGRPCPutUserRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.PutUserRequest)
+	return putUserRequest{Username: req.Username, User: fromPBUser(req.User)}, nil
+}
+
+func encodeGRPCPutUserResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(putUserResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return &pb.PutUserReply{}, nil
+}
+
+func decodeGRPCPatchUserRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.PatchUserRequest)
+	var patch Patch
+	switch p := req.Patch.(type) {
+	case *pb.PatchUserRequest_MergePatch:
+		mp := MergePatch(p.MergePatch)
+		if err := mp.check(); err != nil {
+			return nil, err
+		}
+		patch = mp
+	case *pb.PatchUserRequest_JsonPatch:
+		var jp JSONPatch
+		if err := json.Unmarshal(p.JsonPatch, &jp); err != nil {
+			return nil, badRequest(err)
+		}
+		if err := jp.check(); err != nil {
+			return nil, err
+		}
+		patch = jp
+	default:
+		return nil, ErrBadRequest.WithDetail("missing patch")
+	}
+	return patchUserRequest{Username: req.Username, Patch: patch}, nil
+}
+
+func encodeGRPCPatchUserResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(patchUserResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return &pb.PatchUserReply{}, nil
+}
+
+func decodeGRPCDeleteUserRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.DeleteUserRequest)
+	return deleteUserRequest{Username: req.Username}, nil
+}
+
+func encodeGRPCDeleteUserResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(deleteUserResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return &pb.DeleteUserReply{}, nil
+}
+
+func decodeGRPCRestoreUserRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.RestoreUserRequest)
+	return restoreUserRequest{Username: req.Username}, nil
+}
+
+func encodeGRPCRestoreUserResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(restoreUserResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return &pb.RestoreUserReply{}, nil
+}
+
+func decodeGRPCPurgeUserRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.PurgeUserRequest)
+	return purgeUserRequest{Username: req.Username}, nil
+}
+
+func decodeGRPCUnlockUserRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.UnlockUserRequest)
+	return unlockUserRequest{Username: req.Username}, nil
+}
+
+func encodeGRPCPurgeUserResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(purgeUserResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return &pb.PurgeUserReply{}, nil
+}
+
+func encodeGRPCUnlockUserResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(unlockUserResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return &pb.UnlockUserReply{}, nil
+}
+
+func decodeGRPCListUsersRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.ListUsersRequest)
+	return listUsersRequest{Options: ListOptions{
+		Role:        req.Role,
+		EmailDomain: req.EmailDomain,
+		NamePrefix:  req.NamePrefix,
+		SortBy:      SortField(req.SortBy),
+		Descending:  req.Descending,
+		Limit:       int(req.Limit),
+		Cursor:      req.Cursor,
+	}}, nil
+}
+
+func encodeGRPCListUsersResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(listUsersResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	rep := &pb.ListUsersReply{NextCursor: resp.NextCursor}
+	for _, u := range resp.Users {
+		rep.Users = append(rep.Users, toPBUser(u))
+	}
+	return rep, nil
+}
+
+func decodeGRPCLoginRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.LoginRequest)
+	return loginRequest{Username: req.Username, Password: req.Password, OTP: req.Otp}, nil
+}
+
+func encodeGRPCLoginResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(loginResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return toPBToken(resp.Token), nil
+}
+
+func decodeGRPCRefreshRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.RefreshRequest)
+	return refreshRequest{RefreshToken: req.RefreshToken}, nil
+}
+
+func encodeGRPCRefreshResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(refreshResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return toPBToken(resp.Token), nil
+}
+
+func decodeGRPCLogoutRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.LogoutRequest)
+	return logoutRequest{RefreshToken: req.RefreshToken}, nil
+}
+
+func encodeGRPCLogoutResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(logoutResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return &pb.LogoutReply{}, nil
+}
+
+func decodeGRPCRevokeSessionsRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.RevokeSessionsRequest)
+	return revokeSessionsRequest{Username: req.Username}, nil
+}
+
+func encodeGRPCRevokeSessionsResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(revokeSessionsResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return &pb.RevokeSessionsReply{}, nil
+}
+
+func decodeGRPCEnrollMFARequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.EnrollMFARequest)
+	return enrollMFARequest{Username: req.Username}, nil
+}
+
+func encodeGRPCEnrollMFAResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(enrollMFAResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return &pb.EnrollMFAReply{Secret: resp.Secret, Uri: resp.URI}, nil
+}
+
+func decodeGRPCConfirmMFARequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.ConfirmMFARequest)
+	return confirmMFARequest{Username: req.Username, Code: req.Code}, nil
+}
+
+func decodeGRPCRegenerateRecoveryCodesRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.RegenerateRecoveryCodesRequest)
+	return regenerateRecoveryCodesRequest{Username: req.Username, Code: req.Code}, nil
+}
+
+func encodeGRPCRecoveryCodesResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(recoveryCodesResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return &pb.RecoveryCodesReply{RecoveryCodes: resp.RecoveryCodes}, nil
+}
+
+func decodeGRPCRequestPasswordResetRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.RequestPasswordResetRequest)
+	return requestPasswordResetRequest{Email: req.Email}, nil
+}
+
+func encodeGRPCRequestPasswordResetResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(requestPasswordResetResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return &pb.RequestPasswordResetReply{}, nil
+}
+
+func decodeGRPCResetPasswordRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.ResetPasswordRequest)
+	return resetPasswordRequest{Token: req.Token, Password: req.Password}, nil
+}
+
+func encodeGRPCResetPasswordResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(resetPasswordResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return &pb.ResetPasswordReply{}, nil
+}
+
+func decodeGRPCVerifyEmailRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.VerifyEmailRequest)
+	return verifyEmailRequest{Username: req.Username, Token: req.Token}, nil
+}
+
+func encodeGRPCVerifyEmailResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(verifyEmailResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return &pb.VerifyEmailReply{}, nil
+}
+
+func encodeGRPCPostUserRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(postUserRequest)
+	return &pb.PostUserRequest{User: toPBUser(req.User)}, nil
+}
+
+func decodeGRPCPostUserResponse(_ context.Context, _ interface{}) (interface{}, error) {
+	return postUserResponse{}, nil
+}
+
+func encodeGRPCGetUserRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(getUserRequest)
+	return &pb.GetUserRequest{Username: req.Username}, nil
+}
+
+func decodeGRPCGetUserResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
+	reply := grpcReply.(*pb.GetUserReply)
+	return getUserResponse{User: fromPBUser(reply.User)}, nil
+}
+
+func encodeGRPCPutUserRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(putUserRequest)
+	return &pb.PutUserRequest{Username: req.Username, User: toPBUser(req.User)}, nil
+}
+
+func decodeGRPCPutUserResponse(_ context.Context, _ interface{}) (interface{}, error) {
+	return putUserResponse{}, nil
+}
+
+func encodeGRPCPatchUserRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(patchUserRequest)
+	pbReq := &pb.PatchUserRequest{Username: req.Username}
+	switch p := req.Patch.(type) {
+	case MergePatch:
+		pbReq.Patch = &pb.PatchUserRequest_MergePatch{MergePatch: p}
+	case JSONPatch:
+		b, err := json.Marshal(p)
+		if err != nil {
+			return nil, err
+		}
+		pbReq.Patch = &pb.PatchUserRequest_JsonPatch{JsonPatch: b}
+	default:
+		return nil, fmt.Errorf("can't send patches of type %T", req.Patch)
+	}
+	return pbReq, nil
+}
+
+func decodeGRPCPatchUserResponse(_ context.Context, _ interface{}) (interface{}, error) {
+	return patchUserResponse{}, nil
+}
+
+func encodeGRPCDeleteUserRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(deleteUserRequest)
+	return &pb.DeleteUserRequest{Username: req.Username}, nil
+}
+
+func decodeGRPCDeleteUserResponse(_ context.Context, _ interface{}) (interface{}, error) {
+	return deleteUserResponse{}, nil
+}
+
+func encodeGRPCRestoreUserRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(restoreUserRequest)
+	return &pb.RestoreUserRequest{Username: req.Username}, nil
+}
+
+func decodeGRPCRestoreUserResponse(_ context.Context, _ interface{}) (interface{}, error) {
+	return restoreUserResponse{}, nil
+}
+
+func encodeGRPCPurgeUserRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(purgeUserRequest)
+	return &pb.PurgeUserRequest{Username: req.Username}, nil
+}
+
+func encodeGRPCUnlockUserRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(unlockUserRequest)
+	return &pb.UnlockUserRequest{Username: req.Username}, nil
+}
+
+func decodeGRPCPurgeUserResponse(_ context.Context, _ interface{}) (interface{}, error) {
+	return purgeUserResponse{}, nil
+}
+
+func decodeGRPCUnlockUserResponse(_ context.Context, _ interface{}) (interface{}, error) {
+	return unlockUserResponse{}, nil
+}
+
+func encodeGRPCListUsersRequest(_ context.Context, request interface{}) (interface{}, error) {
+	opts := request.(listUsersRequest).Options
+	return &pb.ListUsersRequest{
+		Role:        opts.Role,
+		EmailDomain: opts.EmailDomain,
+		NamePrefix:  opts.NamePrefix,
+		SortBy:      string(opts.SortBy),
+		Descending:  opts.Descending,
+		Limit:       int32(opts.Limit),
+		Cursor:      opts.Cursor,
+	}, nil
+}
+
+func decodeGRPCListUsersResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
+	reply := grpcReply.(*pb.ListUsersReply)
+	page := UserPage{NextCursor: reply.NextCursor, Users: make([]User, len(reply.Users))}
+	for i, u := range reply.Users {
+		page.Users[i] = fromPBUser(u)
+	}
+	return listUsersResponse{UserPage: page}, nil
+}
+
+func encodeGRPCLoginRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(loginRequest)
+	return &pb.LoginRequest{Username: req.Username, Password: req.Password, Otp: req.OTP}, nil
+}
+
+func decodeGRPCLoginResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
+	return loginResponse{Token: fromPBToken(grpcReply.(*pb.LoginReply))}, nil
+}
+
+func encodeGRPCRefreshRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(refreshRequest)
+	return &pb.RefreshRequest{RefreshToken: req.RefreshToken}, nil
+}
+
+func decodeGRPCRefreshResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
+	return refreshResponse{Token: fromPBToken(grpcReply.(*pb.LoginReply))}, nil
+}
+
+func encodeGRPCLogoutRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(logoutRequest)
+	return &pb.LogoutRequest{RefreshToken: req.RefreshToken}, nil
+}
+
+func decodeGRPCLogoutResponse(_ context.Context, _ interface{}) (interface{}, error) {
+	return logoutResponse{}, nil
+}
+
+func encodeGRPCRevokeSessionsRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(revokeSessionsRequest)
+	return &pb.RevokeSessionsRequest{Username: req.Username}, nil
+}
+
+func decodeGRPCRevokeSessionsResponse(_ context.Context, _ interface{}) (interface{}, error) {
+	return revokeSessionsResponse{}, nil
+}
+
+func encodeGRPCEnrollMFARequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(enrollMFARequest)
+	return &pb.EnrollMFARequest{Username: req.Username}, nil
+}
+
+func decodeGRPCEnrollMFAResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
+	reply := grpcReply.(*pb.EnrollMFAReply)
+	return enrollMFAResponse{MFAEnrollment: MFAEnrollment{Secret: reply.Secret, URI: reply.Uri}}, nil
+}
+
+func encodeGRPCConfirmMFARequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(confirmMFARequest)
+	return &pb.ConfirmMFARequest{Username: req.Username, Code: req.Code}, nil
+}
+
+func encodeGRPCRegenerateRecoveryCodesRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(regenerateRecoveryCodesRequest)
+	return &pb.RegenerateRecoveryCodesRequest{Username: req.Username, Code: req.Code}, nil
+}
+
+func decodeGRPCRecoveryCodesResponse(_ context.Context, grpcReply interface{}) (interface{}, error) {
+	reply := grpcReply.(*pb.RecoveryCodesReply)
+	return recoveryCodesResponse{RecoveryCodes: reply.RecoveryCodes}, nil
+}
+
+func encodeGRPCRequestPasswordResetRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(requestPasswordResetRequest)
+	return &pb.RequestPasswordResetRequest{Email: req.Email}, nil
+}
+
+func decodeGRPCRequestPasswordResetResponse(_ context.Context, _ interface{}) (interface{}, error) {
+	return requestPasswordResetResponse{}, nil
+}
+
+func encodeGRPCResetPasswordRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(resetPasswordRequest)
+	return &pb.ResetPasswordRequest{Token: req.Token, Password: req.Password}, nil
+}
+
+func decodeGRPCResetPasswordResponse(_ context.Context, _ interface{}) (interface{}, error) {
+	return resetPasswordResponse{}, nil
+}
+
+func encodeGRPCVerifyEmailRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(verifyEmailRequest)
+	return &pb.VerifyEmailRequest{Username: req.Username, Token: req.Token}, nil
+}
+
+func decodeGRPCVerifyEmailResponse(_ context.Context, _ interface{}) (interface{}, error) {
+	return verifyEmailResponse{}, nil
+}
@@ -0,0 +1,112 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/AndrewSC208/user-service-go-kit/pb"
+)
+
+// grpcClient serves the service of ts with MakeGRPCServer over an in-memory
+// connection, and returns client endpoints calling it.
+func (ts *testServer) grpcClient() Endpoints {
+	ts.t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	pb.RegisterUsersServer(srv, MakeGRPCServer(ts.service, ts.keys, log.NewNopLogger(), ts.options...))
+	go srv.Serve(lis)
+	ts.t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	ts.t.Cleanup(func() { conn.Close() })
+	return MakeGRPCClientEndpoints(conn)
+}
+
+func TestGRPCErrors(t *testing.T) {
+	ts := newTestServer(t)
+	ts.seed(User{Username: "alice", Email: "alice@example.com", Password: testPassword, Role: "user"})
+	ts.seed(User{Username: "bob", Email: "bob@example.com", Password: testPassword, Role: "user"})
+	c := ts.grpcClient()
+	var (
+		alice = ContextWithToken(context.Background(), ts.token("alice", "user"))
+		admin = ContextWithToken(context.Background(), ts.token("admin", "admin"))
+	)
+
+	for _, tc := range []struct {
+		name    string
+		call    func() error
+		wantErr error
+	}{
+		{"ok", func() error {
+			_, err := c.GetUser(alice, "alice")
+			return err
+		}, nil},
+		{"missing token", func() error {
+			_, err := c.GetUser(context.Background(), "alice")
+			return err
+		}, ErrMissingToken},
+		{"invalid token", func() error {
+			_, err := c.GetUser(ContextWithToken(context.Background(), "garbage"), "alice")
+			return err
+		}, ErrInvalidToken},
+		{"forbidden", func() error {
+			_, err := c.GetUser(alice, "bob")
+			return err
+		}, ErrForbidden},
+		{"not found", func() error {
+			_, err := c.GetUser(admin, "carol")
+			return err
+		}, ErrNotFound},
+		{"already exists", func() error {
+			return c.PostUser(admin, User{Username: "alice", Email: "other@example.com", Password: testPassword})
+		}, ErrAlreadyExists},
+		{"invalid credentials", func() error {
+			_, err := c.Authenticate(context.Background(), "alice", "wrong", "")
+			return err
+		}, ErrInvalidCredentials},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.call(); !errors.Is(err, tc.wantErr) {
+				t.Errorf("err = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+
+	t.Run("validation", func(t *testing.T) {
+		err := c.PostUser(admin, User{Username: "carol", Email: "not an email", Password: testPassword})
+		var ve ValidationError
+		if !errors.As(err, &ve) || !errors.Is(err, ErrValidation) {
+			t.Fatalf("err = %v, want a ValidationError", err)
+		}
+		if len(ve.Fields) != 1 || ve.Fields[0].Field != "email" {
+			t.Errorf("fields = %+v, want one on email", ve.Fields)
+		}
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		token, err := c.Authenticate(context.Background(), "alice", testPassword, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := c.GetUser(ContextWithToken(context.Background(), token.AccessToken), "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Username != "alice" || u.Email != "alice@example.com" || u.Password != "" {
+			t.Errorf("user = %+v, want alice without password", u)
+		}
+	})
+}
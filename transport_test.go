@@ -0,0 +1,297 @@
+package users
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// testArgon2Params make password hashing cheap, so tests don't spend their
+// time in argon2id.
+var testArgon2Params = Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+// testPassword satisfies DefaultPasswordPolicy.
+const testPassword = "correct horse battery staple 1"
+
+// testServer serves a service over in-memory repositories with
+// MakeHTTPHandler, for tests to drive it end to end.
+type testServer struct {
+	*httptest.Server
+	t       *testing.T
+	repo    UserRepository
+	keys    TokenKeys
+	issuer  TokenIssuer
+	service Service // as served, behind the policy and middlewares
+	options []EndpointOption
+}
+
+type testConfig struct {
+	options     []ServiceOption
+	middlewares []Middleware
+	endpoints   []EndpointOption
+}
+
+// testOption configures the service of a testServer.
+type testOption func(*testConfig)
+
+// withServiceOptions passes options to NewService.
+func withServiceOptions(options ...ServiceOption) testOption {
+	return func(c *testConfig) { c.options = append(c.options, options...) }
+}
+
+// withMiddlewares wraps the service, behind the authorization policy, in
+// middlewares.
+func withMiddlewares(middlewares ...Middleware) testOption {
+	return func(c *testConfig) { c.middlewares = append(c.middlewares, middlewares...) }
+}
+
+// withEndpointOptions passes options to MakeHTTPHandler.
+func withEndpointOptions(options ...EndpointOption) testOption {
+	return func(c *testConfig) { c.endpoints = append(c.endpoints, options...) }
+}
+
+func newTestServer(t *testing.T, options ...testOption) *testServer {
+	t.Helper()
+	var c testConfig
+	for _, option := range options {
+		option(&c)
+	}
+	ts := &testServer{
+		t:    t,
+		repo: NewInmemRepository(),
+		keys: NewHS256Keys([]byte("test secret")),
+	}
+	ts.issuer = NewTokenIssuer(ts.keys, "test", time.Minute)
+
+	s := NewService(ts.repo, append([]ServiceOption{
+		WithPasswordHasher(NewPasswordHasher(testArgon2Params)),
+		WithTokenIssuer(ts.issuer),
+	}, c.options...)...)
+	s = AuthorizationMiddleware(DefaultPolicy)(s)
+	for _, mw := range c.middlewares {
+		s = mw(s)
+	}
+	ts.service, ts.options = s, c.endpoints
+	ts.Server = httptest.NewServer(MakeHTTPHandler(s, ts.keys, log.NewNopLogger(), c.endpoints...))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// seed stores u as is, bypassing the policy, with its password hashed.
+func (ts *testServer) seed(u User) UserModel {
+	ts.t.Helper()
+	m := toModel(u)
+	if u.Password != "" {
+		hash, err := NewPasswordHasher(testArgon2Params).Hash(u.Password)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		m.Password = hash
+	}
+	if err := ts.repo.Create(context.Background(), &m); err != nil {
+		ts.t.Fatal(err)
+	}
+	return m
+}
+
+// token returns an access token for username, with role, authenticated with
+// the amr methods, by default a password and a second factor.
+func (ts *testServer) token(username, role string, amr ...string) string {
+	ts.t.Helper()
+	if len(amr) == 0 {
+		amr = []string{AMRPassword, AMROTP, AMRMFA}
+	}
+	t, err := ts.issuer.Issue(User{Username: username, Role: role}, amr...)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return t.AccessToken
+}
+
+// login logs username in over HTTP, with an OTP if not empty, and returns
+// the tokens issued.
+func (ts *testServer) login(username, password, otp string) Token {
+	ts.t.Helper()
+	resp, body := ts.do("POST", "/auth/login", "", loginRequest{Username: username, Password: password, OTP: otp})
+	if resp.StatusCode != http.StatusOK {
+		ts.t.Fatalf("login status = %d: %s", resp.StatusCode, body)
+	}
+	var token Token
+	if err := json.Unmarshal(body, &token); err != nil {
+		ts.t.Fatal(err)
+	}
+	return token
+}
+
+// do sends a request with body, JSON encoded unless nil, as the bearer of
+// token unless empty, with the header name and value pairs. It returns the
+// response and its body.
+func (ts *testServer) do(method, path, token string, body interface{}, header ...string) (*http.Response, []byte) {
+	ts.t.Helper()
+	var r bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&r).Encode(body); err != nil {
+			ts.t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, ts.URL+path, &r)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return resp, b
+}
+
+// waitForMail waits for mailer to have sent n messages, which the service
+// sends in the background, and returns them.
+func waitForMail(t *testing.T, mailer *InmemMailer, n int) []Message {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if ms := mailer.Messages(); len(ms) >= n {
+			return ms
+		}
+	}
+	t.Fatalf("%d messages sent, want %d", len(mailer.Messages()), n)
+	return nil
+}
+
+// mailedToken returns the token query parameter of the first link in m.
+func mailedToken(t *testing.T, m Message) string {
+	t.Helper()
+	for _, field := range strings.Fields(m.Body) {
+		if u, err := url.Parse(field); err == nil && strings.HasPrefix(u.Scheme, "http") {
+			return u.Query().Get("token")
+		}
+	}
+	t.Fatalf("no link in %q", m.Body)
+	return ""
+}
+
+// failingMailer fails to send any message.
+type failingMailer struct{}
+
+func (failingMailer) Send(context.Context, Message) error {
+	return errors.New("smtp: connection refused")
+}
+
+// logRecorder is a logger recording the lines logged, for tests to wait for.
+type logRecorder struct {
+	lines chan []interface{}
+}
+
+func newLogRecorder() logRecorder { return logRecorder{lines: make(chan []interface{}, 16)} }
+
+func (l logRecorder) Log(keyvals ...interface{}) error {
+	l.lines <- keyvals
+	return nil
+}
+
+// next waits for the next line logged.
+func (l logRecorder) next(t *testing.T) []interface{} {
+	t.Helper()
+	select {
+	case line := <-l.lines:
+		return line
+	case <-time.After(time.Second):
+		t.Fatal("nothing logged")
+		return nil
+	}
+}
+
+// problemCode returns the code of the problem in body, empty if none.
+func problemCode(body []byte) string {
+	var e Error
+	if json.Unmarshal(body, &e) != nil {
+		return ""
+	}
+	return e.Code
+}
+
+func TestHTTPCRUD(t *testing.T) {
+	alice := User{Username: "alice", Email: "alice@example.com", Password: testPassword}
+	bob := User{Username: "bob", Email: "bob@example.com", Password: testPassword}
+
+	for _, tc := range []struct {
+		name     string
+		method   string
+		path     string
+		body     interface{}
+		wantCode int
+		wantErr  string
+	}{
+		{"post", "POST", "/users", bob, http.StatusOK, ""},
+		{"post existing", "POST", "/users", User{Username: "alice", Email: "other@example.com", Password: testPassword}, http.StatusBadRequest, "already_exists"},
+		{"post malformed", "POST", "/users", "{", http.StatusBadRequest, "bad_request"},
+		{"get", "GET", "/users/alice", nil, http.StatusOK, ""},
+		{"get unknown", "GET", "/users/bob", nil, http.StatusNotFound, "not_found"},
+		{"put creates", "PUT", "/users/bob", bob, http.StatusOK, ""},
+		{"put replaces", "PUT", "/users/alice", User{Username: "alice", Email: "alice@example.org", FirstName: "Alice"}, http.StatusOK, ""},
+		{"put other username", "PUT", "/users/alice", bob, http.StatusBadRequest, "inconsistent_ids"},
+		{"patch", "PATCH", "/users/alice", map[string]string{"first_name": "Alice"}, http.StatusOK, ""},
+		{"patch unknown", "PATCH", "/users/bob", map[string]string{"first_name": "Bob"}, http.StatusNotFound, "not_found"},
+		{"delete", "DELETE", "/users/alice", nil, http.StatusOK, ""},
+		{"delete unknown", "DELETE", "/users/bob", nil, http.StatusNotFound, "not_found"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.seed(alice)
+			resp, body := ts.do(tc.method, tc.path, ts.token("admin", "admin"), tc.body)
+			if resp.StatusCode != tc.wantCode {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tc.wantCode, body)
+			}
+			if got := problemCode(body); got != tc.wantErr {
+				t.Errorf("problem = %q, want %q", got, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestHTTPPutReplaces(t *testing.T) {
+	ts := newTestServer(t)
+	ts.seed(User{Username: "alice", Email: "alice@example.com", FirstName: "Alice", LastName: "Liddell", Password: testPassword})
+	admin := ts.token("admin", "admin")
+
+	// PUT replaces every field: the last name left out is cleared.
+	resp, body := ts.do("PUT", "/users/alice", admin, User{Username: "alice", Email: "alice@example.com", FirstName: "Al"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT status = %d: %s", resp.StatusCode, body)
+	}
+	_, body = ts.do("GET", "/users/alice", admin, nil)
+	var got getUserResponse
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.User.FirstName != "Al" || got.User.LastName != "" {
+		t.Errorf("user = %+v, want first name Al and no last name", got.User)
+	}
+	if got.User.Password != "" {
+		t.Errorf("password returned: %q", got.User.Password)
+	}
+}
@@ -0,0 +1,414 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// FieldError describes what's wrong with a field of a request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned when a request has invalid fields. It matches
+// ErrValidation and is rendered as a 422 Unprocessable Entity problem, listing
+// every field error so clients can highlight them all at once.
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return "invalid request: " + strings.Join(msgs, "; ")
+}
+
+func (e ValidationError) Unwrap() error { return ErrValidation }
+
+// PasswordPolicy sets the requirements of new passwords.
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+
+	// MinClasses is the number of character classes (lower case, upper case,
+	// digits, others) a password must mix.
+	MinClasses int
+}
+
+// DefaultPasswordPolicy follows NIST SP 800-63B on length, with a mild
+// complexity requirement on top.
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:  8,
+	MaxLength:  128,
+	MinClasses: 2,
+}
+
+// Validator checks the fields of requests before they reach the service.
+type Validator struct {
+	Roles    []string // allowed roles
+	Password PasswordPolicy
+}
+
+// NewValidator returns a Validator allowing the roles declared in p and
+// enforcing DefaultPasswordPolicy.
+func NewValidator(p Policy) Validator {
+	v := Validator{Password: DefaultPasswordPolicy}
+	for role := range p.Roles {
+		v.Roles = append(v.Roles, role)
+	}
+	sort.Strings(v.Roles)
+	return v
+}
+
+// field limits, matching the columns of user_models
+const (
+	maxUsernameLength = 100
+	maxNameLength     = 100
+	maxEmailLength    = 100
+)
+
+// usernameRegexp is the format of new usernames. Users created before it
+// was enforced keep theirs, see Validator.username.
+var usernameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{2,31}$`)
+
+// fieldErrors accumulates the errors of a request.
+type fieldErrors []FieldError
+
+func (fe *fieldErrors) add(field, format string, args ...interface{}) {
+	*fe = append(*fe, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (fe fieldErrors) err() error {
+	if len(fe) == 0 {
+		return nil
+	}
+	return ValidationError{Fields: fe}
+}
+
+// username checks the username of an existing user, which may predate
+// usernameRegexp.
+func (v Validator) username(fe *fieldErrors, field, username string) {
+	switch {
+	case username == "":
+		fe.add(field, "is required")
+	case len(username) > maxUsernameLength:
+		fe.add(field, "must be at most %d characters", maxUsernameLength)
+	}
+}
+
+// newUsername checks the username of a user being created.
+func (v Validator) newUsername(fe *fieldErrors, field, username string) {
+	switch {
+	case username == "":
+		fe.add(field, "is required")
+	case !usernameRegexp.MatchString(username):
+		fe.add(field, "must be 3 to 32 letters, digits, '.', '_' or '-', starting with a letter or digit")
+	}
+}
+
+// email checks the address is a bare RFC 5322 addr-spec, without display
+// name or angle brackets.
+func (v Validator) email(fe *fieldErrors, field, email string) {
+	if email == "" {
+		fe.add(field, "is required")
+		return
+	}
+	addr, err := mail.ParseAddress(email)
+	switch {
+	case err != nil || addr.Address != email:
+		fe.add(field, "must be a valid email address")
+	case len(email) > maxEmailLength:
+		fe.add(field, "must be at most %d characters", maxEmailLength)
+	}
+}
+
+func (v Validator) password(fe *fieldErrors, field, password, username string) {
+	p := v.Password
+	n := len([]rune(password))
+	switch {
+	case password == "":
+		fe.add(field, "is required")
+		return
+	case n < p.MinLength:
+		fe.add(field, "must be at least %d characters", p.MinLength)
+	case p.MaxLength > 0 && n > p.MaxLength:
+		fe.add(field, "must be at most %d characters", p.MaxLength)
+	}
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	if lower+upper+digit+other < p.MinClasses {
+		fe.add(field, "must mix at least %d of lower case, upper case, digits and symbols", p.MinClasses)
+	}
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		fe.add(field, "must not contain the username")
+	}
+}
+
+func (v Validator) totpCode(fe *fieldErrors, field, code string) {
+	if code == "" {
+		fe.add(field, "is required")
+		return
+	}
+	if len(code) != totpDigits || strings.Trim(code, "0123456789") != "" {
+		fe.add(field, "must be %d digits", totpDigits)
+	}
+}
+
+func (v Validator) role(fe *fieldErrors, field, role string) {
+	for _, allowed := range v.Roles {
+		if role == allowed {
+			return
+		}
+	}
+	fe.add(field, "must be one of %s", strings.Join(v.Roles, ", "))
+}
+
+func (v Validator) name(fe *fieldErrors, field, name string) {
+	if len(name) > maxNameLength {
+		fe.add(field, "must be at most %d characters", maxNameLength)
+	}
+}
+
+// user checks u, the user known as username, created if create is true.
+func (v Validator) user(fe *fieldErrors, u User, username string, create bool) {
+	if create {
+		v.newUsername(fe, "username", u.Username)
+	} else {
+		v.username(fe, "username", u.Username)
+	}
+	v.email(fe, "email", u.Email)
+	if create || u.Password != "" {
+		v.password(fe, "password", u.Password, username)
+	}
+	if u.Role != "" {
+		v.role(fe, "role", u.Role)
+	}
+	v.name(fe, "first_name", u.FirstName)
+	v.name(fe, "last_name", u.LastName)
+}
+
+// validatable is implemented by the request types that can be checked by a
+// Validator.
+type validatable interface {
+	validate(v Validator) error
+}
+
+// Validating returns an endpoint middleware rejecting invalid requests with a
+// ValidationError.
+func Validating(v Validator) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if r, ok := request.(validatable); ok {
+				if err := r.validate(v); err != nil {
+					return nil, err
+				}
+			}
+			if r, ok := request.(patchUserRequest); ok {
+				r.Patch = validatedPatch(r.Patch, v, r.Username)
+				request = r
+			}
+			if r, ok := request.(putUserRequest); ok {
+				// Whether a PUT creates the user is only known once read.
+				r.onCreate = func(u User) error {
+					var fe fieldErrors
+					v.newUsername(&fe, "username", u.Username)
+					return fe.err()
+				}
+				request = r
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+func (r postUserRequest) validate(v Validator) error {
+	var fe fieldErrors
+	v.user(&fe, r.User, r.User.Username, true)
+	return fe.err()
+}
+
+func (r getUserRequest) validate(v Validator) error {
+	var fe fieldErrors
+	v.username(&fe, "username", r.Username)
+	return fe.err()
+}
+
+func (r putUserRequest) validate(v Validator) error {
+	var fe fieldErrors
+	v.user(&fe, r.User, r.Username, false) // an existing password is kept
+	return fe.err()
+}
+
+// validate checks the username. The patch is only checked once applied, see
+// validatedPatch.
+func (r patchUserRequest) validate(v Validator) error {
+	var fe fieldErrors
+	v.username(&fe, "username", r.Username)
+	return fe.err()
+}
+
+// validatedPatch makes a Validator check the fields a patch changes. Those it
+// leaves alone are kept as stored, valid or not when the rules were laxer.
+func validatedPatch(p Patch, v Validator, username string) Patch {
+	return checkedPatch{p, func(before, after User) error {
+		var fe fieldErrors
+		if after.Username != before.Username {
+			v.username(&fe, "username", after.Username)
+		}
+		if after.Email != before.Email {
+			v.email(&fe, "email", after.Email)
+		}
+		if after.Password != before.Password {
+			v.password(&fe, "password", after.Password, username)
+		}
+		if after.Role != before.Role && after.Role != "" {
+			v.role(&fe, "role", after.Role)
+		}
+		if after.FirstName != before.FirstName {
+			v.name(&fe, "first_name", after.FirstName)
+		}
+		if after.LastName != before.LastName {
+			v.name(&fe, "last_name", after.LastName)
+		}
+		return fe.err()
+	}}
+}
+
+func (r deleteUserRequest) validate(v Validator) error {
+	var fe fieldErrors
+	v.username(&fe, "username", r.Username)
+	return fe.err()
+}
+
+func (r restoreUserRequest) validate(v Validator) error {
+	var fe fieldErrors
+	v.username(&fe, "username", r.Username)
+	return fe.err()
+}
+
+func (r purgeUserRequest) validate(v Validator) error {
+	var fe fieldErrors
+	v.username(&fe, "username", r.Username)
+	return fe.err()
+}
+
+func (r unlockUserRequest) validate(v Validator) error {
+	var fe fieldErrors
+	v.username(&fe, "username", r.Username)
+	return fe.err()
+}
+
+func (r listUsersRequest) validate(v Validator) error {
+	var fe fieldErrors
+	opts := r.Options
+	if opts.Role != "" {
+		v.role(&fe, "role", opts.Role)
+	}
+	switch opts.SortBy {
+	case "", SortByCreated, SortByUpdated, SortByUsername:
+	default:
+		fe.add("sort", "must be one of %s, %s or %s", SortByCreated, SortByUpdated, SortByUsername)
+	}
+	if opts.Limit < 0 || opts.Limit > MaxListLimit {
+		fe.add("limit", "must be between 1 and %d", MaxListLimit)
+	}
+	return fe.err()
+}
+
+func (r refreshRequest) validate(v Validator) error {
+	var fe fieldErrors
+	if r.RefreshToken == "" {
+		fe.add("refresh_token", "is required")
+	}
+	return fe.err()
+}
+
+func (r logoutRequest) validate(v Validator) error {
+	var fe fieldErrors
+	if r.RefreshToken == "" {
+		fe.add("refresh_token", "is required")
+	}
+	return fe.err()
+}
+
+func (r revokeSessionsRequest) validate(v Validator) error {
+	var fe fieldErrors
+	v.username(&fe, "username", r.Username)
+	return fe.err()
+}
+
+func (r enrollMFARequest) validate(v Validator) error {
+	var fe fieldErrors
+	v.username(&fe, "username", r.Username)
+	return fe.err()
+}
+
+func (r confirmMFARequest) validate(v Validator) error {
+	var fe fieldErrors
+	v.username(&fe, "username", r.Username)
+	v.totpCode(&fe, "code", r.Code)
+	return fe.err()
+}
+
+func (r regenerateRecoveryCodesRequest) validate(v Validator) error {
+	var fe fieldErrors
+	v.username(&fe, "username", r.Username)
+	v.totpCode(&fe, "code", r.Code)
+	return fe.err()
+}
+
+func (r requestPasswordResetRequest) validate(v Validator) error {
+	var fe fieldErrors
+	v.email(&fe, "email", r.Email)
+	return fe.err()
+}
+
+func (r resetPasswordRequest) validate(v Validator) error {
+	var fe fieldErrors
+	if r.Token == "" {
+		fe.add("token", "is required")
+	}
+	v.password(&fe, "password", r.Password, "")
+	return fe.err()
+}
+
+func (r verifyEmailRequest) validate(v Validator) error {
+	var fe fieldErrors
+	v.username(&fe, "username", r.Username)
+	if r.Token == "" {
+		fe.add("token", "is required")
+	}
+	return fe.err()
+}
+
+func (r loginRequest) validate(v Validator) error {
+	var fe fieldErrors
+	if r.Username == "" {
+		fe.add("username", "is required")
+	}
+	if r.Password == "" {
+		fe.add("password", "is required")
+	}
+	return fe.err()
+}
@@ -0,0 +1,111 @@
+package users
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHTTPValidation(t *testing.T) {
+	long := strings.Repeat("a", maxNameLength+1)
+
+	for _, tc := range []struct {
+		name       string
+		method     string
+		path       string
+		body       interface{}
+		wantCode   int
+		wantFields string
+	}{
+		{"post", "POST", "/users", User{Username: "carol", Email: "carol@example.com", Password: testPassword}, http.StatusOK, ""},
+		{"post short username", "POST", "/users", User{Username: "cj", Email: "cj@example.com", Password: testPassword}, http.StatusUnprocessableEntity, "username"},
+		{"post username with space", "POST", "/users", User{Username: "carol c", Email: "carol@example.com", Password: testPassword}, http.StatusUnprocessableEntity, "username"},
+		{"post bad email", "POST", "/users", User{Username: "carol", Email: "Carol <carol@example.com>", Password: testPassword}, http.StatusUnprocessableEntity, "email"},
+		{"post short password", "POST", "/users", User{Username: "carol", Email: "carol@example.com", Password: "a1"}, http.StatusUnprocessableEntity, "password"},
+		{"post one class password", "POST", "/users", User{Username: "carol", Email: "carol@example.com", Password: "abcdefghij"}, http.StatusUnprocessableEntity, "password"},
+		{"post password with username", "POST", "/users", User{Username: "carol", Email: "carol@example.com", Password: "Carol-1234"}, http.StatusUnprocessableEntity, "password"},
+		{"post long name", "POST", "/users", User{Username: "carol", Email: "carol@example.com", Password: testPassword, FirstName: long}, http.StatusUnprocessableEntity, "first_name"},
+		{"post everything wrong", "POST", "/users", User{Username: "", Email: "", Password: "", Role: "root"}, http.StatusUnprocessableEntity, "username email password role"},
+		{"put creates", "PUT", "/users/carol", User{Username: "carol", Email: "carol@example.com"}, http.StatusOK, ""},
+		{"put creates short username", "PUT", "/users/cj", User{Username: "cj", Email: "cj@example.com"}, http.StatusUnprocessableEntity, "username"},
+
+		// Users created before the username format was enforced can still
+		// be looked up and updated.
+		{"get legacy", "GET", "/users/al", nil, http.StatusOK, ""},
+		{"put legacy", "PUT", "/users/al", User{Username: "al", Email: "al@example.org"}, http.StatusOK, ""},
+		{"put legacy bad email", "PUT", "/users/al", User{Username: "al", Email: "al"}, http.StatusUnprocessableEntity, "email"},
+		{"patch legacy", "PATCH", "/users/al", map[string]string{"first_name": "Al"}, http.StatusOK, ""},
+		{"patch legacy bad email", "PATCH", "/users/al", map[string]string{"email": "al"}, http.StatusUnprocessableEntity, "email"},
+		{"delete legacy", "DELETE", "/users/al", nil, http.StatusOK, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.seed(User{Username: "al", Email: "al@example.com", Password: testPassword, Role: "user"})
+			resp, body := ts.do(tc.method, tc.path, ts.token("admin", "admin"), tc.body)
+			if resp.StatusCode != tc.wantCode {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tc.wantCode, body)
+			}
+			if tc.wantFields == "" {
+				return
+			}
+			var problem struct {
+				Fields []FieldError `json:"fields"`
+			}
+			if err := json.Unmarshal(body, &problem); err != nil {
+				t.Fatal(err)
+			}
+			var fields []string
+			for _, f := range problem.Fields {
+				fields = append(fields, f.Field)
+			}
+			if got := strings.Join(fields, " "); got != tc.wantFields {
+				t.Errorf("fields = %q, want %q", got, tc.wantFields)
+			}
+		})
+	}
+}
+
+func TestHTTPPatchValidatesChanges(t *testing.T) {
+	long := strings.Repeat("a", maxNameLength+1)
+
+	for _, tc := range []struct {
+		name       string
+		patch      map[string]string
+		wantCode   int
+		wantFields string
+	}{
+		{"other field", map[string]string{"last_name": "Liddell"}, http.StatusOK, ""},
+		{"same values", map[string]string{"email": "al", "first_name": long}, http.StatusOK, ""},
+		{"email", map[string]string{"email": "al@"}, http.StatusUnprocessableEntity, "email"},
+		{"first name", map[string]string{"first_name": long + "a"}, http.StatusUnprocessableEntity, "first_name"},
+		{"role", map[string]string{"role": "root"}, http.StatusUnprocessableEntity, "role"},
+		{"password", map[string]string{"password": "lowercaseonly"}, http.StatusUnprocessableEntity, "password"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			// Stored before the rules it breaks were enforced.
+			ts.seed(User{Username: "al", Email: "al", FirstName: long, Password: testPassword, Role: "user"})
+			resp, body := ts.do("PATCH", "/users/al", ts.token("admin", "admin"), tc.patch)
+			if resp.StatusCode != tc.wantCode {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tc.wantCode, body)
+			}
+			if tc.wantFields == "" {
+				return
+			}
+			var problem struct {
+				Fields []FieldError `json:"fields"`
+			}
+			if err := json.Unmarshal(body, &problem); err != nil {
+				t.Fatal(err)
+			}
+			var fields []string
+			for _, f := range problem.Fields {
+				fields = append(fields, f.Field)
+			}
+			if got := strings.Join(fields, " "); got != tc.wantFields {
+				t.Errorf("fields = %q, want %q", got, tc.wantFields)
+			}
+		})
+	}
+}
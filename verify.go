@@ -0,0 +1,78 @@
+package users
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrInvalidVerificationToken is returned for email verification tokens that
+// are forged, expired, or for an address the user no longer has to verify.
+var ErrInvalidVerificationToken = newError("invalid_verification_token", http.StatusBadRequest, "invalid or expired email verification token")
+
+// DefaultEmailVerificationTTL is how long email verification links can be
+// used, by default.
+const DefaultEmailVerificationTTL = 48 * time.Hour
+
+// verificationClaims are what email verification tokens vouch for: the user
+// received a mail at the address.
+type verificationClaims struct {
+	Username  string `json:"u"`
+	Email     string `json:"e"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// signVerificationToken returns c, signed with HMAC SHA-256 and key. Unlike
+// password reset tokens, they aren't stored: the state of the user, whose
+// email is verified or pending, tells whether they were used.
+func signVerificationToken(key []byte, c verificationClaims) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	p := base64.RawURLEncoding.EncodeToString(payload)
+	return p + "." + base64.RawURLEncoding.EncodeToString(macOf(key, p)), nil
+}
+
+// parseVerificationToken verifies the signature and expiry of token, and
+// returns its claims.
+func parseVerificationToken(key []byte, token string, now time.Time) (verificationClaims, error) {
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return verificationClaims{}, ErrInvalidVerificationToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil || !hmac.Equal(sig, macOf(key, token[:i])) {
+		return verificationClaims{}, ErrInvalidVerificationToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(token[:i])
+	if err != nil {
+		return verificationClaims{}, ErrInvalidVerificationToken
+	}
+	var c verificationClaims
+	if err := json.Unmarshal(payload, &c); err != nil || now.Unix() >= c.ExpiresAt {
+		return verificationClaims{}, ErrInvalidVerificationToken
+	}
+	return c, nil
+}
+
+func macOf(key []byte, s string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+// verificationMessage is the email sent with a verification link.
+func verificationMessage(to, link string, ttl time.Duration) Message {
+	return Message{
+		To:      to,
+		Subject: "Verify your email address",
+		Body: "Please confirm this is your email address by following this link within " + ttl.String() + ":\n\n" +
+			link + "\n\n" +
+			"If you didn't sign up or change your email, ignore this email.\n",
+	}
+}
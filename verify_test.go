@@ -0,0 +1,179 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerificationToken(t *testing.T) {
+	var (
+		key    = []byte("verification key")
+		now    = time.Unix(1700000000, 0)
+		claims = verificationClaims{Username: "alice", Email: "alice@example.com", ExpiresAt: now.Add(time.Hour).Unix()}
+	)
+	sign := func(key []byte, c verificationClaims) string {
+		token, err := signVerificationToken(key, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	split := func(token string) (payload, sig string) {
+		i := strings.IndexByte(token, '.')
+		return token[:i], token[i+1:]
+	}
+	valid := sign(key, claims)
+	payload, sig := split(valid)
+	bob, _ := split(sign(key, verificationClaims{Username: "bob", Email: "alice@example.com", ExpiresAt: claims.ExpiresAt}))
+
+	for _, tc := range []struct {
+		name    string
+		token   string
+		now     time.Time
+		wantErr bool
+	}{
+		{"valid", valid, now, false},
+		{"expired", valid, now.Add(time.Hour), true},
+		{"other key", sign([]byte("other key"), claims), now, true},
+		{"other payload", bob + "." + sig, now, true},
+		{"unsigned", payload, now, true},
+		{"garbage", "not.a-token", now, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseVerificationToken(key, tc.token, tc.now)
+			if tc.wantErr {
+				if err != ErrInvalidVerificationToken {
+					t.Errorf("err = %v, want %v", err, ErrInvalidVerificationToken)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != claims {
+				t.Errorf("claims = %+v, want %+v", got, claims)
+			}
+		})
+	}
+}
+
+func TestHTTPVerifyEmail(t *testing.T) {
+	mailer := NewInmemMailer()
+	ts := newTestServer(t, withServiceOptions(
+		WithEmailVerification(mailer, []byte("verification key"), "http://localhost/verify", time.Hour),
+	))
+	admin := ts.token("admin", "admin")
+	get := func() User {
+		_, body := ts.do("GET", "/users/alice", admin, nil)
+		var got getUserResponse
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatal(err)
+		}
+		return got.User
+	}
+	verify := func(token string) (int, string) {
+		resp, body := ts.do("POST", "/users/alice/email/verify", "", verifyEmailRequest{Token: token})
+		return resp.StatusCode, problemCode(body)
+	}
+
+	// Creating alice mails a link to verify her email.
+	resp, body := ts.do("POST", "/users", admin, User{Username: "alice", Email: "alice@example.com", Password: testPassword, Role: "user"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST status = %d: %s", resp.StatusCode, body)
+	}
+	mail := waitForMail(t, mailer, 1)[0]
+	if mail.To != "alice@example.com" || !strings.Contains(mail.Body, "username=alice") {
+		t.Errorf("mailed %+v, want a link for alice to alice@example.com", mail)
+	}
+	first := mailedToken(t, mail)
+	if u := get(); u.EmailVerified {
+		t.Error("email verified before following the link")
+	}
+
+	// A new email is pending until verified, and supersedes the first link.
+	resp, body = ts.do("PATCH", "/users/alice", admin, map[string]string{"email": "alice@example.org"}, "Content-Type", MergePatchType)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PATCH status = %d: %s", resp.StatusCode, body)
+	}
+	if u := get(); u.Email != "alice@example.com" || u.PendingEmail != "alice@example.org" {
+		t.Errorf("email %q pending %q, want alice@example.com pending alice@example.org", u.Email, u.PendingEmail)
+	}
+	mail = waitForMail(t, mailer, 2)[1]
+	if mail.To != "alice@example.org" {
+		t.Errorf("mailed to %s, want alice@example.org", mail.To)
+	}
+	second := mailedToken(t, mail)
+
+	for _, tc := range []struct {
+		name     string
+		token    string
+		wantCode int
+		wantErr  string
+	}{
+		{"forged", second + "x", http.StatusBadRequest, "invalid_verification_token"},
+		{"pending email", second, http.StatusOK, ""},
+		{"used", second, http.StatusBadRequest, "invalid_verification_token"},
+		{"superseded", first, http.StatusBadRequest, "invalid_verification_token"},
+	} {
+		if code, problem := verify(tc.token); code != tc.wantCode || problem != tc.wantErr {
+			t.Errorf("%s: status %d, problem %q; want %d, %q", tc.name, code, problem, tc.wantCode, tc.wantErr)
+		}
+	}
+	if u := get(); u.Email != "alice@example.org" || !u.EmailVerified || u.PendingEmail != "" {
+		t.Errorf("email %q verified %v pending %q, want alice@example.org verified", u.Email, u.EmailVerified, u.PendingEmail)
+	}
+}
+
+func TestHTTPVerifyEmailLinks(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		ttl      time.Duration
+		user     string // whose email is verified with alice's link
+		wantCode int
+	}{
+		{"valid", time.Hour, "alice", http.StatusOK},
+		{"expired", -time.Second, "alice", http.StatusBadRequest},
+		{"other user", time.Hour, "bob", http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mailer := NewInmemMailer()
+			ts := newTestServer(t, withServiceOptions(
+				WithEmailVerification(mailer, []byte("verification key"), "http://localhost/verify", tc.ttl),
+			))
+			ts.seed(User{Username: "bob", Email: "bob@example.com", Password: testPassword, Role: "user"})
+			admin := ts.token("admin", "admin")
+			ts.do("POST", "/users", admin, User{Username: "alice", Email: "alice@example.com", Password: testPassword, Role: "user"})
+			token := mailedToken(t, waitForMail(t, mailer, 1)[0])
+
+			resp, body := ts.do("POST", "/users/"+tc.user+"/email/verify", "", verifyEmailRequest{Token: token})
+			if resp.StatusCode != tc.wantCode {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode, tc.wantCode, body)
+			}
+		})
+	}
+}
+
+func TestHTTPVerificationMailFailure(t *testing.T) {
+	logs := newLogRecorder()
+	ts := newTestServer(t, withServiceOptions(
+		WithLogger(logs),
+		WithEmailVerification(failingMailer{}, []byte("verification key"), "http://localhost/verify", time.Hour),
+	))
+	admin := ts.token("admin", "admin")
+
+	// The user is written whether or not the mail goes out.
+	resp, body := ts.do("POST", "/users", admin, User{Username: "alice", Email: "alice@example.com", Password: testPassword, Role: "user"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode, body)
+	}
+	if line := fmt.Sprint(logs.next(t)); line != "[op sendVerification err smtp: connection refused]" {
+		t.Errorf("logged %s", line)
+	}
+	if resp, _ := ts.do("GET", "/users/alice", admin, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}